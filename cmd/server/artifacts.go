@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/artifacts"
+)
+
+// artifactsDir is where the artifacts of each job are kept, in a directory named by its ID
+const artifactsDir = "./artifacts"
+
+func jobArtifactsDir(id uuid.UUID) string {
+	return filepath.Join(artifactsDir, id.String())
+}
+
+// handleUploadArtifacts extracts the tar archive sent by the worker into the artifacts of the job
+func (h *httpServer) handleUploadArtifacts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := uuid.FromString(vars["id"])
+		if err != nil {
+			errorHttp(w, "invalid uuid", http.StatusBadRequest)
+			return
+		}
+
+		job, err := h.db.GetById(r.Context(), id)
+		if err != nil || job == nil {
+			errorHttp(w, "job with given ID not found", http.StatusNotFound)
+			return
+		}
+
+		defer r.Body.Close()
+		err = artifacts.Extract(r.Body, jobArtifactsDir(id), int64(h.artifactsMax))
+		if errors.Is(err, artifacts.ErrTooLarge) {
+			errorHttp(w, fmt.Sprintf("artifacts are larger than %s", h.artifactsMax), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			errorHttp(w, "Error extracting artifacts: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		files, err := artifacts.List(jobArtifactsDir(id))
+		if err != nil {
+			errorHttp(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("stored artifacts of job %s, it has %d files\n", id, len(files))
+		_ = json.NewEncoder(w).Encode(files)
+	}
+}
+
+// handleListArtifacts lists the artifacts of a job, or sends all of them as a tar archive with ?tar
+func (h *httpServer) handleListArtifacts() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := uuid.FromString(vars["id"])
+		if err != nil {
+			errorHttp(w, "invalid uuid", http.StatusBadRequest)
+			return
+		}
+
+		if r.URL.Query().Has("tar") {
+			serveArtifact(w, r, jobArtifactsDir(id))
+			return
+		}
+
+		files, err := artifacts.List(jobArtifactsDir(id))
+		if err != nil {
+			errorHttp(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if files == nil {
+			files = []artifacts.File{}
+		}
+		_ = json.NewEncoder(w).Encode(files)
+	}
+}
+
+// handleGetArtifact downloads a file of the artifacts of a job, or a directory as a tar archive
+func (h *httpServer) handleGetArtifact() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := uuid.FromString(vars["id"])
+		if err != nil {
+			errorHttp(w, "invalid uuid", http.StatusBadRequest)
+			return
+		}
+
+		p, err := artifacts.CleanPath(vars["path"])
+		if err != nil {
+			errorHttp(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		serveArtifact(w, r, filepath.Join(jobArtifactsDir(id), filepath.FromSlash(p)))
+	}
+}
+
+// serveArtifact sends a file as it is and a directory as a tar archive
+func serveArtifact(w http.ResponseWriter, r *http.Request, p string) {
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		errorHttp(w, "artifact not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		errorHttp(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if info.IsDir() {
+		w.Header().Set("Content-Type", "application/x-tar")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", info.Name()+".tar"))
+		if err := artifacts.WriteTar(w, p); err != nil {
+			// the headers have already been sent, the client gets a truncated archive
+			log.Printf("error sending artifacts %s: %v\n", p, err)
+		}
+		return
+	}
+
+	f, err := os.Open(p)
+	if err != nil {
+		errorHttp(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(filepath.ToSlash(p))))
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
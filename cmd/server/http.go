@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -9,6 +11,8 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/gorilla/handlers"
@@ -17,13 +21,26 @@ import (
 	"github.com/hpcloud/tail"
 	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/database"
 	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/lifecycle"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/workers"
 )
 
-func startHttp(quit <-chan struct{}, cfg conf, db database.Database, finished chan<- struct{}) error {
+// startHttp serves the API until the shutdown starts, and then waits for the requests in flight
+// until the shutdown deadline
+func startHttp(lc *lifecycle.Manager, cfg conf, db database.Database) error {
 	r := mux.NewRouter()
 
 	s := &httpServer{
-		db: db,
+		db:       db,
+		queues:   cfg.Queues,
+		preempt:  cfg.Preempt,
+		limits:   cfg.Limits,
+		keyTTL:   cfg.IdempotencyTTL,
+		shutdown: make(chan struct{}),
+
+		artifactsMax: cfg.ArtifactsMaxSize,
+		registries:   normalizeRegistries(cfg.Registries),
+		workerTokens: cfg.WorkerTokens,
 		t: &telegramClient{
 			Token:  cfg.Telegram.Token,
 			ChatId: cfg.Telegram.ChatId,
@@ -32,17 +49,40 @@ func startHttp(quit <-chan struct{}, cfg conf, db database.Database, finished ch
 
 	r.HandleFunc("/experiments", s.handleGetJobs()).Methods("GET")
 	r.HandleFunc("/experiments", s.handleNewJob()).Methods("POST")
+	r.HandleFunc("/experiments/hold", s.handleBulkStatus(db.Hold)).Methods("POST")
+	r.HandleFunc("/experiments/release", s.handleBulkStatus(db.Release)).Methods("POST")
 	r.HandleFunc("/experiments/{id}", s.handleGetById()).Methods("GET")
 	r.HandleFunc("/experiments/{id}", s.handleJobUpdate()).Methods("PUT")
+	r.HandleFunc("/experiments/{id}/cancel", s.handleCancel()).Methods("POST")
+	r.HandleFunc("/experiments/{id}/hold", s.handleStatus(db.Hold)).Methods("POST")
+	r.HandleFunc("/experiments/{id}/release", s.handleStatus(db.Release)).Methods("POST")
+	r.HandleFunc("/experiments/{id}/stats", s.handleGetStats()).Methods("GET")
+	r.HandleFunc("/experiments/{id}/stats", s.handleAddStats()).Methods("POST")
+	r.HandleFunc("/experiments/{id}/pull", s.handleSetPull()).Methods("POST")
+	r.HandleFunc("/experiments/{id}/artifacts", s.handleListArtifacts()).Methods("GET")
+	r.HandleFunc("/experiments/{id}/artifacts", s.handleUploadArtifacts()).Methods("POST")
+	r.HandleFunc("/experiments/{id}/artifacts/{path:.+}", s.handleGetArtifact()).Methods("GET")
+	r.HandleFunc("/deadletter", s.handleDeadLetters()).Methods("GET")
+	r.HandleFunc("/deadletter/requeue", s.handleBulkStatus(db.Requeue)).Methods("POST")
 	r.HandleFunc("/logs/{id}", s.handleGetLogs()).Methods("GET")
 	r.HandleFunc("/logs/{id}/tail", s.handleFollowLogs()).Methods("GET")
 
+	r.HandleFunc("/workers", s.handleGetWorkers()).Methods("GET")
+	r.HandleFunc("/workers/register", s.handleWorkerRegister()).Methods("POST")
+	r.HandleFunc("/workers/{id}/cordon", s.handleCordon(cordonWorker)).Methods("POST")
+	r.HandleFunc("/workers/{id}/drain", s.handleCordon(drainWorker)).Methods("POST")
+	r.HandleFunc("/workers/{id}/uncordon", s.handleCordon(uncordonWorker)).Methods("POST")
 	r.HandleFunc("/workers/poll", s.handleWorkerFetch()).Methods("GET")
+	r.HandleFunc("/workers/heartbeat", s.handleWorkerHeartbeat()).Methods("POST")
+	r.HandleFunc("/workers/return", s.handleWorkerReturn()).Methods("POST")
+	r.HandleFunc("/workers/registries/{registry}", s.handleRegistryAuth()).Methods("GET")
+	r.HandleFunc("/workers/images", s.handleQueuedImages()).Methods("GET")
 	r.HandleFunc("/logs/{id}/upload", s.handleWorkerLogs()).Methods("GET")
 
+	tokens := append(append([]string{}, cfg.Tokens...), cfg.WorkerTokens...)
 	h := handlers.RecoveryHandler(handlers.PrintRecoveryStack(true))(
 		handlers.CombinedLoggingHandler(os.Stderr,
-			handlers.CompressHandler(authMiddleware(r, cfg.Tokens))))
+			handlers.CompressHandler(authMiddleware(r, tokens))))
 
 	srv := &http.Server{
 		Addr: cfg.Http.Listen,
@@ -52,13 +92,14 @@ func startHttp(quit <-chan struct{}, cfg conf, db database.Database, finished ch
 		IdleTimeout: cfg.Http.IdleTimeout,
 		Handler:     h,
 	}
+	srv.RegisterOnShutdown(func() { close(s.shutdown) })
 
 	idleConnsClosed := make(chan struct{})
 	go func() {
-		<-quit
+		<-lc.Closing()
 
 		// We received an interrupt signal, shut down.
-		if err := srv.Shutdown(context.Background()); err != nil {
+		if err := srv.Shutdown(lc.Context()); err != nil {
 			// Error from closing listeners, or context timeout:
 			log.Printf("error http server shutdown: %v", err)
 		}
@@ -72,30 +113,420 @@ func startHttp(quit <-chan struct{}, cfg conf, db database.Database, finished ch
 	}
 
 	<-idleConnsClosed
-	finished <- struct{}{}
 
 	return nil
 }
 
 type httpServer struct {
-	db database.Database
-	t  *telegramClient
+	db      database.Database
+	queues  map[string]queueConfig
+	preempt preemptionConfig
+	limits  []database.Limit
+	keyTTL  time.Duration
+	t       *telegramClient
+	// shutdown is closed when the http server is shutting down, so that the waiting polls return
+	shutdown chan struct{}
+	// artifactsMax is the most bytes of artifacts a worker can upload at once, zero for no limit
+	artifactsMax jobs.Size
+	// registries are the credentials of the container registries by normalized host
+	registries map[string]workers.RegistryAuth
+	// workerTokens are the tokens that can get the credentials of the registries
+	workerTokens []string
 }
 
+const (
+	// maxPollWait is the longest a worker can wait in /workers/poll
+	maxPollWait = time.Minute
+	// maxPollJobs is the most jobs a worker can claim in one /workers/poll
+	maxPollJobs = 32
+	// pollRetry is how often a waiting poll looks for new jobs
+	pollRetry = time.Second
+	// defaultQueuedImages is how many images /workers/images returns by default
+	defaultQueuedImages = 5
+)
+
+// handleWorkerFetch claims jobs for a worker. With "max", up to that many jobs are claimed and
+// returned as a list; with "wait", the request blocks until some job is available or the time is up.
+// Without "max" a single job is returned, as the older workers expect.
 func (h *httpServer) handleWorkerFetch() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		job, err := h.db.FetchJob(r.Context())
+		q := r.URL.Query()
+
+		max := 1
+		if v := q.Get("max"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				errorHttp(w, "invalid max", http.StatusBadRequest)
+				return
+			}
+			if n > maxPollJobs {
+				n = maxPollJobs
+			}
+			max = n
+		}
+
+		var wait time.Duration
+		if v := q.Get("wait"); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil || d < 0 {
+				errorHttp(w, "invalid wait", http.StatusBadRequest)
+				return
+			}
+			if d > maxPollWait {
+				d = maxPollWait
+			}
+			wait = d
+		}
+
+		// the workers that report their free GPUs only get the jobs that fit in them
+		var gpus *int
+		if v := q.Get("gpus"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				errorHttp(w, "invalid gpus", http.StatusBadRequest)
+				return
+			}
+			gpus = &n
+		}
+
+		workerID, _ := uuid.FromString(q.Get("worker"))
+		claimed, err := h.pollJobs(r.Context(), workerID, max, gpus, wait)
 		if err != nil {
-			errorHttp(w, "Error fetching jobs: "+err.Error(), http.StatusInternalServerError)
+			errorHttp(w, "Error polling jobs: "+err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		if job == nil {
+		if len(claimed) == 0 {
 			errorHttp(w, "No job found", http.StatusNoContent)
 			return
 		}
 
-		_ = json.NewEncoder(w).Encode(job)
+		// the worker left while the jobs were being claimed, nobody is going to run them
+		if r.Context().Err() != nil {
+			h.returnJobs(workerID, claimed)
+			return
+		}
+
+		if q.Get("max") == "" {
+			_ = json.NewEncoder(w).Encode(claimed[0])
+			return
+		}
+		_ = json.NewEncoder(w).Encode(claimed)
+	}
+}
+
+// pollJobs claims up to max jobs for a worker, waiting up to wait for the first one to be available.
+// If gpus is not nil, the jobs claimed need at most that many GPUs between all of them.
+func (h *httpServer) pollJobs(ctx context.Context, workerID uuid.UUID, max int, gpus *int, wait time.Duration) ([]jobs.Job, error) {
+	deadline := time.NewTimer(wait)
+	defer deadline.Stop()
+	retry := time.NewTicker(pollRetry)
+	defer retry.Stop()
+
+	for {
+		if workerID != uuid.Nil {
+			worker, err := h.db.GetWorker(ctx, workerID)
+			if err != nil {
+				return nil, fmt.Errorf("getting worker: %w", err)
+			}
+			if worker != nil && worker.Cordoned {
+				return nil, nil
+			}
+		}
+
+		params := database.FetchParams{Limits: h.limits, Worker: workerID}
+		if gpus != nil {
+			free := *gpus
+			params.MaxGPUs = &free
+		}
+
+		var claimed []jobs.Job
+		for len(claimed) < max {
+			job, err := h.db.FetchJob(ctx, params)
+			if err != nil {
+				if len(claimed) != 0 {
+					log.Printf("error fetching jobs, giving the %d already claimed: %v\n", len(claimed), err)
+					return claimed, nil
+				}
+				return nil, fmt.Errorf("fetching jobs: %w", err)
+			}
+			if job == nil {
+				break
+			}
+			claimed = append(claimed, *job)
+			if params.MaxGPUs != nil {
+				*params.MaxGPUs -= job.GPUs
+			}
+		}
+		if len(claimed) != 0 {
+			return claimed, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, nil
+		case <-h.shutdown:
+			return nil, nil
+		case <-deadline.C:
+			return nil, nil
+		case <-retry.C:
+		}
+	}
+}
+
+// returnJobs enqueues again jobs claimed for a worker that could not be given to it
+func (h *httpServer) returnJobs(workerID uuid.UUID, claimed []jobs.Job) {
+	ids := make([]uuid.UUID, len(claimed))
+	for i, job := range claimed {
+		ids[i] = job.ID
+	}
+
+	returned, err := h.db.ReturnJobs(context.Background(), workerID, ids)
+	if err != nil {
+		log.Printf("error returning jobs of worker %s: %v\n", workerID, err)
+		return
+	}
+	for _, job := range returned {
+		log.Printf("worker %s left before receiving job %s, enqueued again\n", workerID, job.ID)
+	}
+}
+
+func (h *httpServer) handleWorkerRegister() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var reg workers.Registration
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&reg); err != nil {
+			errorHttp(w, "Error decoding json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if reg.Name == "" {
+			reg.Name = reg.Hostname
+		}
+		if reg.Name == "" {
+			errorHttp(w, "name or hostname is required", http.StatusBadRequest)
+			return
+		}
+
+		worker, err := h.db.RegisterWorker(r.Context(), reg)
+		if err != nil {
+			errorHttp(w, "Error registering worker: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("worker %s (%s) registered from %s with version %s\n", worker.Name, worker.ID, worker.Hostname, worker.Version)
+		_ = json.NewEncoder(w).Encode(worker)
+	}
+}
+
+func (h *httpServer) handleGetWorkers() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ws, err := h.db.GetWorkers(r.Context())
+		if err != nil {
+			errorHttp(w, "Error getting workers: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if ws == nil {
+			ws = []workers.Worker{}
+		}
+		_ = json.NewEncoder(w).Encode(ws)
+	}
+}
+
+// drainRequest is the body of a drain request
+type drainRequest struct {
+	// Requeue stops the running jobs and enqueues them again instead of waiting for them
+	Requeue bool `json:"requeue"`
+}
+
+// cordonChange returns the new cordon state of a worker given its current one and the request
+type cordonChange func(*workers.Worker, *http.Request) (bool, workers.DrainMode, error)
+
+func cordonWorker(w *workers.Worker, _ *http.Request) (bool, workers.DrainMode, error) {
+	return true, w.Drain, nil
+}
+
+func drainWorker(_ *workers.Worker, r *http.Request) (bool, workers.DrainMode, error) {
+	var req drainRequest
+	defer r.Body.Close()
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+		return false, "", err
+	}
+
+	if req.Requeue {
+		return true, workers.DrainRequeue, nil
+	}
+	return true, workers.DrainWait, nil
+}
+
+func uncordonWorker(_ *workers.Worker, _ *http.Request) (bool, workers.DrainMode, error) {
+	return false, "", nil
+}
+
+// handleCordon changes whether a worker can be given new jobs and how it is being drained
+func (h *httpServer) handleCordon(change cordonChange) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := uuid.FromString(vars["id"])
+		if err != nil {
+			errorHttp(w, "invalid uuid", http.StatusBadRequest)
+			return
+		}
+
+		worker, err := h.db.GetWorker(r.Context(), id)
+		if err != nil {
+			errorHttp(w, "Error getting worker: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if worker == nil {
+			errorHttp(w, "worker with given ID not found", http.StatusNotFound)
+			return
+		}
+
+		cordoned, drain, err := change(worker, r)
+		if err != nil {
+			errorHttp(w, "Error decoding json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		worker, err = h.db.CordonWorker(r.Context(), id, cordoned, drain)
+		if err != nil {
+			errorHttp(w, "Error updating worker: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if worker == nil {
+			errorHttp(w, "worker with given ID not found", http.StatusNotFound)
+			return
+		}
+
+		log.Printf("worker %s (%s) cordoned = %v, drain = %q\n", worker.Name, worker.ID, worker.Cordoned, worker.Drain)
+		_ = json.NewEncoder(w).Encode(worker)
+	}
+}
+
+func (h *httpServer) handleWorkerHeartbeat() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var hb workers.Heartbeat
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&hb); err != nil {
+			errorHttp(w, "Error decoding json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		res := workers.HeartbeatResponse{Stop: []jobs.StopSignal{}}
+		if hb.WorkerID != uuid.Nil {
+			worker, err := h.db.WorkerHeartbeat(r.Context(), hb.WorkerID, hb)
+			if err != nil {
+				errorHttp(w, "Error updating worker: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			res.Register = worker == nil
+			if worker != nil {
+				res.Cordoned = worker.Cordoned
+				res.Drain = worker.Drain
+			}
+		}
+
+		stopping, err := h.db.StopRequests(r.Context(), hb.Running)
+		if err != nil {
+			errorHttp(w, "Error getting stop requests: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for _, job := range stopping {
+			signal := jobs.StopSignal{
+				ID:     job.ID,
+				Reason: job.StopRequest,
+				By:     job.CancelledBy,
+			}
+			if job.StopRequest == jobs.StopPreempt {
+				signal.By = "preemption policy"
+				signal.Grace = jobs.Duration(h.preempt.CheckpointGrace)
+			}
+			res.Stop = append(res.Stop, signal)
+		}
+
+		_ = json.NewEncoder(w).Encode(res)
+	}
+}
+
+// handleWorkerReturn enqueues again the jobs a worker claimed but did not start or had to stop
+func (h *httpServer) handleWorkerReturn() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req workers.ReturnedJobs
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			errorHttp(w, "Error decoding json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		returned, err := h.db.ReturnJobs(r.Context(), req.WorkerID, req.Jobs)
+		if err != nil {
+			errorHttp(w, "Error returning jobs: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		for _, job := range returned {
+			switch req.Reason {
+			case workers.ReturnCheckpoint:
+				log.Printf("worker %s stopped job %s to checkpoint it while shutting down\n", req.WorkerID, job.ID)
+				appendLog(job, fmt.Sprintf("job stopped by worker %s, which is shutting down, enqueued again to resume from its checkpoint", req.WorkerID))
+			case workers.ReturnKill:
+				log.Printf("worker %s killed job %s while shutting down\n", req.WorkerID, job.ID)
+				appendLog(job, fmt.Sprintf("job killed by worker %s, which is shutting down, enqueued again", req.WorkerID))
+			case workers.ReturnPreempted:
+				log.Printf("worker %s stopped job %s, preempted\n", req.WorkerID, job.ID)
+				appendLog(job, fmt.Sprintf("job preempted on worker %s, enqueued again", req.WorkerID))
+			case workers.ReturnDrained:
+				log.Printf("worker %s stopped job %s while being drained\n", req.WorkerID, job.ID)
+				appendLog(job, fmt.Sprintf("job stopped by worker %s, which is being drained, enqueued again", req.WorkerID))
+			default:
+				log.Printf("worker %s returned job %s without starting it\n", req.WorkerID, job.ID)
+				appendLog(job, fmt.Sprintf("job returned by worker %s before starting, enqueued again", req.WorkerID))
+			}
+		}
+
+		if returned == nil {
+			returned = []jobs.Job{}
+		}
+		_ = json.NewEncoder(w).Encode(returned)
+	}
+}
+
+// handleQueuedImages returns the images of the next enqueued jobs, without repeating them, so that
+// the workers can pull them before claiming the jobs. The images that are never pulled are left out.
+func (h *httpServer) handleQueuedImages() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		max := defaultQueuedImages
+		if v := r.URL.Query().Get("max"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				errorHttp(w, "invalid max", http.StatusBadRequest)
+				return
+			}
+			max = n
+		}
+
+		enqueued, err := h.db.GetByStatus(r.Context(), jobs.Enqueued)
+		if err != nil {
+			errorHttp(w, "Error getting enqueued jobs: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		images := []string{}
+		seen := make(map[string]bool)
+		for _, job := range enqueued {
+			if len(images) == max {
+				break
+			}
+			if job.Docker.Pull() == jobs.PullNever || seen[job.Docker.Image] {
+				continue
+			}
+			seen[job.Docker.Image] = true
+			images = append(images, job.Docker.Image)
+		}
+		_ = json.NewEncoder(w).Encode(images)
 	}
 }
 
@@ -169,16 +600,89 @@ func (h *httpServer) handleNewJob() http.HandlerFunc {
 			return
 		}
 
-		job, err := h.db.Insert(r.Context(), jobRequest)
+		key := r.Header.Get("Idempotency-Key")
+		if len(key) > 255 {
+			errorHttp(w, "Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		// hashed before applying the defaults, they could change between retries
+		b, _ := json.Marshal(jobRequest)
+		hash := sha256.Sum256(b)
+		h.applyQueueDefaults(&jobRequest)
+
+		if err := jobRequest.Docker.Resources.Validate(h.queues[jobRequest.Queue].MaxResources); err != nil {
+			errorHttp(w, "invalid resources: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := jobRequest.Docker.Argv(); err != nil {
+			errorHttp(w, "invalid command: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := jobs.ValidateMounts(jobRequest.Docker.Mounts); err != nil {
+			errorHttp(w, "invalid mounts: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := jobs.ValidateOutputs(jobRequest.Docker.Outputs); err != nil {
+			errorHttp(w, "invalid outputs: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := jobs.ValidateImage(jobRequest.Docker.Image); err != nil {
+			errorHttp(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		policy, err := jobs.ParsePullPolicy(string(jobRequest.Docker.PullPolicy))
+		if err != nil {
+			errorHttp(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		jobRequest.Docker.PullPolicy = policy
+
+		if key == "" {
+			job, err := h.db.Insert(r.Context(), jobRequest)
+			if err != nil {
+				errorHttp(w, fmt.Sprintf("error inserting job: %v\n", err), http.StatusInternalServerError)
+				return
+			}
+
+			_ = json.NewEncoder(w).Encode(job)
+			return
+		}
+
+		job, replayed, err := h.db.InsertIdempotent(r.Context(), database.IdempotencyKey{
+			Key:         key,
+			RequestHash: hex.EncodeToString(hash[:]),
+			TTL:         h.keyTTL,
+		}, jobRequest)
 		if err != nil {
+			if errors.Is(err, database.ErrIdempotencyMismatch) {
+				errorHttp(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
 			errorHttp(w, fmt.Sprintf("error inserting job: %v\n", err), http.StatusInternalServerError)
 			return
 		}
 
+		if replayed {
+			w.Header().Set("Idempotent-Replayed", "true")
+		}
 		_ = json.NewEncoder(w).Encode(job)
 	}
 }
 
+// applyQueueDefaults fills the fields that were not set in the request with the defaults of its queue
+func (h *httpServer) applyQueueDefaults(params *database.InsertParams) {
+	if params.Queue == "" {
+		params.Queue = jobs.DefaultQueue
+	}
+
+	q := h.queues[params.Queue]
+	if params.Timeout == 0 {
+		params.Timeout = q.DefaultTimeout
+	}
+	params.Docker.Resources.ApplyMax(q.MaxResources)
+}
+
 func (h *httpServer) handleJobUpdate() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -212,6 +716,135 @@ func (h *httpServer) handleJobUpdate() http.HandlerFunc {
 	}
 }
 
+// statusChange is a bulk status change of the database, like database.Database.Hold
+type statusChange func(context.Context, database.JobFilter) ([]jobs.Job, error)
+
+// handleStatus applies a status change to a single job
+func (h *httpServer) handleStatus(change statusChange) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := uuid.FromString(vars["id"])
+		if err != nil {
+			errorHttp(w, "invalid uuid", http.StatusBadRequest)
+			return
+		}
+
+		changed, err := change(r.Context(), database.JobFilter{IDs: []uuid.UUID{id}})
+		if err != nil {
+			errorHttp(w, "Error updating job: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if len(changed) == 0 {
+			existing, err := h.db.GetById(r.Context(), id)
+			if err != nil || existing == nil {
+				errorHttp(w, "job with given ID not found", http.StatusNotFound)
+				return
+			}
+			errorHttp(w, fmt.Sprintf("job is %s and its status cannot be changed", existing.Status), http.StatusConflict)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(changed[0])
+	}
+}
+
+// handleBulkStatus applies a status change to all the jobs matching the filter in the body
+func (h *httpServer) handleBulkStatus(change statusChange) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var filter database.JobFilter
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&filter); err != nil {
+			errorHttp(w, "Error decoding json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if filter.Empty() {
+			errorHttp(w, "filter must have at least one of ids, queue or name_prefix", http.StatusBadRequest)
+			return
+		}
+
+		changed, err := change(r.Context(), filter)
+		if err != nil {
+			errorHttp(w, "Error updating jobs: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if changed == nil {
+			changed = []jobs.Job{}
+		}
+		_ = json.NewEncoder(w).Encode(changed)
+	}
+}
+
+// handleDeadLetters lists the expired jobs and the failed jobs that exhausted their retries
+func (h *httpServer) handleDeadLetters() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dead, err := h.db.DeadLetters(r.Context())
+		if err != nil {
+			errorHttp(w, "Error getting dead-lettered jobs: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if dead == nil {
+			dead = []jobs.Job{}
+		}
+		_ = json.NewEncoder(w).Encode(dead)
+	}
+}
+
+// cancelRequest is the body of a cancel request
+type cancelRequest struct {
+	By string `json:"by"`
+}
+
+func (h *httpServer) handleCancel() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := uuid.FromString(vars["id"])
+		if err != nil {
+			errorHttp(w, "invalid uuid", http.StatusBadRequest)
+			return
+		}
+
+		var req cancelRequest
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && !errors.Is(err, io.EOF) {
+			errorHttp(w, "Error decoding json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.By == "" {
+			req.By = "unknown"
+		}
+
+		job, err := h.db.Cancel(r.Context(), id, req.By)
+		if err != nil {
+			errorHttp(w, "Error cancelling job: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if job == nil {
+			existing, err := h.db.GetById(r.Context(), id)
+			if err != nil || existing == nil {
+				errorHttp(w, "job with given ID not found", http.StatusNotFound)
+				return
+			}
+			errorHttp(w, fmt.Sprintf("job is %s and cannot be cancelled", existing.Status), http.StatusConflict)
+			return
+		}
+
+		// the job never reached a worker, so nobody else will write its final log
+		if job.Status == jobs.Cancelled {
+			appendLog(*job, fmt.Sprintf("job cancelled by %s before it started", job.CancelledBy), jobs.MagicEnd)
+			if err := h.t.sendNotification(*job); err != nil {
+				log.Printf("error sending job update notification via telegram: %v", err)
+			}
+		}
+
+		_ = json.NewEncoder(w).Encode(job)
+	}
+}
+
 func (h *httpServer) handleGetById() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		vars := mux.Vars(r)
@@ -251,12 +884,119 @@ func (h *httpServer) handleGetLogs() http.HandlerFunc {
 			errorHttp(w, fmt.Sprintf("error opening log file: %v", err), http.StatusInternalServerError)
 			return
 		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil {
+			errorHttp(w, fmt.Sprintf("error reading log file: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		// supports range requests, the workers read the end of the log to resume it
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		http.ServeContent(w, r, "", info.ModTime(), f)
+	}
+}
+
+// maxStatsSamples limits the samples a worker can upload at once
+const maxStatsSamples = 1000
+
+func (h *httpServer) handleAddStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := uuid.FromString(vars["id"])
+		if err != nil {
+			errorHttp(w, "invalid uuid", http.StatusBadRequest)
+			return
+		}
 
-		// TODO: add support for range requests
-		if _, err := io.Copy(w, f); err != nil {
-			errorHttp(w, fmt.Sprintf("error copying log file to body: %v", err), http.StatusInternalServerError)
+		var samples []jobs.StatsSample
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&samples); err != nil {
+			errorHttp(w, "Error decoding json: "+err.Error(), http.StatusBadRequest)
 			return
 		}
+		if len(samples) > maxStatsSamples {
+			errorHttp(w, fmt.Sprintf("too many samples, at most %d", maxStatsSamples), http.StatusBadRequest)
+			return
+		}
+
+		job, err := h.db.AddStats(r.Context(), id, samples)
+		if err != nil {
+			errorHttp(w, "Error adding stats: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if job == nil {
+			errorHttp(w, "job with given ID not found", http.StatusNotFound)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(job.Usage)
+	}
+}
+
+// handleSetPull stores how the worker got the image of the job
+func (h *httpServer) handleSetPull() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := uuid.FromString(vars["id"])
+		if err != nil {
+			errorHttp(w, "invalid uuid", http.StatusBadRequest)
+			return
+		}
+
+		var pull jobs.PullInfo
+		defer r.Body.Close()
+		if err := json.NewDecoder(r.Body).Decode(&pull); err != nil {
+			errorHttp(w, "Error decoding json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		job, err := h.db.SetPull(r.Context(), id, pull)
+		if err != nil {
+			errorHttp(w, "Error setting pull: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if job == nil {
+			errorHttp(w, "job with given ID not found", http.StatusNotFound)
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(job.Pull)
+	}
+}
+
+func (h *httpServer) handleGetStats() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		id, err := uuid.FromString(vars["id"])
+		if err != nil {
+			errorHttp(w, "invalid uuid", http.StatusBadRequest)
+			return
+		}
+
+		var step time.Duration
+		if v := r.URL.Query().Get("step"); v != "" {
+			step, err = time.ParseDuration(v)
+			if err != nil || step < 0 {
+				errorHttp(w, "invalid step", http.StatusBadRequest)
+				return
+			}
+		}
+
+		samples, err := h.db.GetStats(r.Context(), id)
+		if err != nil {
+			errorHttp(w, "Error getting stats: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		samples = jobs.Downsample(samples, step)
+		if samples == nil {
+			samples = []jobs.StatsSample{}
+		}
+		_ = json.NewEncoder(w).Encode(samples)
 	}
 }
 
@@ -5,13 +5,13 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
 	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/config"
 	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/database"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/lifecycle"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/workers"
 )
 
 // httpConfig is the configuration for the HTTP server.
@@ -21,12 +21,35 @@ type httpConfig struct {
 	IdleTimeout time.Duration `yaml:"idle_timeout" json:"idleTimeout"`
 }
 
+// queueConfig holds the defaults applied to the jobs enqueued to a queue.
+type queueConfig struct {
+	DefaultTimeout jobs.Duration `yaml:"default_timeout" json:"defaultTimeout"`
+	// MaxResources are the highest resources a job of the queue can ask for
+	MaxResources jobs.Resources `yaml:"max_resources" json:"maxResources"`
+}
+
 // config is the configuration for the server.
 type conf struct {
-	Database string         `yaml:"database" json:"database"`
-	Http     httpConfig     `yaml:"http" json:"http"`
-	Tokens   []string       `yaml:"tokens" json:"tokens"`
-	Telegram telegramClient `yaml:"telegram" json:"telegram"`
+	Database string     `yaml:"database" json:"database"`
+	Http     httpConfig `yaml:"http" json:"http"`
+	Tokens   []string   `yaml:"tokens" json:"tokens"`
+	// WorkerTokens are the tokens of the workers. They are accepted like Tokens, and only they can
+	// get the credentials of the registries.
+	WorkerTokens []string               `yaml:"worker_tokens" json:"workerTokens"`
+	Telegram     telegramClient         `yaml:"telegram" json:"telegram"`
+	Queues       map[string]queueConfig `yaml:"queues" json:"queues"`
+	Watchdog     watchdogConfig         `yaml:"watchdog" json:"watchdog"`
+	Preempt      preemptionConfig       `yaml:"preemption" json:"preemption"`
+	Limits       []database.Limit       `yaml:"limits" json:"limits"`
+	// IdempotencyTTL is how long the Idempotency-Key of a new job is remembered
+	IdempotencyTTL time.Duration `yaml:"idempotency_ttl" json:"idempotencyTtl"`
+	// ArtifactsMaxSize is the most a worker can upload at once to the artifacts of a job
+	ArtifactsMaxSize jobs.Size `yaml:"artifacts_max_size" json:"artifactsMaxSize"`
+	// Registries are the credentials of the container registries by host, given to the workers that
+	// don't have their own
+	Registries map[string]workers.RegistryAuth `yaml:"registries" json:"registries"`
+	// ShutdownTimeout is how long the shutdown waits for the requests in flight, 30s by default
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout" json:"shutdownTimeout"`
 }
 
 var (
@@ -42,6 +65,12 @@ func main() {
 		panic(err)
 	}
 	fmt.Printf("Loaded server configuration: %+v\n", cfg)
+	if cfg.IdempotencyTTL <= 0 {
+		cfg.IdempotencyTTL = 24 * time.Hour
+	}
+	if cfg.ShutdownTimeout <= 0 {
+		cfg.ShutdownTimeout = 30 * time.Second
+	}
 
 	// Connect to database
 	db, err := database.NewPostgres(context.Background(), cfg.Database)
@@ -51,32 +80,18 @@ func main() {
 	}
 	defer db.Close()
 
-	// 2 per http i el puller
-	closing := make(chan struct{}, 1)
-	waitClose := make(chan struct{}, 1)
-
-	// Start HTTP server
-	go func() {
-		if err := startHttp(closing, *cfg, db, waitClose); err != nil {
-			log.Printf("error server: %s\n", err)
-		}
-	}()
-
-	// Wait for SIGINT and SIGTERM (HIT CTRL-C)
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
-	<-c
-
-	log.Printf("starting gracefull shutdown. Waiting for all pending tasks to finish\n")
-
-	// Stop HTTP server
-	for i := 0; i < len(closing); i++ {
-		closing <- struct{}{}
-	}
+	lc := lifecycle.New(cfg.ShutdownTimeout)
+	lc.Go("http server", func() error {
+		return startHttp(lc, *cfg, db)
+	})
+	lc.Go("watchdog", func() error {
+		startWatchdog(lc.Closing(), *cfg, db)
+		return nil
+	})
 
-	// Wait for all pending tasks to finish
-	for i := 0; i < len(waitClose); i++ {
-		<-waitClose
+	pending := lc.Wait()
+	if len(pending) != 0 {
+		log.Printf("shutdown did not finish in %s, %v still running\n", cfg.ShutdownTimeout, pending)
 	}
 
 	log.Printf("shutdown!\n")
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/database"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/workers"
+)
+
+// preemptionConfig is the configuration of the preemption policy.
+type preemptionConfig struct {
+	Enabled bool `yaml:"enabled" json:"enabled"`
+	// After is how long a job has to wait in the queue before lower priority jobs are preempted
+	// to make room for it
+	After time.Duration `yaml:"after" json:"after"`
+	// CheckpointGrace is the time a preempted job has to checkpoint after receiving SIGTERM
+	CheckpointGrace time.Duration `yaml:"checkpoint_grace" json:"checkpointGrace"`
+}
+
+// workerCapacity is what a worker has free for the waiting jobs, counting the jobs that are already
+// being preempted as gone
+type workerCapacity struct {
+	slots, gpus int
+	// candidates are the preemptible jobs running in the worker, in the order they are preempted
+	candidates []jobs.Job
+}
+
+// preempt asks the workers to stop preemptible running jobs to make room for the higher priority
+// jobs that have been waiting for too long. A waiting job only preempts jobs of a single worker, and
+// only if stopping them frees a slot and as many GPUs as it needs there. Victims are chosen by
+// lowest priority first and, with the same priority, the ones that started most recently (less work
+// is lost), on the worker where the fewest jobs have to be stopped. Returns the jobs that have been
+// asked to stop.
+func preempt(ctx context.Context, cfg preemptionConfig, db database.Database) ([]jobs.Job, error) {
+	enqueued, err := db.GetByStatus(ctx, jobs.Enqueued)
+	if err != nil {
+		return nil, fmt.Errorf("getting enqueued jobs: %w", err)
+	}
+
+	// hold, release and requeue change updated_at, the time waiting is counted from the submission
+	var waiting []jobs.Job
+	for _, job := range enqueued {
+		if time.Since(job.CreatedAt) >= cfg.After {
+			waiting = append(waiting, job)
+		}
+	}
+	if len(waiting) == 0 {
+		return nil, nil
+	}
+	sort.SliceStable(waiting, func(i, j int) bool {
+		if waiting[i].Priority != waiting[j].Priority {
+			return waiting[i].Priority > waiting[j].Priority
+		}
+		return waiting[i].CreatedAt.Before(waiting[j].CreatedAt)
+	})
+
+	capacity, err := workersCapacity(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+
+	var victims []jobs.Job
+	for _, job := range waiting {
+		best, stop := -1, 0
+		for i, c := range capacity {
+			n, ok := c.victims(job)
+			if ok && (best == -1 || n < stop) {
+				best, stop = i, n
+			}
+		}
+		if best == -1 {
+			continue
+		}
+
+		c := &capacity[best]
+		for _, candidate := range c.candidates[:stop] {
+			stopped, err := db.RequestStop(ctx, candidate.ID, jobs.StopPreempt)
+			if err != nil {
+				return victims, fmt.Errorf("preempting job %s: %w", candidate.ID, err)
+			}
+			// the job finished or was cancelled in the meantime, it has made room anyway
+			if stopped != nil {
+				victims = append(victims, *stopped)
+			}
+			c.slots++
+			c.gpus += candidate.GPUs
+		}
+		c.candidates = c.candidates[stop:]
+		c.slots--
+		c.gpus -= job.GPUs
+	}
+
+	return victims, nil
+}
+
+// victims returns how many of the candidates have to be stopped to run the job in the worker, or
+// false if stopping all the ones with a lower priority is not enough
+func (c workerCapacity) victims(job jobs.Job) (int, bool) {
+	slots, gpus := c.slots, c.gpus
+	for n := 0; ; n++ {
+		if slots > 0 && gpus >= job.GPUs {
+			return n, true
+		}
+		if n == len(c.candidates) || c.candidates[n].Priority >= job.Priority {
+			return 0, false
+		}
+		slots++
+		gpus += c.candidates[n].GPUs
+	}
+}
+
+// workersCapacity returns the free slots and GPUs of the online workers that can be given jobs
+func workersCapacity(ctx context.Context, db database.Database) ([]workerCapacity, error) {
+	ws, err := db.GetWorkers(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("getting workers: %w", err)
+	}
+	running, err := db.GetByStatus(ctx, jobs.Running)
+	if err != nil {
+		return nil, fmt.Errorf("getting running jobs: %w", err)
+	}
+	byID := make(map[uuid.UUID]jobs.Job, len(running))
+	for _, job := range running {
+		byID[job.ID] = job
+	}
+
+	var capacity []workerCapacity
+	for _, w := range ws {
+		if w.Status != workers.Online || w.Cordoned {
+			continue
+		}
+
+		c := workerCapacity{slots: w.FreeSlots, gpus: len(w.GPUs)}
+		for _, id := range w.Running {
+			job, ok := byID[id]
+			if !ok {
+				continue
+			}
+			switch {
+			case job.StopRequest == jobs.StopPreempt:
+				// it is already being stopped, its slot and GPUs will be free soon
+				c.slots++
+			case job.Preemptible && job.StopRequest == "":
+				c.gpus -= job.GPUs
+				c.candidates = append(c.candidates, job)
+			default:
+				c.gpus -= job.GPUs
+			}
+		}
+
+		sort.SliceStable(c.candidates, func(i, j int) bool {
+			if c.candidates[i].Priority != c.candidates[j].Priority {
+				return c.candidates[i].Priority < c.candidates[j].Priority
+			}
+			return startedAt(c.candidates[i]).After(startedAt(c.candidates[j]))
+		})
+		capacity = append(capacity, c)
+	}
+	return capacity, nil
+}
+
+func startedAt(job jobs.Job) time.Time {
+	if job.StartedAt == nil {
+		return job.UpdatedAt
+	}
+	return *job.StartedAt
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/database"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/workers"
+)
+
+// runJob inserts a job and claims it for the worker
+func runJob(t *testing.T, db database.Database, worker uuid.UUID, params database.InsertParams) jobs.Job {
+	t.Helper()
+
+	ctx := context.Background()
+	// sqlite cannot read back an empty environment
+	params.Docker.Environment = map[string]interface{}{"EPOCHS": 1}
+	inserted, err := db.Insert(ctx, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job, err := db.FetchJob(ctx, database.FetchParams{Worker: worker})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job == nil || job.ID != inserted.ID {
+		t.Fatalf("fetched %+v, want job %s", job, inserted.ID)
+	}
+	return *job
+}
+
+func TestReturnJobs(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	wk, err := db.RegisterWorker(ctx, workers.Registration{Name: "w1", Hostname: "w1", Version: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := runJob(t, db, wk.ID, database.InsertParams{Name: "train", Docker: jobs.Docker{Image: "train:1"}, Preemptible: true})
+	if job.Worker == nil || *job.Worker != wk.ID || job.Attempts != 1 {
+		t.Fatalf("claimed job has worker %v and %d attempts, want %s and 1", job.Worker, job.Attempts, wk.ID)
+	}
+
+	// another worker cannot requeue it
+	returned, err := db.ReturnJobs(ctx, uuid.Must(uuid.NewV4()), []uuid.UUID{job.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(returned) != 0 {
+		t.Fatalf("a job was returned by a worker that is not running it: %+v", returned)
+	}
+
+	returned, err = db.ReturnJobs(ctx, wk.ID, []uuid.UUID{job.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(returned) != 1 {
+		t.Fatalf("returned %d jobs, want 1", len(returned))
+	}
+	got := returned[0]
+	if got.Status != jobs.Enqueued || got.Attempts != 0 || got.StartedAt != nil || got.Worker != nil {
+		t.Errorf("returned job is %s with %d attempts, started at %v in worker %v; want it enqueued as new",
+			got.Status, got.Attempts, got.StartedAt, got.Worker)
+	}
+}
+
+func TestPreemptNotEnoughGPUs(t *testing.T) {
+	ctx := context.Background()
+	db := newTestDB(t)
+	wk, err := db.RegisterWorker(ctx, workers.Registration{Name: "w1", Hostname: "w1", Version: "test", GPUs: []string{"0", "1"}, Slots: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// one GPU is used by a job that cannot be preempted, the other by a preemptible one
+	victim := runJob(t, db, wk.ID, database.InsertParams{Name: "victim", Docker: jobs.Docker{Image: "train:1"}, GPUs: 1, Preemptible: true})
+	blocker := runJob(t, db, wk.ID, database.InsertParams{Name: "blocker", Docker: jobs.Docker{Image: "train:1"}, GPUs: 1})
+	if _, err := db.WorkerHeartbeat(ctx, wk.ID, workers.Heartbeat{WorkerID: wk.ID, Running: []uuid.UUID{victim.ID, blocker.ID}, FreeSlots: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// stopping the victim frees a single GPU, the waiting job needs two
+	cfg := preemptionConfig{Enabled: true}
+	docker := jobs.Docker{Image: "train:1", Environment: map[string]interface{}{"EPOCHS": 1}}
+	if _, err := db.Insert(ctx, database.InsertParams{Name: "waiting", Docker: docker, GPUs: 2, Priority: 10}); err != nil {
+		t.Fatal(err)
+	}
+	stopped, err := preempt(ctx, cfg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stopped) != 0 {
+		t.Fatalf("preempted %d jobs that do not free enough GPUs", len(stopped))
+	}
+	job, err := db.GetById(ctx, victim.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if job.StopRequest != "" {
+		t.Errorf("the victim was asked to stop: %s", job.StopRequest)
+	}
+
+	// a job that fits in the GPU of the victim preempts it
+	if _, err := db.Insert(ctx, database.InsertParams{Name: "small", Docker: docker, GPUs: 1, Priority: 10}); err != nil {
+		t.Fatal(err)
+	}
+	stopped, err = preempt(ctx, cfg, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stopped) != 1 || stopped[0].ID != victim.ID {
+		t.Fatalf("preempted %+v, want only job %s", stopped, victim.ID)
+	}
+}
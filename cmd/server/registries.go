@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/workers"
+)
+
+// normalizeRegistries keys the credentials by the normalized host of their registry
+func normalizeRegistries(registries map[string]workers.RegistryAuth) map[string]workers.RegistryAuth {
+	res := make(map[string]workers.RegistryAuth, len(registries))
+	for registry, auth := range registries {
+		res[workers.NormalizeRegistry(registry)] = auth
+	}
+	return res
+}
+
+// handleRegistryAuth gives the credentials of a registry to a worker, which pulls the images of
+// the jobs with them. Only the registered workers using a worker token can get them, without
+// worker tokens the server gives none.
+func (h *httpServer) handleRegistryAuth() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(h.workerTokens) == 0 {
+			errorHttp(w, "the server does not give registry credentials without worker tokens", http.StatusNotFound)
+			return
+		}
+		if !isValid(r.Header.Get("Authorization"), h.workerTokens) {
+			errorHttp(w, "only the workers can get registry credentials", http.StatusForbidden)
+			return
+		}
+
+		workerID, err := uuid.FromString(r.URL.Query().Get("worker"))
+		if err != nil {
+			errorHttp(w, "invalid worker uuid", http.StatusBadRequest)
+			return
+		}
+		wk, err := h.db.GetWorker(r.Context(), workerID)
+		if err != nil {
+			errorHttp(w, "Error getting worker: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if wk == nil {
+			errorHttp(w, "worker is not registered", http.StatusForbidden)
+			return
+		}
+
+		registry := workers.NormalizeRegistry(mux.Vars(r)["registry"])
+		auth, ok := h.registries[registry]
+		if !ok {
+			errorHttp(w, "no credentials for registry "+registry, http.StatusNotFound)
+			return
+		}
+
+		log.Printf("giving the credentials of registry %s to worker %s\n", registry, wk.Name)
+		_ = json.NewEncoder(w).Encode(auth)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/database"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/workers"
+)
+
+// newTestDB returns an empty sqlite database created with setup_sqlite.sql
+func newTestDB(t *testing.T) database.Database {
+	t.Helper()
+
+	schema, err := os.ReadFile(filepath.Join("..", "..", "setup_sqlite.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "database.db")
+	conn, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Exec(string(schema)); err != nil {
+		t.Fatalf("creating the schema: %v", err)
+	}
+
+	db, err := database.NewSqlite(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestRegistryAuth(t *testing.T) {
+	db := newTestDB(t)
+	wk, err := db.RegisterWorker(context.Background(), workers.Registration{Name: "w1", Hostname: "w1", Version: "test"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h := &httpServer{
+		db:           db,
+		registries:   normalizeRegistries(map[string]workers.RegistryAuth{"registry.example.com": {Username: "skeduler", Password: "secret"}}),
+		workerTokens: []string{"worker-token"},
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/workers/registries/{registry}", h.handleRegistryAuth())
+
+	get := func(token, registry string, worker uuid.UUID) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/workers/registries/"+registry+"?worker="+worker.String(), nil)
+		req.Header.Set("Authorization", token)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name     string
+		token    string
+		registry string
+		worker   uuid.UUID
+		want     int
+	}{
+		{name: "worker token", token: "worker-token", registry: "registry.example.com", worker: wk.ID, want: http.StatusOK},
+		{name: "user token", token: "user-token", registry: "registry.example.com", worker: wk.ID, want: http.StatusForbidden},
+		{name: "unregistered worker", token: "worker-token", registry: "registry.example.com", worker: uuid.Must(uuid.NewV4()), want: http.StatusForbidden},
+		{name: "unknown registry", token: "worker-token", registry: "other.example.com", worker: wk.ID, want: http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := get(tt.token, tt.registry, tt.worker)
+			if rec.Code != tt.want {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+			if tt.want != http.StatusOK {
+				return
+			}
+			var auth workers.RegistryAuth
+			if err := json.NewDecoder(rec.Body).Decode(&auth); err != nil {
+				t.Fatal(err)
+			}
+			if auth.Username != "skeduler" || auth.Password != "secret" {
+				t.Errorf("got credentials %+v", auth)
+			}
+		})
+	}
+
+	// without worker tokens nobody gets the credentials
+	h.workerTokens = nil
+	if rec := get("worker-token", "registry.example.com", wk.ID); rec.Code != http.StatusNotFound {
+		t.Errorf("status %d without worker tokens, want %d", rec.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/database"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+)
+
+// watchdogConfig is the configuration for the server watchdog.
+type watchdogConfig struct {
+	Interval time.Duration `yaml:"interval" json:"interval"`
+	// TimeoutGrace is the extra time given to a worker to report a job that exceeded its
+	// timeout before the server marks it as timed out by itself.
+	TimeoutGrace time.Duration `yaml:"timeout_grace" json:"timeoutGrace"`
+	// WorkerTimeout is how long a worker can go without sending a heartbeat before it is marked
+	// as offline
+	WorkerTimeout time.Duration `yaml:"worker_timeout" json:"workerTimeout"`
+}
+
+// startWatchdog periodically checks the jobs in the database, taking care of the ones that
+// were left behind by a worker that disappeared
+func startWatchdog(quit <-chan struct{}, cfg conf, db database.Database) {
+	interval := cfg.Watchdog.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+	grace := cfg.Watchdog.TimeoutGrace
+	if grace <= 0 {
+		grace = 5 * time.Minute
+	}
+	workerTimeout := cfg.Watchdog.WorkerTimeout
+	if workerTimeout <= 0 {
+		workerTimeout = time.Minute
+	}
+
+	t := &telegramClient{
+		Token:  cfg.Telegram.Token,
+		ChatId: cfg.Telegram.ChatId,
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Printf("started watchdog, checking every %s\n", interval)
+	for {
+		select {
+		case <-quit:
+			return
+
+		case <-ticker.C:
+			if cfg.Preempt.Enabled {
+				victims, err := preempt(context.TODO(), cfg.Preempt, db)
+				if err != nil {
+					log.Printf("error preempting jobs: %v\n", err)
+				}
+				for _, job := range victims {
+					log.Printf("preempting job %s (priority %d) to make room for higher priority jobs\n", job.ID, job.Priority)
+				}
+			}
+
+			offline, err := db.MarkWorkersOffline(context.TODO(), workerTimeout)
+			if err != nil {
+				log.Printf("error marking workers offline: %v\n", err)
+			}
+			for _, w := range offline {
+				log.Printf("worker %s (%s) has not been seen since %s, marked as %s\n", w.Name, w.ID, w.LastSeenAt, w.Status)
+			}
+
+			// the blocked reasons are otherwise only updated when a worker fetches a job
+			if err := db.UpdateBlockedReasons(context.TODO(), cfg.Limits); err != nil {
+				log.Printf("error updating blocked reasons: %v\n", err)
+			}
+
+			expired, err := db.ExpireJobs(context.TODO())
+			if err != nil {
+				log.Printf("error expiring jobs: %v\n", err)
+			}
+			for _, job := range expired {
+				log.Printf("job %s expired before starting, moved to the dead-letter list\n", job.ID)
+				appendLog(job, "[watchdog] job expired before it could start, moved to the dead-letter list", jobs.MagicEnd)
+
+				if err := t.sendNotification(job); err != nil {
+					log.Printf("error sending job update notification via telegram: %v", err)
+				}
+			}
+
+			timedOut, err := db.TimeoutJobs(context.TODO(), grace)
+			if err != nil {
+				log.Printf("error timing out jobs: %v\n", err)
+				continue
+			}
+
+			for _, job := range timedOut {
+				log.Printf("job %s exceeded its timeout of %s, marked as %s\n", job.ID, job.Timeout, job.Status)
+				appendLog(job,
+					fmt.Sprintf("[watchdog] job exceeded its timeout of %s and the worker did not report it, marked as %s", job.Timeout, job.Status),
+					jobs.MagicEnd)
+
+				if err := t.sendNotification(job); err != nil {
+					log.Printf("error sending job update notification via telegram: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// appendLog writes the given lines at the end of the log file of a job
+func appendLog(job jobs.Job, lines ...string) {
+	logFile, err := os.OpenFile(fmt.Sprintf("./logs/%v.log", job.ID), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("error opening log file of %s: %v\n", job.ID, err)
+		return
+	}
+	defer logFile.Close()
+
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(logFile, line); err != nil {
+			log.Printf("error writing log file of %s: %v\n", job.ID, err)
+			return
+		}
+	}
+}
@@ -9,11 +9,15 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"os"
+	"time"
 
 	"github.com/gofrs/uuid"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/artifacts"
 	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/database"
 	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/workers"
 )
 
 var errNoJob = errors.New("no job available")
@@ -50,40 +54,76 @@ func getJobs(ctx context.Context, host, token string) ([]jobs.Job, error) {
 	return []jobs.Job{}, fmt.Errorf("server error, recived status code %d and body", res.StatusCode)
 }
 
-func newJob(ctx context.Context, host, token string, jobRequest jobs.Job) (jobs.Job, error) {
+// newJobAttempts is the number of times a new job request is sent before giving up
+const newJobAttempts = 4
+
+// errRetryable wraps the errors after which a request can be safely sent again
+type errRetryable struct {
+	err error
+}
+
+func (e errRetryable) Error() string { return e.err.Error() }
+func (e errRetryable) Unwrap() error { return e.err }
+
+// newJob enqueues a job. The request is sent with an Idempotency-Key and retried with the same key
+// on timeouts and server errors, so the job is never enqueued twice.
+func newJob(ctx context.Context, host, token string, jobRequest database.InsertParams) (jobs.Job, error) {
 	b, err := json.Marshal(jobRequest)
 	if err != nil {
 		return jobs.Job{}, fmt.Errorf("error unmarshaling json: %w", err)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/experiments", host), bytes.NewReader(b))
-	req.Header.Set("Authorization", token)
+	key, err := uuid.NewV4()
+	if err != nil {
+		return jobs.Job{}, fmt.Errorf("generating idempotency key: %w", err)
+	}
 
+	for attempt := 1; ; attempt++ {
+		job, err := postJob(ctx, host, token, key.String(), b)
+		var retryable errRetryable
+		if err == nil || !errors.As(err, &retryable) || attempt == newJobAttempts {
+			return job, err
+		}
+
+		fmt.Fprintf(os.Stderr, "error enqueueing job (attempt %d/%d), retrying: %v\n", attempt, newJobAttempts, err)
+		select {
+		case <-ctx.Done():
+			return jobs.Job{}, ctx.Err()
+		case <-time.After(time.Duration(attempt) * time.Second):
+		}
+	}
+}
+
+func postJob(ctx context.Context, host, token, key string, body []byte) (jobs.Job, error) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/experiments", host), bytes.NewReader(body))
 	if err != nil {
-		return jobs.Job{}, fmt.Errorf("creating get request: %w", err)
+		return jobs.Job{}, fmt.Errorf("creating post request: %w", err)
 	}
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Idempotency-Key", key)
 
 	res, err := httpClient.Do(req)
 	if err != nil {
-		return jobs.Job{}, fmt.Errorf("performing get request: %w", err)
+		return jobs.Job{}, errRetryable{fmt.Errorf("performing post request: %w", err)}
 	}
-
 	defer res.Body.Close()
 
-	switch res.StatusCode {
-	case http.StatusNoContent:
-		_, _ = io.Copy(ioutil.Discard, res.Body)
-		return jobs.Job{}, errNoJob
-
-	case http.StatusOK:
+	switch {
+	case res.StatusCode == http.StatusOK:
 		var job jobs.Job
 		_ = json.NewDecoder(res.Body).Decode(&job)
 		return job, nil
 
-	default:
+	case res.StatusCode >= http.StatusInternalServerError:
+		ret, _ := io.ReadAll(res.Body)
+		return jobs.Job{}, errRetryable{fmt.Errorf("server error, recived status code %d and body: %s", res.StatusCode, string(ret))}
 	}
 
-	return jobs.Job{}, fmt.Errorf("server error, recived status code %d and body", res.StatusCode)
+	ret, _ := io.ReadAll(res.Body)
+	return jobs.Job{}, fmt.Errorf("server error, recived status code %d and body: %s", res.StatusCode, string(ret))
 }
 
 func getJob(ctx context.Context, host, token string, id uuid.UUID) (jobs.Job, error) {
@@ -150,6 +190,220 @@ func jobUpdate(ctx context.Context, host, token string, jobUpdate database.Updat
 	return jobs.Job{}, fmt.Errorf("server error, recived status code %d and body", res.StatusCode)
 }
 
+func cancelJob(ctx context.Context, host, token string, id uuid.UUID, by string) (jobs.Job, error) {
+	b, err := json.Marshal(map[string]string{"by": by})
+	if err != nil {
+		return jobs.Job{}, fmt.Errorf("error marshaling json: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/experiments/%s/cancel", host, id.String()), bytes.NewReader(b))
+	if err != nil {
+		return jobs.Job{}, fmt.Errorf("creating post request: %w", err)
+	}
+	req.Header.Set("Authorization", token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return jobs.Job{}, fmt.Errorf("performing post request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		ret, _ := io.ReadAll(res.Body)
+		return jobs.Job{}, fmt.Errorf("server error, recived status code %d and body: %s", res.StatusCode, string(ret))
+	}
+
+	var job jobs.Job
+	_ = json.NewDecoder(res.Body).Decode(&job)
+	return job, nil
+}
+
+// changeStatus calls one of the bulk status endpoints (experiments/hold, experiments/release,
+// deadletter/requeue) with the given filter
+func changeStatus(ctx context.Context, host, token, path string, filter database.JobFilter) ([]jobs.Job, error) {
+	b, err := json.Marshal(filter)
+	if err != nil {
+		return nil, fmt.Errorf("error marshaling json: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/%s", host, path), bytes.NewReader(b))
+	if err != nil {
+		return nil, fmt.Errorf("creating post request: %w", err)
+	}
+	req.Header.Set("Authorization", token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("performing post request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		ret, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("server error, recived status code %d and body: %s", res.StatusCode, string(ret))
+	}
+
+	var changed []jobs.Job
+	_ = json.NewDecoder(res.Body).Decode(&changed)
+	return changed, nil
+}
+
+func getDeadLetters(ctx context.Context, host, token string) ([]jobs.Job, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/deadletter", host), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating get request: %w", err)
+	}
+	req.Header.Set("Authorization", token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("performing get request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		ret, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("server error, recived status code %d and body: %s", res.StatusCode, string(ret))
+	}
+
+	var dead []jobs.Job
+	_ = json.NewDecoder(res.Body).Decode(&dead)
+	return dead, nil
+}
+
+// getStats gets the resource usage samples of a job, averaged in intervals of step if it is not zero
+func getStats(ctx context.Context, host, token string, id uuid.UUID, step time.Duration) ([]jobs.StatsSample, error) {
+	u := fmt.Sprintf("%s/experiments/%s/stats", host, id)
+	if step > 0 {
+		u += "?step=" + step.String()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating get request: %w", err)
+	}
+	req.Header.Set("Authorization", token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("performing get request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		ret, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("server error, recived status code %d and body: %s", res.StatusCode, string(ret))
+	}
+
+	var samples []jobs.StatsSample
+	if err := json.NewDecoder(res.Body).Decode(&samples); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	return samples, nil
+}
+
+func getArtifacts(ctx context.Context, host, token string, id uuid.UUID) ([]artifacts.File, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/experiments/%s/artifacts", host, id), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating get request: %w", err)
+	}
+	req.Header.Set("Authorization", token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("performing get request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		ret, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("server error, recived status code %d and body: %s", res.StatusCode, string(ret))
+	}
+
+	var files []artifacts.File
+	if err := json.NewDecoder(res.Body).Decode(&files); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	return files, nil
+}
+
+// downloadArtifact downloads a file or directory of the artifacts of a job, all of them if p is
+// empty. The directories are sent as a tar archive, in which case isTar is true.
+func downloadArtifact(ctx context.Context, host, token string, id uuid.UUID, p string) (body io.ReadCloser, isTar bool, err error) {
+	u := fmt.Sprintf("%s/experiments/%s/artifacts?tar", host, id)
+	if p != "" {
+		u = fmt.Sprintf("%s/experiments/%s/artifacts/%s", host, id, (&url.URL{Path: p}).EscapedPath())
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("creating get request: %w", err)
+	}
+	req.Header.Set("Authorization", token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("performing get request: %w", err)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		defer res.Body.Close()
+		ret, _ := io.ReadAll(res.Body)
+		return nil, false, fmt.Errorf("server error, recived status code %d and body: %s", res.StatusCode, string(ret))
+	}
+	return res.Body, res.Header.Get("Content-Type") == "application/x-tar", nil
+}
+
+func getWorkers(ctx context.Context, host, token string) ([]workers.Worker, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/workers", host), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating get request: %w", err)
+	}
+	req.Header.Set("Authorization", token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("performing get request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		ret, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("server error, recived status code %d and body: %s", res.StatusCode, string(ret))
+	}
+
+	var ws []workers.Worker
+	_ = json.NewDecoder(res.Body).Decode(&ws)
+	return ws, nil
+}
+
+// changeWorker calls one of the worker endpoints (cordon, drain, uncordon)
+func changeWorker(ctx context.Context, host, token string, id uuid.UUID, action string, body interface{}) (workers.Worker, error) {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return workers.Worker{}, fmt.Errorf("error marshaling json: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/workers/%s/%s", host, id.String(), action), bytes.NewReader(b))
+	if err != nil {
+		return workers.Worker{}, fmt.Errorf("creating post request: %w", err)
+	}
+	req.Header.Set("Authorization", token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return workers.Worker{}, fmt.Errorf("performing post request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		ret, _ := io.ReadAll(res.Body)
+		return workers.Worker{}, fmt.Errorf("server error, recived status code %d and body: %s", res.StatusCode, string(ret))
+	}
+
+	var w workers.Worker
+	_ = json.NewDecoder(res.Body).Decode(&w)
+	return w, nil
+}
+
 func getLogs(ctx context.Context, host, token string, id uuid.UUID) (string, error) {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/logs/%s", host, id.String()), nil)
 	if err != nil {
@@ -5,14 +5,20 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/urfave/cli/v2"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/artifacts"
 	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/config"
 	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/database"
-	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
 )
 
 // conf stores the configuration of the application
@@ -64,9 +70,15 @@ func main() {
 				Aliases:   []string{"e"},
 				Usage:     "Enqueues an experiment",
 				ArgsUsage: "<filename>",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{
+						Name:  "hold",
+						Usage: "Enqueue the experiment as held, it won't start until released",
+					},
+				},
 				Action: func(c *cli.Context) error {
 					if c.Args().Len() > 0 {
-						return enqueueExperiment(cfg.Host, cfg.Token, c.Args().Get(0))
+						return enqueueExperiment(cfg.Host, cfg.Token, c.Args().Get(0), c.Bool("hold"))
 					}
 
 					fmt.Println("Input experiment file not specified")
@@ -87,6 +99,182 @@ func main() {
 					return nil
 				},
 			},
+			{
+				Name:      "cancel",
+				Aliases:   []string{"c"},
+				Usage:     "Cancels an experiment, stopping it if it is running",
+				ArgsUsage: "<id>",
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() > 0 {
+						return cancelExperiment(cfg.Host, cfg.Token, c.Args().Get(0))
+					}
+
+					fmt.Println("Experiment ID not specified")
+					return nil
+				},
+			},
+			{
+				Name:      "hold",
+				Usage:     "Holds enqueued experiments so that they don't start",
+				ArgsUsage: "[id...]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "queue",
+						Usage: "Only experiments in the given queue",
+					},
+					&cli.StringFlag{
+						Name:  "name",
+						Usage: "Only experiments whose name starts with the given prefix",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return changeExperimentsStatus(cfg.Host, cfg.Token, "experiments/hold", c)
+				},
+			},
+			{
+				Name:      "release",
+				Usage:     "Releases held experiments so that they can start",
+				ArgsUsage: "[id...]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "queue",
+						Usage: "Only experiments in the given queue",
+					},
+					&cli.StringFlag{
+						Name:  "name",
+						Usage: "Only experiments whose name starts with the given prefix",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					return changeExperimentsStatus(cfg.Host, cfg.Token, "experiments/release", c)
+				},
+			},
+			{
+				Name:  "deadletter",
+				Usage: "Lists the expired experiments and the ones that exhausted their retries",
+				Action: func(c *cli.Context) error {
+					return listDeadLetters(cfg.Host, cfg.Token)
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:      "requeue",
+						Usage:     "Enqueues dead-lettered experiments again",
+						ArgsUsage: "[id...]",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:  "queue",
+								Usage: "Only experiments in the given queue",
+							},
+							&cli.StringFlag{
+								Name:  "name",
+								Usage: "Only experiments whose name starts with the given prefix",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							return changeExperimentsStatus(cfg.Host, cfg.Token, "deadletter/requeue", c)
+						},
+					},
+				},
+			},
+			{
+				Name:  "workers",
+				Usage: "Lists the registered workers",
+				Action: func(c *cli.Context) error {
+					return listWorkers(cfg.Host, cfg.Token)
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:      "cordon",
+						Usage:     "Stops giving new experiments to a worker",
+						ArgsUsage: "<id or name>",
+						Action: func(c *cli.Context) error {
+							return changeWorkerState(cfg.Host, cfg.Token, "cordon", nil, c)
+						},
+					},
+					{
+						Name:      "drain",
+						Usage:     "Cordons a worker and waits for its experiments to finish or requeues them",
+						ArgsUsage: "<id or name>",
+						Flags: []cli.Flag{
+							&cli.BoolFlag{
+								Name:  "requeue",
+								Usage: "Stop the running experiments and enqueue them again instead of waiting for them",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							return changeWorkerState(cfg.Host, cfg.Token, "drain", map[string]bool{"requeue": c.Bool("requeue")}, c)
+						},
+					},
+					{
+						Name:      "uncordon",
+						Usage:     "Gives new experiments to a cordoned or drained worker again",
+						ArgsUsage: "<id or name>",
+						Action: func(c *cli.Context) error {
+							return changeWorkerState(cfg.Host, cfg.Token, "uncordon", nil, c)
+						},
+					},
+				},
+			},
+			{
+				Name:      "stats",
+				Usage:     "Shows the resource usage of an experiment",
+				ArgsUsage: "<id>",
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "step",
+						Value: time.Minute,
+						Usage: "Interval of the rows of the usage table, averaging the samples in each",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() > 0 {
+						return showStats(cfg.Host, cfg.Token, c.Args().Get(0), c.Duration("step"))
+					}
+
+					fmt.Println("Experiment ID not specified")
+					return nil
+				},
+			},
+			{
+				Name:  "artifacts",
+				Usage: "Lists and downloads the outputs collected from experiments",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "ls",
+						Usage:     "Lists the artifacts of an experiment",
+						ArgsUsage: "<id>",
+						Action: func(c *cli.Context) error {
+							if c.Args().Len() > 0 {
+								return listArtifacts(cfg.Host, cfg.Token, c.Args().Get(0))
+							}
+
+							fmt.Println("Experiment ID not specified")
+							return nil
+						},
+					},
+					{
+						Name:      "get",
+						Usage:     "Downloads a file or directory of the artifacts of an experiment, or all of them",
+						ArgsUsage: "<id> [path]",
+						Flags: []cli.Flag{
+							&cli.StringFlag{
+								Name:    "output",
+								Aliases: []string{"o"},
+								Value:   ".",
+								Usage:   "Directory where the artifacts are saved",
+							},
+						},
+						Action: func(c *cli.Context) error {
+							if c.Args().Len() > 0 {
+								return getArtifact(cfg.Host, cfg.Token, c.Args().Get(0), c.Args().Get(1), c.String("output"))
+							}
+
+							fmt.Println("Experiment ID not specified")
+							return nil
+						},
+					},
+				},
+			},
 			{
 				Name:      "logs",
 				Aliases:   []string{"l"},
@@ -165,18 +353,27 @@ func showExperiment(host string, token string, id string) error {
 }
 
 // enqueueExperiment enqueues an experiment from a file
-func enqueueExperiment(host, token, fileName string) error {
-	job, err := jobs.NewFromFile(fileName)
+func enqueueExperiment(host, token, fileName string, hold bool) error {
+	b, err := ioutil.ReadFile(fileName)
 	if err != nil {
 		return fmt.Errorf("error reading specification: %w", err)
 	}
 
-	ret, err := newJob(context.TODO(), host, token, *job)
+	var job database.InsertParams
+	if err := json.Unmarshal(b, &job); err != nil {
+		return fmt.Errorf("error unmarshaling specification: %w", err)
+	}
+	job.Hold = job.Hold || hold
+	if job.User == "" {
+		job.User = username()
+	}
+
+	ret, err := newJob(context.TODO(), host, token, job)
 	if err != nil {
 		return fmt.Errorf("error creating new job: %w", err)
 	}
 
-	b, err := json.Marshal(ret)
+	b, err = json.Marshal(ret)
 	if err != nil {
 		return fmt.Errorf("error encoding data: %w", err)
 	}
@@ -211,6 +408,283 @@ func updateExperiment(host, token, fileName string) error {
 	return nil
 }
 
+// listDeadLetters lists the dead-lettered experiments
+func listDeadLetters(host, token string) error {
+	ret, err := getDeadLetters(context.TODO(), host, token)
+	if err != nil {
+		return fmt.Errorf("error getting dead-lettered jobs: %w", err)
+	}
+
+	b, err := json.Marshal(ret)
+	if err != nil {
+		return fmt.Errorf("error encoding data: %w", err)
+	}
+
+	fmt.Println(prettyString(b))
+	return nil
+}
+
+// listWorkers lists the registered workers
+func listWorkers(host, token string) error {
+	ret, err := getWorkers(context.TODO(), host, token)
+	if err != nil {
+		return fmt.Errorf("error getting workers: %w", err)
+	}
+
+	b, err := json.Marshal(ret)
+	if err != nil {
+		return fmt.Errorf("error encoding data: %w", err)
+	}
+
+	fmt.Println(prettyString(b))
+	return nil
+}
+
+// changeWorkerState cordons, drains or uncordons the worker given as argument, by ID or name
+func changeWorkerState(host, token, action string, body interface{}, c *cli.Context) error {
+	if c.Args().Len() == 0 {
+		fmt.Println("Worker ID or name not specified")
+		return nil
+	}
+
+	id, err := uuid.FromString(c.Args().Get(0))
+	if err != nil {
+		ws, err := getWorkers(context.TODO(), host, token)
+		if err != nil {
+			return fmt.Errorf("error getting workers: %w", err)
+		}
+		for _, w := range ws {
+			if w.Name == c.Args().Get(0) {
+				id = w.ID
+			}
+		}
+		if id == uuid.Nil {
+			return fmt.Errorf("worker %q not found", c.Args().Get(0))
+		}
+	}
+
+	ret, err := changeWorker(context.TODO(), host, token, id, action, body)
+	if err != nil {
+		return fmt.Errorf("error changing worker: %w", err)
+	}
+
+	b, err := json.Marshal(ret)
+	if err != nil {
+		return fmt.Errorf("error encoding data: %w", err)
+	}
+	fmt.Println(prettyString(b))
+
+	return nil
+}
+
+// changeExperimentsStatus holds, releases or requeues the experiments given as arguments or matching the flags
+func changeExperimentsStatus(host, token, path string, c *cli.Context) error {
+	filter := database.JobFilter{
+		Queue:      c.String("queue"),
+		NamePrefix: c.String("name"),
+	}
+	for _, arg := range c.Args().Slice() {
+		id, err := uuid.FromString(arg)
+		if err != nil {
+			return fmt.Errorf("invalid experiment ID %q: %w", arg, err)
+		}
+		filter.IDs = append(filter.IDs, id)
+	}
+
+	if filter.Empty() {
+		fmt.Println("Experiment IDs or filter not specified")
+		return nil
+	}
+
+	ret, err := changeStatus(context.TODO(), host, token, path, filter)
+	if err != nil {
+		return fmt.Errorf("error changing experiments status: %w", err)
+	}
+
+	b, err := json.Marshal(ret)
+	if err != nil {
+		return fmt.Errorf("error encoding data: %w", err)
+	}
+	fmt.Println(prettyString(b))
+
+	return nil
+}
+
+// cancelExperiment cancels an experiment, recording the current user as the one who cancelled it
+func cancelExperiment(host, token, id string) error {
+	jobId, err := uuid.FromString(id)
+	if err != nil {
+		return fmt.Errorf("invalid experiment ID: %w", err)
+	}
+
+	ret, err := cancelJob(context.TODO(), host, token, jobId, whoami())
+	if err != nil {
+		return fmt.Errorf("error cancelling job: %w", err)
+	}
+
+	b, err := json.Marshal(ret)
+	if err != nil {
+		return fmt.Errorf("error encoding data: %w", err)
+	}
+	fmt.Println(prettyString(b))
+
+	return nil
+}
+
+// username returns the name of the user running the client
+func username() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return "unknown"
+}
+
+// whoami returns user@hostname of the user running the client
+func whoami() string {
+	name := username()
+	if hostname, err := os.Hostname(); err == nil {
+		return name + "@" + hostname
+	}
+	return name
+}
+
+// showStats shows a summary of the resource usage of an experiment and its usage over time
+func showStats(host, token, id string, step time.Duration) error {
+	jobId, err := uuid.FromString(id)
+	if err != nil {
+		return fmt.Errorf("invalid experiment ID: %w", err)
+	}
+
+	job, err := getJob(context.TODO(), host, token, jobId)
+	if err != nil {
+		return fmt.Errorf("error getting job from backend: %w", err)
+	}
+	if job.Usage == nil {
+		fmt.Println("The experiment has no resource usage samples")
+		return nil
+	}
+
+	samples, err := getStats(context.TODO(), host, token, jobId, step)
+	if err != nil {
+		return fmt.Errorf("error getting stats: %w", err)
+	}
+
+	var limit int64
+	for _, s := range samples {
+		if s.MemoryLimit > limit {
+			limit = s.MemoryLimit
+		}
+	}
+
+	u := job.Usage
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Experiment:\t%s (%s)\n", job.Name, job.Status)
+	fmt.Fprintf(w, "Samples:\t%d\n", u.Samples)
+	fmt.Fprintf(w, "CPU:\tavg %.1f%%\tpeak %.1f%%\n", u.AvgCPU, u.PeakCPU)
+	if limit > 0 {
+		fmt.Fprintf(w, "Memory:\tavg %s\tpeak %s\tlimit %s\n", formatBytes(u.AvgMemory), formatBytes(u.PeakMemory), formatBytes(limit))
+	} else {
+		fmt.Fprintf(w, "Memory:\tavg %s\tpeak %s\n", formatBytes(u.AvgMemory), formatBytes(u.PeakMemory))
+	}
+	fmt.Fprintf(w, "Network:\trx %s\ttx %s\n", formatBytes(u.NetRx), formatBytes(u.NetTx))
+	fmt.Fprintf(w, "Block IO:\tread %s\twrite %s\n", formatBytes(u.BlockRead), formatBytes(u.BlockWrite))
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if len(samples) == 0 {
+		return nil
+	}
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "TIME\tCPU\tMEMORY\tNET RX\tNET TX\tREAD\tWRITE\t")
+	for _, s := range samples {
+		fmt.Fprintf(w, "%s\t%.1f%%\t%s\t%s\t%s\t%s\t%s\t\n", s.Time.Local().Format("2006-01-02 15:04:05"), s.CPU,
+			formatBytes(s.Memory), formatBytes(s.NetRx), formatBytes(s.NetTx), formatBytes(s.BlockRead), formatBytes(s.BlockWrite))
+	}
+	return w.Flush()
+}
+
+// listArtifacts lists the files collected from an experiment
+func listArtifacts(host, token, id string) error {
+	jobId, err := uuid.FromString(id)
+	if err != nil {
+		return fmt.Errorf("invalid experiment ID: %w", err)
+	}
+
+	files, err := getArtifacts(context.TODO(), host, token, jobId)
+	if err != nil {
+		return fmt.Errorf("error getting artifacts: %w", err)
+	}
+	if len(files) == 0 {
+		fmt.Println("The experiment has no artifacts")
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "PATH\tSIZE\tMODIFIED")
+	for _, f := range files {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", f.Path, formatBytes(f.Size), f.Modified.Local().Format("2006-01-02 15:04:05"))
+	}
+	return w.Flush()
+}
+
+// getArtifact saves a file of the artifacts of an experiment in dir. The directories, and all the
+// artifacts when p is empty, are extracted inside dir.
+func getArtifact(host, token, id, p, dir string) error {
+	jobId, err := uuid.FromString(id)
+	if err != nil {
+		return fmt.Errorf("invalid experiment ID: %w", err)
+	}
+
+	body, isTar, err := downloadArtifact(context.TODO(), host, token, jobId, p)
+	if err != nil {
+		return fmt.Errorf("error downloading artifacts: %w", err)
+	}
+	defer body.Close()
+
+	if isTar {
+		if err := artifacts.Extract(body, dir, 0); err != nil {
+			return fmt.Errorf("error extracting artifacts: %w", err)
+		}
+		fmt.Printf("Artifacts saved in %s\n", dir)
+		return nil
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating directory: %w", err)
+	}
+	target := filepath.Join(dir, path.Base(p))
+	f, err := os.Create(target)
+	if err != nil {
+		return fmt.Errorf("error creating file: %w", err)
+	}
+	if _, err := io.Copy(f, body); err != nil {
+		f.Close()
+		return fmt.Errorf("error saving artifact: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error saving artifact: %w", err)
+	}
+	fmt.Printf("Artifact saved in %s\n", target)
+	return nil
+}
+
+// formatBytes formats a size in bytes with a binary unit
+func formatBytes(b int64) string {
+	const unit = 1024
+	if b < unit {
+		return fmt.Sprintf("%d B", b)
+	}
+	div, exp := int64(unit), 0
+	for n := b / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(b)/float64(div), "KMGTPE"[exp])
+}
+
 // showLogs shows the logs of an experiment
 func showLogs(host string, token string, id string) error {
 	jobId, _ := uuid.FromString(id)
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"path"
+
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+)
+
+// collectArtifacts copies the outputs of the job out of its container and uploads them to the
+// server. The outputs that can't be copied are logged and skipped, the job result is kept.
+func (w *worker) collectArtifacts(logr *log.Logger, j jobs.Job, containerID string) {
+	for _, output := range j.Docker.Outputs {
+		p := output
+		if !path.IsAbs(p) && path.IsAbs(j.Docker.Workdir) {
+			p = path.Join(j.Docker.Workdir, p)
+		}
+
+		archive, err := w.rt.CopyFrom(context.TODO(), containerID, p)
+		if errors.Is(err, errNoCopy) {
+			logr.Printf("not collecting the outputs: %v\n", err)
+			return
+		}
+		if err != nil {
+			logr.Printf("error copying output %s: %v\n", output, err)
+			continue
+		}
+
+		err = uploadArtifacts(context.TODO(), w.host, w.token, j.ID, archive)
+		archive.Close()
+		if err != nil {
+			logr.Printf("error uploading output %s: %v\n", output, err)
+			continue
+		}
+		logr.Printf("uploaded output %s to the artifacts\n", output)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"log"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/docker/distribution/reference"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+)
+
+const (
+	// defaultCacheInterval is how often the image cache is checked by default
+	defaultCacheInterval = time.Minute
+	// defaultQueuedImages is how many images of the enqueued jobs are kept when they are not
+	// pulled in advance
+	defaultQueuedImages = 5
+	// recentlyUsed is how long an image is kept after Pull marks it as used. A slot creates the
+	// container after pulling, so until then the image is not in use by any container.
+	recentlyUsed = 10 * time.Minute
+)
+
+// imageCacheConfig configures the images kept by the worker
+type imageCacheConfig struct {
+	// Prepull is how many images of the next enqueued jobs are pulled before the jobs are claimed,
+	// zero disables it
+	Prepull int `yaml:"prepull"`
+	// MinFree is the free disk space below which the unused images are removed, the least recently
+	// used first. Zero disables it.
+	MinFree jobs.Size `yaml:"min_free"`
+	// Keep are the images that are never removed, they can be patterns like "pytorch/*"
+	Keep []string `yaml:"keep"`
+	// Interval is how often the cache is checked, 1m by default
+	Interval time.Duration `yaml:"interval"`
+}
+
+// localImage is an image stored by the runtime
+type localImage struct {
+	ID      string
+	Tags    []string
+	Digests []string
+	Size    int64
+	// LastUsed is when a job last used the image, or when it was created if no job has. It is
+	// only kept in memory, after the worker restarts it is the creation time again.
+	LastUsed time.Time
+	// InUse is true if a container, running or not, uses the image
+	InUse bool
+}
+
+// imageStore is implemented by the runtimes that keep the images locally, so that the image
+// cache can manage them
+type imageStore interface {
+	HasImage(ctx context.Context, image string) (bool, error)
+	Images(ctx context.Context) ([]localImage, error)
+	RemoveImage(ctx context.Context, id string) error
+	// DiskFree returns the free space in bytes of the disk where the images are stored
+	DiskFree(ctx context.Context) (int64, error)
+}
+
+// imageCache pulls the images of the enqueued jobs in advance and removes the unused images when
+// the disk is running out of space
+type imageCache struct {
+	cfg   imageCacheConfig
+	rt    Runtime
+	store imageStore
+	host  string
+	token string
+}
+
+func newImageCache(cfg imageCacheConfig, rt Runtime, store imageStore, host, token string) *imageCache {
+	if cfg.Interval <= 0 {
+		cfg.Interval = defaultCacheInterval
+	}
+	return &imageCache{cfg: cfg, rt: rt, store: store, host: host, token: token}
+}
+
+// run checks the cache every interval until closing is closed
+func (c *imageCache) run(closing <-chan struct{}) {
+	t := time.NewTicker(c.cfg.Interval)
+	defer t.Stop()
+
+	for {
+		c.check(context.TODO())
+
+		select {
+		case <-closing:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (c *imageCache) check(ctx context.Context) {
+	// the images of the next jobs are kept even if they are not pulled in advance
+	max := c.cfg.Prepull
+	if max == 0 {
+		max = defaultQueuedImages
+	}
+	queued, err := getQueuedImages(ctx, c.host, c.token, max)
+	if err != nil {
+		log.Printf("error getting the images of the enqueued jobs: %v\n", err)
+	}
+
+	if c.cfg.Prepull > 0 {
+		c.prepull(ctx, queued)
+	}
+	if c.cfg.MinFree > 0 {
+		c.collect(ctx, queued)
+	}
+}
+
+// prepull pulls the images that are not present
+func (c *imageCache) prepull(ctx context.Context, images []string) {
+	for _, image := range images {
+		present, err := c.store.HasImage(ctx, image)
+		if err != nil {
+			log.Printf("error checking image %s: %v\n", image, err)
+			continue
+		}
+		if present {
+			continue
+		}
+
+		start := time.Now()
+		if _, err := c.rt.Pull(ctx, image, jobs.PullIfNotPresent, ioutil.Discard); err != nil {
+			log.Printf("error pre-pulling image %s: %v\n", image, err)
+			continue
+		}
+		log.Printf("pre-pulled image %s for an enqueued job in %s\n", image, time.Since(start).Round(time.Second))
+	}
+}
+
+// collect removes the unused images, the least recently used first, until there is MinFree space.
+// The images used in the last recentlyUsed are kept, a slot may be about to create a container.
+func (c *imageCache) collect(ctx context.Context, queued []string) {
+	free, err := c.store.DiskFree(ctx)
+	if err != nil {
+		log.Printf("error getting the free disk space, not removing images: %v\n", err)
+		return
+	}
+	if free >= int64(c.cfg.MinFree) {
+		return
+	}
+
+	images, err := c.store.Images(ctx)
+	if err != nil {
+		log.Printf("error listing images: %v\n", err)
+		return
+	}
+
+	keep := append(append([]string{}, c.cfg.Keep...), familiarImages(queued)...)
+	var unused []localImage
+	for _, img := range images {
+		if !img.InUse && time.Since(img.LastUsed) >= recentlyUsed && !matchesAny(img, keep) {
+			unused = append(unused, img)
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool { return unused[i].LastUsed.Before(unused[j].LastUsed) })
+
+	for _, img := range unused {
+		if free >= int64(c.cfg.MinFree) {
+			return
+		}
+		if err := c.store.RemoveImage(ctx, img.ID); err != nil {
+			log.Printf("error removing image %s %v: %v\n", img.ID, img.Tags, err)
+			continue
+		}
+
+		// the layers shared with other images are not freed, so the space is measured again
+		if free, err = c.store.DiskFree(ctx); err != nil {
+			log.Printf("error getting the free disk space: %v\n", err)
+			return
+		}
+		log.Printf("removed image %s %v last used at %s, %s free\n", img.ID, img.Tags, img.LastUsed.Format(time.RFC3339), jobs.Size(free))
+	}
+	if free < int64(c.cfg.MinFree) {
+		log.Printf("only %s free after removing the unused images, below the minimum of %s\n", jobs.Size(free), c.cfg.MinFree)
+	}
+}
+
+// familiarImages returns the images as they are shown in the tags and digests of the local
+// images, like "ubuntu:latest"
+func familiarImages(images []string) []string {
+	var res []string
+	for _, image := range images {
+		named, err := reference.ParseNormalizedNamed(image)
+		if err != nil {
+			continue
+		}
+		res = append(res, reference.FamiliarString(reference.TagNameOnly(named)))
+	}
+	return res
+}
+
+// matchesAny returns true if a tag or digest of the image matches one of the patterns
+func matchesAny(img localImage, patterns []string) bool {
+	for _, name := range append(append([]string{}, img.Tags...), img.Digests...) {
+		for _, pattern := range patterns {
+			if ok, err := path.Match(pattern, name); err == nil && ok {
+				return true
+			}
+		}
+	}
+	return false
+}
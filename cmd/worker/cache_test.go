@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fakeImageStore keeps the images in memory, every image removed frees its size
+type fakeImageStore struct {
+	images  []localImage
+	free    int64
+	removed []string
+}
+
+func (s *fakeImageStore) HasImage(ctx context.Context, image string) (bool, error) {
+	return false, nil
+}
+
+func (s *fakeImageStore) Images(ctx context.Context) ([]localImage, error) {
+	return s.images, nil
+}
+
+func (s *fakeImageStore) RemoveImage(ctx context.Context, id string) error {
+	for _, img := range s.images {
+		if img.ID == id {
+			s.free += img.Size
+		}
+	}
+	s.removed = append(s.removed, id)
+	return nil
+}
+
+func (s *fakeImageStore) DiskFree(ctx context.Context) (int64, error) {
+	return s.free, nil
+}
+
+func TestCollectKeepsImagesInUse(t *testing.T) {
+	now := time.Now()
+	store := &fakeImageStore{
+		images: []localImage{
+			{ID: "running", Tags: []string{"train:1"}, Size: 10, LastUsed: now.Add(-48 * time.Hour), InUse: true},
+			{ID: "kept", Tags: []string{"pytorch/pytorch:2"}, Size: 10, LastUsed: now.Add(-48 * time.Hour)},
+			{ID: "queued", Tags: []string{"eval:3"}, Size: 10, LastUsed: now.Add(-48 * time.Hour)},
+			// pulled by a slot that has not created its container yet
+			{ID: "preparing", Tags: []string{"train:2"}, Size: 10, LastUsed: now.Add(-time.Second)},
+			{ID: "newer", Tags: []string{"old:2"}, Size: 10, LastUsed: now.Add(-time.Hour)},
+			{ID: "oldest", Tags: []string{"old:1"}, Size: 10, LastUsed: now.Add(-24 * time.Hour)},
+		},
+	}
+	c := newImageCache(imageCacheConfig{MinFree: 100, Keep: []string{"pytorch/*"}}, nil, store, "", "")
+
+	c.collect(context.Background(), []string{"eval:3"})
+
+	want := []string{"oldest", "newer"}
+	if len(store.removed) != len(want) {
+		t.Fatalf("removed %v, want %v", store.removed, want)
+	}
+	for i := range want {
+		if store.removed[i] != want[i] {
+			t.Fatalf("removed %v, want %v", store.removed, want)
+		}
+	}
+}
@@ -1,53 +1,67 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 	"time"
 
+	"github.com/gofrs/uuid"
 	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/workers"
 )
 
-var errNoJob = errors.New("no job available")
-
 var httpClient = &http.Client{
 	Timeout: 10 * time.Second,
 }
 
-func fetchJobs(ctx context.Context, host string, token string) (jobs.Job, error) {
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/workers/poll", host), nil)
-	req.Header.Set("User-Agent", "Skeduler-Puller/1.0")
-	req.Header.Set("Authorization", token)
+// pollClient is used for the long polls, which set their own deadline
+var pollClient = &http.Client{}
+
+// pollJobs claims up to max jobs, waiting in the server up to wait for them. Returns no jobs and
+// no error when none became available.
+func pollJobs(ctx context.Context, host string, token string, workerID uuid.UUID, wait time.Duration, max int, gpus int) ([]jobs.Job, error) {
+	// the request lasts as long as the wait, so it cannot use the timeout of httpClient
+	ctx, cancel := context.WithTimeout(ctx, wait+httpClient.Timeout)
+	defer cancel()
+
+	uri := fmt.Sprintf("%s/workers/poll?worker=%s&wait=%s&max=%d&gpus=%d", host, workerID, wait, max, gpus)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
 	if err != nil {
-		return jobs.Job{}, fmt.Errorf("creating get request: %w", err)
+		return nil, fmt.Errorf("creating get request: %w", err)
 	}
+	req.Header.Set("User-Agent", "Skeduler-Puller/1.0")
+	req.Header.Set("Authorization", token)
 
-	res, err := httpClient.Do(req)
+	res, err := pollClient.Do(req)
 	if err != nil {
-		return jobs.Job{}, fmt.Errorf("performing get request: %w", err)
+		return nil, fmt.Errorf("performing get request: %w", err)
 	}
 	defer res.Body.Close()
 
 	switch res.StatusCode {
 	case http.StatusNoContent:
 		_, _ = io.Copy(ioutil.Discard, res.Body)
-		return jobs.Job{}, errNoJob
+		return nil, nil
 
 	case http.StatusOK:
-		var job jobs.Job
-		_ = json.NewDecoder(res.Body).Decode(&job)
-		return job, nil
+		var claimed []jobs.Job
+		if err := json.NewDecoder(res.Body).Decode(&claimed); err != nil {
+			return nil, fmt.Errorf("decoding response: %w", err)
+		}
+		return claimed, nil
 
 	default:
 	}
 
-	return jobs.Job{}, fmt.Errorf("server error, recived status code %d and body", res.StatusCode)
+	b, _ := ioutil.ReadAll(res.Body)
+	return nil, fmt.Errorf("server error, recived status code %d and body: %v", res.StatusCode, string(b))
 }
 
 func updateJob(ctx context.Context, host string, job jobs.Job, token string) error {
@@ -77,3 +91,301 @@ func updateJob(ctx context.Context, host string, job jobs.Job, token string) err
 
 	return fmt.Errorf("server error, recived status code %d and body: %v", res.StatusCode, string(b))
 }
+
+func sendHeartbeat(ctx context.Context, host string, token string, hb workers.Heartbeat) (workers.HeartbeatResponse, error) {
+	buff := &bytes.Buffer{}
+	if err := json.NewEncoder(buff).Encode(hb); err != nil {
+		return workers.HeartbeatResponse{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/workers/heartbeat", host), buff)
+	if err != nil {
+		return workers.HeartbeatResponse{}, fmt.Errorf("creating post request: %w", err)
+	}
+	req.Header.Set("User-Agent", "Skeduler-Puller/1.0")
+	req.Header.Set("Authorization", token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return workers.HeartbeatResponse{}, fmt.Errorf("performing post request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return workers.HeartbeatResponse{}, fmt.Errorf("server error, recived status code %d and body: %v", res.StatusCode, string(b))
+	}
+
+	var hbRes workers.HeartbeatResponse
+	if err := json.NewDecoder(res.Body).Decode(&hbRes); err != nil {
+		return workers.HeartbeatResponse{}, fmt.Errorf("decoding response: %w", err)
+	}
+	return hbRes, nil
+}
+
+func registerWorker(ctx context.Context, host string, token string, reg workers.Registration) (workers.Worker, error) {
+	buff := &bytes.Buffer{}
+	if err := json.NewEncoder(buff).Encode(reg); err != nil {
+		return workers.Worker{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/workers/register", host), buff)
+	if err != nil {
+		return workers.Worker{}, fmt.Errorf("creating post request: %w", err)
+	}
+	req.Header.Set("User-Agent", "Skeduler-Puller/1.0")
+	req.Header.Set("Authorization", token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return workers.Worker{}, fmt.Errorf("performing post request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return workers.Worker{}, fmt.Errorf("server error, recived status code %d and body: %v", res.StatusCode, string(b))
+	}
+
+	var w workers.Worker
+	if err := json.NewDecoder(res.Body).Decode(&w); err != nil {
+		return workers.Worker{}, fmt.Errorf("decoding response: %w", err)
+	}
+	return w, nil
+}
+
+func returnJobs(ctx context.Context, host string, token string, returned workers.ReturnedJobs) error {
+	buff := &bytes.Buffer{}
+	if err := json.NewEncoder(buff).Encode(returned); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/workers/return", host), buff)
+	if err != nil {
+		return fmt.Errorf("creating post request: %w", err)
+	}
+	req.Header.Set("User-Agent", "Skeduler-Puller/1.0")
+	req.Header.Set("Authorization", token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("performing post request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("server error, recived status code %d and body: %v", res.StatusCode, string(b))
+	}
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	return nil
+}
+
+func uploadStats(ctx context.Context, host string, token string, id uuid.UUID, samples []jobs.StatsSample) error {
+	buff := &bytes.Buffer{}
+	if err := json.NewEncoder(buff).Encode(samples); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/experiments/%s/stats", host, id), buff)
+	if err != nil {
+		return fmt.Errorf("creating post request: %w", err)
+	}
+	req.Header.Set("User-Agent", "Skeduler-Puller/1.0")
+	req.Header.Set("Authorization", token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("performing post request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("server error, recived status code %d and body: %v", res.StatusCode, string(b))
+	}
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	return nil
+}
+
+// uploadPull stores how the image of the job was pulled
+func uploadPull(ctx context.Context, host string, token string, id uuid.UUID, info jobs.PullInfo) error {
+	buff := &bytes.Buffer{}
+	if err := json.NewEncoder(buff).Encode(info); err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/experiments/%s/pull", host, id), buff)
+	if err != nil {
+		return fmt.Errorf("creating post request: %w", err)
+	}
+	req.Header.Set("User-Agent", "Skeduler-Puller/1.0")
+	req.Header.Set("Authorization", token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("performing post request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("server error, recived status code %d and body: %v", res.StatusCode, string(b))
+	}
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	return nil
+}
+
+// uploadArtifacts streams a tar archive to the artifacts of the job. It uses pollClient, the
+// archive can take longer than the timeout of httpClient to send.
+func uploadArtifacts(ctx context.Context, host string, token string, id uuid.UUID, archive io.Reader) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, fmt.Sprintf("%s/experiments/%s/artifacts", host, id), archive)
+	if err != nil {
+		return fmt.Errorf("creating post request: %w", err)
+	}
+	req.Header.Set("User-Agent", "Skeduler-Puller/1.0")
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Content-Type", "application/x-tar")
+
+	res, err := pollClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("performing post request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("server error, recived status code %d and body: %v", res.StatusCode, string(b))
+	}
+	_, _ = io.Copy(ioutil.Discard, res.Body)
+	return nil
+}
+
+// getQueuedImages returns the images of the next enqueued jobs, up to max
+func getQueuedImages(ctx context.Context, host string, token string, max int) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/workers/images?max=%d", host, max), nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating get request: %w", err)
+	}
+	req.Header.Set("User-Agent", "Skeduler-Puller/1.0")
+	req.Header.Set("Authorization", token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("performing get request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("server error, recived status code %d and body: %v", res.StatusCode, string(b))
+	}
+
+	var images []string
+	if err := json.NewDecoder(res.Body).Decode(&images); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	return images, nil
+}
+
+// getRegistryAuth returns the credentials the server has for a registry, nil if it has none
+func getRegistryAuth(ctx context.Context, host string, token string, workerID uuid.UUID, registry string) (*workers.RegistryAuth, error) {
+	uri := fmt.Sprintf("%s/workers/registries/%s?worker=%s", host, url.PathEscape(registry), workerID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating get request: %w", err)
+	}
+	req.Header.Set("User-Agent", "Skeduler-Puller/1.0")
+	req.Header.Set("Authorization", token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("performing get request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		_, _ = io.Copy(ioutil.Discard, res.Body)
+		return nil, nil
+	}
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return nil, fmt.Errorf("server error, recived status code %d and body: %v", res.StatusCode, string(b))
+	}
+
+	var auth workers.RegistryAuth
+	if err := json.NewDecoder(res.Body).Decode(&auth); err != nil {
+		return nil, fmt.Errorf("decoding response: %w", err)
+	}
+	return &auth, nil
+}
+
+func getJob(ctx context.Context, host string, token string, id uuid.UUID) (jobs.Job, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/experiments/%s", host, id), nil)
+	if err != nil {
+		return jobs.Job{}, fmt.Errorf("creating get request: %w", err)
+	}
+	req.Header.Set("User-Agent", "Skeduler-Puller/1.0")
+	req.Header.Set("Authorization", token)
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return jobs.Job{}, fmt.Errorf("performing get request: %w", err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		b, _ := ioutil.ReadAll(res.Body)
+		return jobs.Job{}, fmt.Errorf("server error, recived status code %d and body: %v", res.StatusCode, string(b))
+	}
+
+	var job jobs.Job
+	if err := json.NewDecoder(res.Body).Decode(&job); err != nil {
+		return jobs.Job{}, fmt.Errorf("decoding response: %w", err)
+	}
+	return job, nil
+}
+
+// logTailSize is how much of the end of a job log is read to find its last line
+const logTailSize = 64 * 1024
+
+// lastLogTime returns the timestamp of the last container line the server has in the log of a job,
+// the zero time if it has none
+func lastLogTime(ctx context.Context, host string, token string, id uuid.UUID) (time.Time, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/logs/%s", host, id), nil)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("creating get request: %w", err)
+	}
+	req.Header.Set("User-Agent", "Skeduler-Puller/1.0")
+	req.Header.Set("Authorization", token)
+	req.Header.Set("Range", fmt.Sprintf("bytes=-%d", logTailSize))
+
+	res, err := httpClient.Do(req)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("performing get request: %w", err)
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusPartialContent:
+	case http.StatusRequestedRangeNotSatisfiable:
+		// empty log
+		return time.Time{}, nil
+	default:
+		b, _ := ioutil.ReadAll(res.Body)
+		return time.Time{}, fmt.Errorf("server error, recived status code %d and body: %v", res.StatusCode, string(b))
+	}
+
+	var last time.Time
+	scanner := bufio.NewScanner(res.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if t, ok := lineTime(scanner.Text()); ok {
+			last = t
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, fmt.Errorf("reading log: %w", err)
+	}
+	return last, nil
+}
@@ -0,0 +1,7 @@
+package main
+
+import "errors"
+
+func diskFree(path string) (int64, error) {
+	return 0, errors.New("the free disk space is not available on windows")
+}
@@ -0,0 +1,579 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/mount"
+	volumetypes "github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-units"
+	"github.com/gofrs/uuid"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/workers"
+)
+
+const (
+	// containerJobLabel is the label with the skeduler job ID set on the containers
+	containerJobLabel = "skeduler.job-id"
+	// containerWorkerLabel is the label with the name of the worker that created the container
+	containerWorkerLabel = "skeduler.worker"
+	// containerGPUsLabel is the label with the GPUs given to the container, separated by commas, so
+	// that they are not given to another job after the worker restarts
+	containerGPUsLabel = "skeduler.gpus"
+)
+
+// dockerRuntime runs the jobs as Docker containers
+type dockerRuntime struct {
+	cli *client.Client
+	// credentials are used to pull the images of the private registries
+	credentials *registryCredentials
+
+	mu sync.Mutex
+	// lastUsed is when a job last used each image, by image ID. It is not persisted, after a
+	// restart the images are ordered by their creation time until they are used again.
+	lastUsed map[string]time.Time
+}
+
+func newDockerRuntime(credentials *registryCredentials) (*dockerRuntime, error) {
+	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
+	if err != nil {
+		return nil, fmt.Errorf("creating docker client: %w", err)
+	}
+	return &dockerRuntime{cli: cli, credentials: credentials, lastUsed: make(map[string]time.Time)}, nil
+}
+
+func (d *dockerRuntime) Close() error {
+	return d.cli.Close()
+}
+
+// Pull pulls the image with the credentials of its registry, if there are any, unless the policy
+// allows using the one already present. A rejected token printed by a credentials command is
+// refreshed and the pull retried once. The digest of the image used is written to out, so that
+// the run can be reproduced.
+func (d *dockerRuntime) Pull(ctx context.Context, image string, policy jobs.PullPolicy, out io.Writer) (*jobs.PullInfo, error) {
+	if policy != jobs.PullAlways {
+		present, err := d.HasImage(ctx, image)
+		if err != nil {
+			return nil, err
+		}
+		if !present && policy == jobs.PullNever {
+			return nil, fmt.Errorf("image %s is not present and the pull policy is %s", image, policy)
+		}
+		if present {
+			_, _ = fmt.Fprintf(out, "image %s is present, not pulling it (pull policy %s)\n", image, policy)
+			info := &jobs.PullInfo{}
+			info.ImageID, info.Digest, err = d.useImage(ctx, image, out)
+			return info, err
+		}
+	}
+
+	registry, err := workers.RegistryHost(image)
+	if err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	info, err := d.pull(ctx, image, registry, out)
+	if isAuthError(err) && d.credentials.refresh(registry) {
+		_, _ = fmt.Fprintf(out, "registry %s rejected the token, refreshing it\n", registry)
+		info, err = d.pull(ctx, image, registry, out)
+	}
+	if err != nil {
+		return nil, err
+	}
+	took := time.Since(start)
+	info.Duration = jobs.Duration(took)
+	_, _ = fmt.Fprintf(out, "pulled image %s in %s: %s downloaded, %d layers of %d were already present\n",
+		image, took.Round(time.Millisecond), units.BytesSize(float64(info.Bytes)), info.CachedLayers, info.Layers)
+
+	info.ImageID, info.Digest, err = d.useImage(ctx, image, out)
+	return &info, err
+}
+
+// useImage records that a job uses the image and writes its digest to out. It returns the ID and
+// the registry digest of the image, which is empty for the local images.
+func (d *dockerRuntime) useImage(ctx context.Context, image string, out io.Writer) (string, string, error) {
+	info, _, err := d.cli.ImageInspectWithRaw(ctx, image)
+	if err != nil {
+		return "", "", fmt.Errorf("inspecting image: %w", err)
+	}
+
+	d.mu.Lock()
+	d.lastUsed[info.ID] = time.Now()
+	d.mu.Unlock()
+
+	var digest string
+	if len(info.RepoDigests) > 0 {
+		digest = info.RepoDigests[0][strings.Index(info.RepoDigests[0], "@")+1:]
+	}
+
+	digests := strings.Join(info.RepoDigests, ", ")
+	if digests == "" {
+		digests = "local image, without a registry digest"
+	}
+	_, err = fmt.Fprintf(out, "using image %s %s (%s)\n", image, info.ID, digests)
+	return info.ID, digest, err
+}
+
+// pull pulls the image, writing a summary of the progress to out. The errors in the progress
+// stream, like a layer that cannot be downloaded, are returned.
+func (d *dockerRuntime) pull(ctx context.Context, image, registry string, out io.Writer) (jobs.PullInfo, error) {
+	auth, from, err := d.credentials.get(ctx, registry)
+	if err != nil {
+		return jobs.PullInfo{}, fmt.Errorf("getting credentials of registry %s: %w", registry, err)
+	}
+
+	var opts types.ImagePullOptions
+	if auth != nil {
+		if opts.RegistryAuth, err = authCredentials(*auth, registry); err != nil {
+			return jobs.PullInfo{}, err
+		}
+	}
+
+	// la variable reader conté el progrés/log del pull de la imatge.
+	reader, err := d.cli.ImagePull(ctx, image, opts)
+	if isAuthError(err) {
+		if auth == nil {
+			return jobs.PullInfo{}, fmt.Errorf("authentication failed, there are no credentials for registry %s: %w", registry, err)
+		}
+		return jobs.PullInfo{}, fmt.Errorf("authentication failed, registry %s rejected the credentials of user %q from the %s: %w", registry, auth.Username, from, err)
+	}
+	if err != nil {
+		return jobs.PullInfo{}, err
+	}
+	defer reader.Close()
+
+	return decodePull(reader, out, pullProgressInterval)
+}
+
+// isAuthError returns true if the registry refused the pull because of the credentials. The
+// daemon reports a private image pulled anonymously as not found, so the message is checked too.
+func isAuthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errdefs.IsUnauthorized(err) || errdefs.IsForbidden(err) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, s := range []string{"unauthorized", "authentication required", "access denied", "denied:", "incorrect username or password"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *dockerRuntime) Create(ctx context.Context, spec RunSpec) (string, []string, error) {
+	containerConfig := &container.Config{
+		Image:      spec.Image,
+		Cmd:        spec.Cmd,
+		Entrypoint: spec.Entrypoint,
+		Hostname:   spec.Hostname,
+		Env:        spec.Env,
+		WorkingDir: spec.Workdir,
+		User:       spec.User,
+		Labels: map[string]string{
+			containerJobLabel:    spec.JobID.String(),
+			containerWorkerLabel: spec.Worker,
+			containerGPUsLabel:   strings.Join(spec.GPUs, ","),
+		},
+	}
+
+	hostConfig := &container.HostConfig{
+		// the worker removes the container once it has its exit code, so that a container that
+		// exits while the worker is restarting is not lost
+		AutoRemove: false,
+		ShmSize:    int64(spec.Resources.ShmSize),
+		Resources: container.Resources{
+			NanoCPUs:   int64(spec.Resources.CPUs * 1e9),
+			Memory:     int64(spec.Resources.Memory),
+			MemorySwap: int64(spec.Resources.MemorySwap),
+		},
+	}
+	if spec.Resources.PidsLimit > 0 {
+		hostConfig.Resources.PidsLimit = &spec.Resources.PidsLimit
+	}
+
+	var scratch []string
+	for _, m := range spec.Mounts {
+		mnt := dockerMount(m)
+		if m.Kind() == jobs.MountScratch {
+			name, err := d.createScratch(ctx, spec, len(scratch))
+			if err != nil {
+				d.removeVolumes(scratch)
+				return "", nil, err
+			}
+			scratch = append(scratch, name)
+			mnt.Source = name
+		}
+		hostConfig.Mounts = append(hostConfig.Mounts, mnt)
+	}
+	for _, u := range spec.Resources.Ulimits {
+		hostConfig.Resources.Ulimits = append(hostConfig.Resources.Ulimits, &units.Ulimit{Name: u.Name, Soft: u.Soft, Hard: u.Hard})
+	}
+
+	if len(spec.GPUs) != 0 {
+		hostConfig.Resources.DeviceRequests = []container.DeviceRequest{
+			{
+				Driver:       "nvidia",
+				DeviceIDs:    spec.GPUs, // especificar que es vol utilitzar la GPU 0, també podria ser "all"
+				Capabilities: [][]string{{"compute", "utility"}},
+			},
+		}
+	}
+
+	resp, err := d.cli.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, "")
+	if err != nil {
+		d.removeVolumes(scratch)
+		return "", nil, err
+	}
+	return resp.ID, resp.Warnings, nil
+}
+
+// scratchPrefix starts the names of the scratch volumes of a job
+func scratchPrefix(jobID uuid.UUID) string {
+	return "skeduler-" + jobID.String() + "-"
+}
+
+// scratchVolume is the name of the n-th scratch volume of a job
+func scratchVolume(jobID uuid.UUID, n int) string {
+	return fmt.Sprintf("%s%d", scratchPrefix(jobID), n)
+}
+
+// createScratch creates the n-th scratch volume of the job. A volume with the same name left by a
+// previous run of the job is removed first, so that the job always starts with an empty one.
+func (d *dockerRuntime) createScratch(ctx context.Context, spec RunSpec, n int) (string, error) {
+	name := scratchVolume(spec.JobID, n)
+	if err := d.cli.VolumeRemove(ctx, name, false); err != nil && !client.IsErrNotFound(err) {
+		return "", fmt.Errorf("removing old scratch volume %s: %w", name, err)
+	}
+
+	_, err := d.cli.VolumeCreate(ctx, volumetypes.VolumeCreateBody{
+		Name: name,
+		Labels: map[string]string{
+			containerJobLabel:    spec.JobID.String(),
+			containerWorkerLabel: spec.Worker,
+		},
+	})
+	if err != nil {
+		return "", fmt.Errorf("creating scratch volume %s: %w", name, err)
+	}
+	return name, nil
+}
+
+// removeVolumes removes the scratch volumes of a container that has been removed, or was never
+// created
+func (d *dockerRuntime) removeVolumes(names []string) {
+	for _, name := range names {
+		if err := d.cli.VolumeRemove(context.TODO(), name, false); err != nil && !client.IsErrNotFound(err) {
+			log.Printf("error removing scratch volume %s: %v\n", name, err)
+		}
+	}
+}
+
+func (d *dockerRuntime) Start(ctx context.Context, id string) error {
+	return d.cli.ContainerStart(ctx, id, types.ContainerStartOptions{})
+}
+
+func (d *dockerRuntime) Logs(ctx context.Context, id string, since time.Time, stdout, stderr io.Writer) error {
+	var sinceOpt string
+	if !since.IsZero() {
+		// Docker includes the lines written at since
+		sinceOpt = since.Add(time.Nanosecond).Format(time.RFC3339Nano)
+	}
+
+	containerLogs, err := d.cli.ContainerLogs(ctx, id, types.ContainerLogsOptions{
+		Since:      sinceOpt,
+		ShowStdout: true,
+		ShowStderr: true,
+		Timestamps: true,
+		Follow:     true,
+		Tail:       "all",
+		Details:    true,
+	})
+	if err != nil {
+		return err
+	}
+	defer containerLogs.Close()
+
+	_, err = stdcopy.StdCopy(stdout, stderr, containerLogs)
+	return err
+}
+
+func (d *dockerRuntime) Wait(ctx context.Context, id string) <-chan ExitStatus {
+	res := make(chan ExitStatus, 1)
+	statusCh, errCh := d.cli.ContainerWait(ctx, id, container.WaitConditionNotRunning)
+
+	go func() {
+		select {
+		case err := <-errCh:
+			res <- ExitStatus{Code: -1, Err: err}
+		case s := <-statusCh:
+			status := ExitStatus{Code: s.StatusCode}
+			if s.Error != nil {
+				status.Err = fmt.Errorf("%s", s.Error.Message)
+			}
+			res <- status
+		}
+	}()
+
+	return res
+}
+
+func (d *dockerRuntime) Stop(ctx context.Context, id string, grace time.Duration) error {
+	err := d.cli.ContainerStop(ctx, id, &grace)
+	if err == nil {
+		return nil
+	}
+
+	if killErr := d.cli.ContainerKill(ctx, id, "SIGKILL"); killErr != nil {
+		return fmt.Errorf("stopping container: %v, killing it: %w", err, killErr)
+	}
+	return nil
+}
+
+func (d *dockerRuntime) Inspect(ctx context.Context, id string) (ContainerState, error) {
+	c, err := d.cli.ContainerInspect(ctx, id)
+	if err != nil {
+		return ContainerState{}, err
+	}
+	if c.State == nil {
+		return ContainerState{}, fmt.Errorf("container %s has no state", id)
+	}
+
+	return ContainerState{
+		Running:  c.State.Running,
+		ExitCode: c.State.ExitCode,
+		Status:   c.State.Status,
+	}, nil
+}
+
+// dockerMount returns the mount of m, Create sets the source of a scratch volume to the volume it
+// creates for the job
+func dockerMount(m jobs.Mount) mount.Mount {
+	switch m.Kind() {
+	case jobs.MountBind:
+		return mount.Mount{Type: mount.TypeBind, Source: m.Source, Target: m.Target, ReadOnly: m.ReadOnly}
+	case jobs.MountScratch:
+		return mount.Mount{Type: mount.TypeVolume, Target: m.Target}
+	default:
+		return mount.Mount{Type: mount.TypeVolume, Source: m.Source, Target: m.Target, ReadOnly: m.ReadOnly}
+	}
+}
+
+// Remove deletes the container together with its anonymous volumes and its scratch volumes
+func (d *dockerRuntime) Remove(ctx context.Context, id string) error {
+	c, err := d.cli.ContainerInspect(ctx, id)
+	if err != nil {
+		if client.IsErrNotFound(err) {
+			return nil
+		}
+		return err
+	}
+
+	var scratch []string
+	if c.Config != nil {
+		jobID := uuid.FromStringOrNil(c.Config.Labels[containerJobLabel])
+		for _, m := range c.Mounts {
+			if jobID != uuid.Nil && m.Type == mount.TypeVolume && strings.HasPrefix(m.Name, scratchPrefix(jobID)) {
+				scratch = append(scratch, m.Name)
+			}
+		}
+	}
+
+	err = d.cli.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: true, RemoveVolumes: true})
+	if err != nil && !client.IsErrNotFound(err) {
+		return err
+	}
+	d.removeVolumes(scratch)
+	return nil
+}
+
+func (d *dockerRuntime) List(ctx context.Context, worker string) ([]JobContainer, error) {
+	containers, err := d.cli.ContainerList(ctx, types.ContainerListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", containerWorkerLabel+"="+worker)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var res []JobContainer
+	for _, c := range containers {
+		jobID, err := uuid.FromString(c.Labels[containerJobLabel])
+		if err != nil {
+			log.Printf("ignoring container %s with invalid job label: %v\n", c.ID, err)
+			continue
+		}
+
+		state, err := d.Inspect(ctx, c.ID)
+		if err != nil {
+			return nil, fmt.Errorf("inspecting container %s: %w", c.ID, err)
+		}
+		res = append(res, JobContainer{ID: c.ID, JobID: jobID, State: state, GPUs: splitGPUs(c.Labels[containerGPUsLabel]), Created: time.Unix(c.Created, 0)})
+	}
+	return res, nil
+}
+
+func (d *dockerRuntime) Stats(ctx context.Context, id string) (jobs.StatsSample, error) {
+	// without streaming the daemon waits for a second sample, so the CPU usage can be computed
+	res, err := d.cli.ContainerStats(ctx, id, false)
+	if err != nil {
+		return jobs.StatsSample{}, err
+	}
+	defer res.Body.Close()
+
+	var stats types.StatsJSON
+	if err := json.NewDecoder(res.Body).Decode(&stats); err != nil {
+		return jobs.StatsSample{}, fmt.Errorf("decoding stats: %w", err)
+	}
+
+	sample := jobs.StatsSample{
+		Time:        stats.Read,
+		Memory:      int64(stats.MemoryStats.Usage),
+		MemoryLimit: int64(stats.MemoryStats.Limit),
+	}
+
+	cpuDelta := float64(stats.CPUStats.CPUUsage.TotalUsage) - float64(stats.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(stats.CPUStats.SystemUsage) - float64(stats.PreCPUStats.SystemUsage)
+	cpus := float64(stats.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(stats.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && systemDelta > 0 {
+		sample.CPU = cpuDelta / systemDelta * cpus * 100
+	}
+
+	// the page cache is not counted, like docker stats does (cgroups v1 and v2)
+	cache, ok := stats.MemoryStats.Stats["total_inactive_file"]
+	if !ok {
+		cache = stats.MemoryStats.Stats["inactive_file"]
+	}
+	if cache < stats.MemoryStats.Usage {
+		sample.Memory -= int64(cache)
+	}
+
+	for _, n := range stats.Networks {
+		sample.NetRx += int64(n.RxBytes)
+		sample.NetTx += int64(n.TxBytes)
+	}
+	for _, e := range stats.BlkioStats.IoServiceBytesRecursive {
+		switch strings.ToLower(e.Op) {
+		case "read":
+			sample.BlockRead += int64(e.Value)
+		case "write":
+			sample.BlockWrite += int64(e.Value)
+		}
+	}
+
+	if sample.Time.IsZero() {
+		sample.Time = time.Now()
+	}
+	return sample, nil
+}
+
+func (d *dockerRuntime) CopyFrom(ctx context.Context, id string, path string) (io.ReadCloser, error) {
+	rc, _, err := d.cli.CopyFromContainer(ctx, id, path)
+	return rc, err
+}
+
+// HasImage returns true if the image is present, it can be a name or a digest
+func (d *dockerRuntime) HasImage(ctx context.Context, image string) (bool, error) {
+	_, _, err := d.cli.ImageInspectWithRaw(ctx, image)
+	if client.IsErrNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("inspecting image: %w", err)
+	}
+	return true, nil
+}
+
+func (d *dockerRuntime) Images(ctx context.Context) ([]localImage, error) {
+	containers, err := d.cli.ContainerList(ctx, types.ContainerListOptions{All: true})
+	if err != nil {
+		return nil, fmt.Errorf("listing containers: %w", err)
+	}
+	inUse := make(map[string]bool, len(containers))
+	for _, c := range containers {
+		inUse[c.ImageID] = true
+	}
+
+	summaries, err := d.cli.ImageList(ctx, types.ImageListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("listing images: %w", err)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	images := make([]localImage, 0, len(summaries))
+	for _, s := range summaries {
+		lastUsed, ok := d.lastUsed[s.ID]
+		if !ok {
+			lastUsed = time.Unix(s.Created, 0)
+		}
+		images = append(images, localImage{
+			ID:       s.ID,
+			Tags:     s.RepoTags,
+			Digests:  s.RepoDigests,
+			Size:     s.Size,
+			LastUsed: lastUsed,
+			InUse:    inUse[s.ID],
+		})
+	}
+	return images, nil
+}
+
+func (d *dockerRuntime) RemoveImage(ctx context.Context, id string) error {
+	// forced because the images with several tags can't be removed by ID otherwise, the ones used
+	// by containers are never removed
+	if _, err := d.cli.ImageRemove(ctx, id, types.ImageRemoveOptions{Force: true, PruneChildren: true}); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	delete(d.lastUsed, id)
+	d.mu.Unlock()
+	return nil
+}
+
+// DiskFree returns the free space of the disk of the Docker data directory, which the worker must
+// be able to see
+func (d *dockerRuntime) DiskFree(ctx context.Context) (int64, error) {
+	info, err := d.cli.Info(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("getting docker info: %w", err)
+	}
+	return diskFree(info.DockerRootDir)
+}
+
+func authCredentials(auth workers.RegistryAuth, registry string) (string, error) {
+	authConfig := types.AuthConfig{
+		Username:      auth.Username,
+		Password:      auth.Password,
+		IdentityToken: auth.IdentityToken,
+		ServerAddress: registry,
+	}
+
+	encodedJSON, err := json.Marshal(authConfig)
+	if err != nil {
+		return "", fmt.Errorf("marshaling authconfig to json: %w", err)
+	}
+
+	return base64.URLEncoding.EncodeToString(encodedJSON), nil
+}
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+)
+
+// fakeAnyImage is the script used for the images without their own script
+const fakeAnyImage = "*"
+
+// fakeScript describes how a fake container behaves
+type fakeScript struct {
+	PullError   string
+	CreateError string
+	StartError  string
+	// Output are the log lines, written evenly spaced during Duration
+	Output   []string
+	Duration time.Duration
+	ExitCode int64
+	// IgnoreStop makes the container ignore the stop signal, so it is killed after the grace period
+	IgnoreStop bool
+	// CPU (in percent) and Memory (in bytes) are the usage reported while running
+	CPU    float64
+	Memory int64
+	// Files are the contents of the files in the container by their path, to copy the outputs
+	Files map[string]string
+	// Present makes the image available without pulling it, for the pull policies
+	Present bool
+}
+
+// fakeRuntime runs scripted containers in-process, without a Docker daemon. Each image follows
+// its own script, or the fakeAnyImage one.
+type fakeRuntime struct {
+	mu         sync.Mutex
+	scripts    map[string]fakeScript
+	containers map[string]*fakeContainer
+	next       int
+	// images have been pulled
+	images map[string]bool
+	// specs are the specs of every container created, in order
+	specs []RunSpec
+}
+
+type fakeContainer struct {
+	spec    RunSpec
+	script  fakeScript
+	created time.Time
+	// started is closed when the container starts, done when it exits
+	started chan struct{}
+	done    chan struct{}
+	stop    chan time.Duration
+	// exitCode is set before closing done
+	exitCode int64
+
+	mu sync.Mutex
+	// output are the lines written so far, changed is closed and replaced when a line is added
+	output  []fakeLine
+	changed chan struct{}
+}
+
+type fakeLine struct {
+	t    time.Time
+	text string
+}
+
+func newFakeRuntime(scripts map[string]fakeScript) *fakeRuntime {
+	return &fakeRuntime{
+		scripts:    scripts,
+		containers: make(map[string]*fakeContainer),
+		images:     make(map[string]bool),
+	}
+}
+
+func (f *fakeRuntime) script(image string) fakeScript {
+	if s, ok := f.scripts[image]; ok {
+		return s
+	}
+	return f.scripts[fakeAnyImage]
+}
+
+func (f *fakeRuntime) container(id string) (*fakeContainer, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	c, ok := f.containers[id]
+	if !ok {
+		return nil, fmt.Errorf("no such container: %s", id)
+	}
+	return c, nil
+}
+
+func (f *fakeRuntime) Pull(ctx context.Context, image string, policy jobs.PullPolicy, out io.Writer) (*jobs.PullInfo, error) {
+	s := f.script(image)
+	f.mu.Lock()
+	present := s.Present || f.images[image]
+	f.mu.Unlock()
+
+	if present && policy != jobs.PullAlways {
+		_, err := fmt.Fprintf(out, "fake: image %s is present, not pulling it\n", image)
+		return &jobs.PullInfo{}, err
+	}
+	if policy == jobs.PullNever {
+		return nil, fmt.Errorf("image %s is not present and the pull policy is %s", image, policy)
+	}
+
+	if s.PullError != "" {
+		return nil, errors.New(s.PullError)
+	}
+	f.mu.Lock()
+	f.images[image] = true
+	f.mu.Unlock()
+	_, err := fmt.Fprintf(out, "fake: pulled %s\n", image)
+	return &jobs.PullInfo{Pulled: true, Layers: 1}, err
+}
+
+func (f *fakeRuntime) Create(ctx context.Context, spec RunSpec) (string, []string, error) {
+	s := f.script(spec.Image)
+	if s.CreateError != "" {
+		return "", nil, errors.New(s.CreateError)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.next++
+	id := fmt.Sprintf("fake-%d", f.next)
+	f.specs = append(f.specs, spec)
+	f.containers[id] = &fakeContainer{
+		spec:    spec,
+		script:  s,
+		created: time.Now(),
+		started: make(chan struct{}),
+		done:    make(chan struct{}),
+		stop:    make(chan time.Duration, 1),
+		changed: make(chan struct{}),
+	}
+	return id, nil, nil
+}
+
+func (f *fakeRuntime) Start(ctx context.Context, id string) error {
+	c, err := f.container(id)
+	if err != nil {
+		return err
+	}
+	if c.script.StartError != "" {
+		return errors.New(c.script.StartError)
+	}
+
+	close(c.started)
+	go c.run()
+	return nil
+}
+
+// run simulates the container until it finishes or is stopped
+func (c *fakeContainer) run() {
+	defer close(c.done)
+
+	finish := time.NewTimer(c.script.Duration)
+	defer finish.Stop()
+
+	// the output lines are written evenly spaced while running
+	var interval time.Duration
+	if len(c.script.Output) > 0 {
+		interval = c.script.Duration / time.Duration(len(c.script.Output))
+	}
+	next := time.NewTimer(0)
+	defer next.Stop()
+	lines := c.script.Output
+
+	for len(lines) > 0 {
+		select {
+		case <-next.C:
+			c.write(lines[0])
+			lines = lines[1:]
+			next.Reset(interval)
+		case <-finish.C:
+			c.exitCode = c.script.ExitCode
+			return
+		case grace := <-c.stop:
+			c.stopped(grace, finish)
+			return
+		}
+	}
+
+	select {
+	case <-finish.C:
+		c.exitCode = c.script.ExitCode
+	case grace := <-c.stop:
+		c.stopped(grace, finish)
+	}
+}
+
+// write adds a line to the output of the container
+func (c *fakeContainer) write(text string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.output = append(c.output, fakeLine{t: time.Now().UTC(), text: text})
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// stopped simulates the container receiving the stop signal
+func (c *fakeContainer) stopped(grace time.Duration, finish *time.Timer) {
+	if !c.script.IgnoreStop {
+		c.exitCode = 143
+		return
+	}
+
+	select {
+	case <-finish.C:
+		c.exitCode = c.script.ExitCode
+	case <-time.After(grace):
+		c.exitCode = 137
+	}
+}
+
+func (f *fakeRuntime) Logs(ctx context.Context, id string, since time.Time, stdout, stderr io.Writer) error {
+	c, err := f.container(id)
+	if err != nil {
+		return err
+	}
+	<-c.started
+
+	written := 0
+	for {
+		c.mu.Lock()
+		lines, changed := c.output[written:], c.changed
+		c.mu.Unlock()
+
+		for _, line := range lines {
+			written++
+			if !line.t.After(since) {
+				continue
+			}
+			if _, err := fmt.Fprintln(stdout, line.t.Format(time.RFC3339Nano), line.text); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.done:
+			// the last lines may have been written right before exiting
+			c.mu.Lock()
+			pending := len(c.output) > written
+			c.mu.Unlock()
+			if !pending {
+				return nil
+			}
+		case <-changed:
+		}
+	}
+}
+
+func (f *fakeRuntime) Wait(ctx context.Context, id string) <-chan ExitStatus {
+	res := make(chan ExitStatus, 1)
+
+	c, err := f.container(id)
+	if err != nil {
+		res <- ExitStatus{Code: -1, Err: err}
+		return res
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			res <- ExitStatus{Code: -1, Err: ctx.Err()}
+		case <-c.done:
+			res <- ExitStatus{Code: c.exitCode}
+		}
+	}()
+	return res
+}
+
+func (f *fakeRuntime) Stop(ctx context.Context, id string, grace time.Duration) error {
+	c, err := f.container(id)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case c.stop <- grace:
+	default:
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.done:
+		return nil
+	}
+}
+
+func (f *fakeRuntime) Inspect(ctx context.Context, id string) (ContainerState, error) {
+	c, err := f.container(id)
+	if err != nil {
+		return ContainerState{}, err
+	}
+
+	select {
+	case <-c.done:
+		return ContainerState{Status: "exited", ExitCode: int(c.exitCode)}, nil
+	default:
+	}
+
+	select {
+	case <-c.started:
+		return ContainerState{Running: true, Status: "running"}, nil
+	default:
+		return ContainerState{Status: "created"}, nil
+	}
+}
+
+func (f *fakeRuntime) Remove(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.containers, id)
+	return nil
+}
+
+func (f *fakeRuntime) List(ctx context.Context, worker string) ([]JobContainer, error) {
+	f.mu.Lock()
+	ids := make(map[string]*fakeContainer)
+	for id, c := range f.containers {
+		if c.spec.Worker == worker {
+			ids[id] = c
+		}
+	}
+	f.mu.Unlock()
+
+	var res []JobContainer
+	for id, c := range ids {
+		state, err := f.Inspect(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, JobContainer{ID: id, JobID: c.spec.JobID, State: state, GPUs: c.spec.GPUs, Created: c.created})
+	}
+	return res, nil
+}
+
+func (f *fakeRuntime) Stats(ctx context.Context, id string) (jobs.StatsSample, error) {
+	state, err := f.Inspect(ctx, id)
+	if err != nil {
+		return jobs.StatsSample{}, err
+	}
+	if !state.Running {
+		return jobs.StatsSample{}, fmt.Errorf("container %s is not running", id)
+	}
+
+	c, err := f.container(id)
+	if err != nil {
+		return jobs.StatsSample{}, err
+	}
+	return jobs.StatsSample{Time: time.Now().UTC(), CPU: c.script.CPU, Memory: c.script.Memory}, nil
+}
+
+// CopyFrom archives the files of the script that are p or inside it
+func (f *fakeRuntime) CopyFrom(ctx context.Context, id string, p string) (io.ReadCloser, error) {
+	c, err := f.container(id)
+	if err != nil {
+		return nil, err
+	}
+
+	p = path.Clean(p)
+	var names []string
+	for name := range c.script.Files {
+		if name == p || strings.HasPrefix(name, strings.TrimSuffix(p, "/")+"/") {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no such file in container %s: %s", id, p)
+	}
+	sort.Strings(names)
+
+	buff := &bytes.Buffer{}
+	tw := tar.NewWriter(buff)
+	for _, name := range names {
+		content := c.script.Files[name]
+		hdr := &tar.Header{
+			Typeflag: tar.TypeReg,
+			Name:     path.Base(p) + strings.TrimPrefix(name, p),
+			Mode:     0644,
+			Size:     int64(len(content)),
+			ModTime:  time.Now(),
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(buff), nil
+}
+
+// fakeGPUs is a GPU discovery that makes up n GPUs named fake-0, fake-1...
+type fakeGPUs int
+
+func (f fakeGPUs) Devices(ctx context.Context) ([]string, error) {
+	devices := make([]string, int(f))
+	for i := range devices {
+		devices[i] = fmt.Sprintf("fake-%d", i)
+	}
+	return devices, nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"github.com/gofrs/uuid"
+)
+
+// defaultGPUCommand lists the indexes of the NVIDIA GPUs of the machine
+var defaultGPUCommand = []string{"nvidia-smi", "--query-gpu=index", "--format=csv,noheader"}
+
+// gpuConfig configures the GPUs of the worker, which are shared by all the slots. Each job gets as
+// many as it asks for.
+type gpuConfig struct {
+	// Discovery finds the device IDs: "static" uses Devices and "command" runs Command, which
+	// prints one ID per line
+	Discovery string   `yaml:"discovery"`
+	Devices   []string `yaml:"devices"`
+	// Command is nvidia-smi listing the GPU indexes by default
+	Command []string `yaml:"command"`
+}
+
+// legacy returns true if the GPUs are not configured, so the ones of each queue are used
+func (c gpuConfig) legacy() bool {
+	return c.Discovery == "" && len(c.Devices) == 0 && len(c.Command) == 0
+}
+
+// gpuDiscovery finds the GPUs of the machine
+type gpuDiscovery interface {
+	Devices(ctx context.Context) ([]string, error)
+}
+
+// staticGPUs are the GPUs listed in the configuration
+type staticGPUs []string
+
+func (s staticGPUs) Devices(ctx context.Context) ([]string, error) {
+	return s, nil
+}
+
+// commandGPUs are the GPUs printed by a command, one ID per line
+type commandGPUs []string
+
+func (c commandGPUs) Devices(ctx context.Context) ([]string, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c[0], c[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("running %v: %w: %s", []string(c), err, strings.TrimSpace(stderr.String()))
+	}
+
+	var devices []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			devices = append(devices, line)
+		}
+	}
+	return devices, nil
+}
+
+// newGPUDiscovery returns the discovery of the configuration. Without one, the worker has the
+// Devices or the ones printed by Command, if they are set, or else the GPUs that the old
+// configurations gave to each queue, "all" meaning the ones printed by nvidia-smi.
+func newGPUDiscovery(cfg gpuConfig, queues []QueueConfig) (gpuDiscovery, error) {
+	command := commandGPUs(defaultGPUCommand)
+	if len(cfg.Command) != 0 {
+		command = cfg.Command
+	}
+
+	switch cfg.Discovery {
+	case "static":
+		return staticGPUs(uniqueStrings(cfg.Devices)), nil
+	case "command":
+		return command, nil
+	case "":
+	default:
+		return nil, fmt.Errorf("unknown gpu discovery %q, it must be static or command", cfg.Discovery)
+	}
+
+	if len(cfg.Devices) != 0 {
+		return staticGPUs(uniqueStrings(cfg.Devices)), nil
+	}
+	if len(cfg.Command) != 0 {
+		return command, nil
+	}
+
+	var legacy []string
+	for _, q := range queues {
+		legacy = append(legacy, q.GPUs...)
+	}
+	if len(legacy) == 0 {
+		return staticGPUs(nil), nil
+	}
+	log.Printf("the gpus of each queue are deprecated, use gpus.devices instead: the jobs that do not set gpus get the ones of the queue of their slot\n")
+	for _, id := range legacy {
+		if id == "all" {
+			return command, nil
+		}
+	}
+	return staticGPUs(uniqueStrings(legacy)), nil
+}
+
+// legacySlotGPUs returns the GPUs that the old configurations gave to each queue, and so to its
+// slot, "all" meaning every device of the worker. The jobs that do not set gpus get the ones of
+// their slot, as before the GPUs were allocated per job.
+func legacySlotGPUs(queues []QueueConfig, devices []string) [][]string {
+	slots := make([][]string, len(queues))
+	for i, q := range queues {
+		for _, id := range q.GPUs {
+			if id == "all" {
+				slots[i] = devices
+				break
+			}
+			slots[i] = append(slots[i], id)
+		}
+	}
+	return slots
+}
+
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	var res []string
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			res = append(res, v)
+		}
+	}
+	return res
+}
+
+// gpuPool hands out the GPUs of the worker to the jobs, so that each one only gets the ones it asked
+// for and no GPU is given to two jobs
+type gpuPool struct {
+	mu      sync.Mutex
+	devices []string
+	// used are the jobs using each device
+	used map[string]uuid.UUID
+}
+
+func newGPUPool(devices []string) *gpuPool {
+	return &gpuPool{devices: devices, used: make(map[string]uuid.UUID)}
+}
+
+// size returns how many GPUs the worker has
+func (p *gpuPool) size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.devices)
+}
+
+// free returns how many GPUs are not used by any job
+func (p *gpuPool) free() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.devices) - len(p.used)
+}
+
+// allocate gives n free GPUs to a job, the first ones in the order they were discovered. It
+// returns false if there are not enough.
+func (p *gpuPool) allocate(job uuid.UUID, n int) ([]string, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if n <= 0 {
+		return nil, true
+	}
+	if len(p.devices)-len(p.used) < n {
+		return nil, false
+	}
+
+	allocated := make([]string, 0, n)
+	for _, id := range p.devices {
+		if len(allocated) == n {
+			break
+		}
+		if _, ok := p.used[id]; !ok {
+			p.used[id] = job
+			allocated = append(allocated, id)
+		}
+	}
+	return allocated, true
+}
+
+// reserve marks the GPUs of a job that was already running as used. The ones that are not in the
+// pool anymore are ignored.
+func (p *gpuPool) reserve(job uuid.UUID, devices []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	known := make(map[string]bool, len(p.devices))
+	for _, id := range p.devices {
+		known[id] = true
+	}
+
+	for _, id := range devices {
+		if !known[id] {
+			log.Printf("job %s uses GPU %s, which this worker does not have anymore\n", job, id)
+			continue
+		}
+		if other, ok := p.used[id]; ok && other != job {
+			log.Printf("job %s uses GPU %s, which is also given to job %s\n", job, id, other)
+		}
+		p.used[id] = job
+	}
+}
+
+// release returns the GPUs of a job to the pool
+func (p *gpuPool) release(job uuid.UUID) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, j := range p.used {
+		if j == job {
+			delete(p.used, id)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/gofrs/uuid"
+)
+
+func TestGPUPool(t *testing.T) {
+	devices, _ := fakeGPUs(4).Devices(context.Background())
+	pool := newGPUPool(devices)
+	a, b := uuid.Must(uuid.NewV4()), uuid.Must(uuid.NewV4())
+
+	gpus, ok := pool.allocate(a, 3)
+	if !ok || !reflect.DeepEqual(gpus, []string{"fake-0", "fake-1", "fake-2"}) {
+		t.Fatalf("allocated %v, %v", gpus, ok)
+	}
+	if _, ok := pool.allocate(b, 2); ok {
+		t.Fatalf("allocated 2 GPUs with only 1 free")
+	}
+	if gpus, ok := pool.allocate(b, 0); !ok || len(gpus) != 0 {
+		t.Fatalf("a job without GPUs got %v", gpus)
+	}
+
+	pool.release(a)
+	if free := pool.free(); free != 4 {
+		t.Errorf("%d GPUs are free after releasing them, want 4", free)
+	}
+}
+
+func TestLegacySlotGPUs(t *testing.T) {
+	queues := []QueueConfig{{GPUs: []string{"0"}}, {GPUs: []string{"1", "2"}}, {}, {GPUs: []string{"all"}}}
+
+	cfg := gpuConfig{}
+	if !cfg.legacy() {
+		t.Fatal("a configuration without gpus is not legacy")
+	}
+	discovery, err := newGPUDiscovery(cfg, queues[:3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, _ := discovery.Devices(context.Background())
+	if !reflect.DeepEqual(devices, []string{"0", "1", "2"}) {
+		t.Errorf("the pool has %v, want the GPUs of every queue", devices)
+	}
+
+	slots := legacySlotGPUs(queues, devices)
+	want := [][]string{{"0"}, {"1", "2"}, nil, {"0", "1", "2"}}
+	if !reflect.DeepEqual(slots, want) {
+		t.Errorf("slot GPUs %v, want %v", slots, want)
+	}
+
+	if (gpuConfig{Devices: []string{"0"}}).legacy() {
+		t.Error("a configuration with gpus is legacy")
+	}
+}
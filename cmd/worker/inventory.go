@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gofrs/uuid"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/workers"
+)
+
+// version is the version of the worker reported when registering
+const version = "1.0.0"
+
+// registration keeps the ID the server gave to this worker and whether it is cordoned
+type registration struct {
+	mu  sync.Mutex
+	id  uuid.UUID
+	reg workers.Registration
+
+	isCordoned bool
+	drain      workers.DrainMode
+}
+
+func newRegistration(cfg *conf, gpus []string) *registration {
+	hostname, _ := os.Hostname()
+
+	name := cfg.Name
+	if name == "" {
+		name = hostname
+	}
+
+	return &registration{reg: workers.Registration{
+		Name:     name,
+		Hostname: hostname,
+		Version:  version,
+		Labels:   cfg.Labels,
+		GPUs:     gpus,
+		CPUs:     runtime.NumCPU(),
+		Memory:   totalMemory(),
+		Slots:    len(cfg.Queues),
+	}}
+}
+
+// register registers the worker in the server, replacing the ID it had
+func (r *registration) register(ctx context.Context, host, token string) error {
+	w, err := registerWorker(ctx, host, token, r.reg)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.id = w.ID
+	r.isCordoned, r.drain = w.Cordoned, w.Drain
+	log.Printf("registered as worker %s (%s)\n", w.Name, w.ID)
+	return nil
+}
+
+// workerID returns the ID of the worker, uuid.Nil if it is not registered
+func (r *registration) workerID() uuid.UUID {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.id
+}
+
+// cordoned returns true if the worker must not fetch new jobs
+func (r *registration) cordoned() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.isCordoned
+}
+
+// setCordon updates the cordon state sent by the server, returning true if it changed
+func (r *registration) setCordon(cordoned bool, drain workers.DrainMode) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	changed := r.isCordoned != cordoned || r.drain != drain
+	r.isCordoned, r.drain = cordoned, drain
+	return changed
+}
+
+// totalMemory returns the total memory of the machine in bytes, 0 if unknown
+func totalMemory() int64 {
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var kb int64
+		if _, err := fmt.Sscanf(scanner.Text(), "MemTotal: %d kB", &kb); err == nil {
+			return kb * 1024
+		}
+	}
+	return 0
+}
+
+// loadAverage returns the load average of the last minute, 0 if unknown
+func loadAverage() float64 {
+	b, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0
+	}
+
+	fields := strings.Fields(string(b))
+	if len(fields) == 0 {
+		return 0
+	}
+	load, _ := strconv.ParseFloat(fields[0], 64)
+	return load
+}
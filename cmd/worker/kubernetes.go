@@ -0,0 +1,521 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/rand"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+)
+
+const (
+	// k8sContainer is the name of the container running the job inside the pod
+	k8sContainer = "job"
+	// k8sJobLabel is the label with the skeduler job ID set on the pods and jobs
+	k8sJobLabel = "skeduler/job-id"
+	// k8sWorkerLabel is the label with the name of the worker that created the pod or job
+	k8sWorkerLabel = "skeduler/worker"
+	// k8sGPUsAnnotation has the GPUs of the worker pool given to the pod, separated by commas
+	k8sGPUsAnnotation = "skeduler/gpus"
+	// k8sGPUResource is the extended resource requested for the GPUs
+	k8sGPUResource = "nvidia.com/gpu"
+)
+
+// kubernetesConfig is the configuration of the Kubernetes runtime
+type kubernetesConfig struct {
+	// Kubeconfig is the path to the kubeconfig file, the in-cluster configuration is used if empty
+	Kubeconfig string `yaml:"kubeconfig"`
+	Namespace  string `yaml:"namespace"`
+	// Kind is the object created for each job: "pod" (default) or "job"
+	Kind string `yaml:"kind"`
+	// TTLAfterFinished is how long the finished Kubernetes jobs are kept if the worker does not remove
+	// them, zero keeps them
+	TTLAfterFinished time.Duration `yaml:"ttl_after_finished"`
+	// PollInterval is how often the state of the pods is checked
+	PollInterval time.Duration `yaml:"poll_interval"`
+}
+
+// kubernetesRuntime submits each job to a Kubernetes cluster as a Pod or a Job. The IDs it
+// returns are "pod/{name}" or "job/{name}".
+type kubernetesRuntime struct {
+	client kubernetes.Interface
+	cfg    kubernetesConfig
+}
+
+// errPodFailed is returned when the pod cannot run the job at all, for example when the image
+// cannot be pulled or the pod is evicted
+var errPodFailed = errors.New("pod failed")
+
+func newKubernetesRuntime(cfg kubernetesConfig) (*kubernetesRuntime, error) {
+	restCfg, err := clientcmd.BuildConfigFromFlags("", cfg.Kubeconfig)
+	if err != nil {
+		return nil, fmt.Errorf("loading kubernetes configuration: %w", err)
+	}
+
+	client, err := kubernetes.NewForConfig(restCfg)
+	if err != nil {
+		return nil, fmt.Errorf("creating kubernetes client: %w", err)
+	}
+
+	return newKubernetesRuntimeWithClient(client, cfg), nil
+}
+
+// newKubernetesRuntimeWithClient creates the runtime with the given client, which can be a fake
+// clientset
+func newKubernetesRuntimeWithClient(client kubernetes.Interface, cfg kubernetesConfig) *kubernetesRuntime {
+	if cfg.Namespace == "" {
+		cfg.Namespace = "default"
+	}
+	if cfg.Kind == "" {
+		cfg.Kind = "pod"
+	}
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = 2 * time.Second
+	}
+	return &kubernetesRuntime{client: client, cfg: cfg}
+}
+
+// Pull does nothing, the cluster pulls the image following the pull policy of the container
+func (k *kubernetesRuntime) Pull(ctx context.Context, image string, policy jobs.PullPolicy, out io.Writer) (*jobs.PullInfo, error) {
+	_, err := fmt.Fprintf(out, "kubernetes runtime: image %s will be pulled by the cluster (pull policy %s)\n", image, policy)
+	return nil, err
+}
+
+// podSpec returns the pod for spec and the warnings about the options the cluster cannot apply
+func (k *kubernetesRuntime) podSpec(spec RunSpec) (corev1.PodSpec, []string) {
+	var env []corev1.EnvVar
+	for _, kv := range spec.Env {
+		name, value, _ := strings.Cut(kv, "=")
+		env = append(env, corev1.EnvVar{Name: name, Value: value})
+	}
+
+	c := corev1.Container{
+		Name:            k8sContainer,
+		Image:           spec.Image,
+		ImagePullPolicy: corev1.PullPolicy(spec.PullPolicy),
+		// as with Docker, the command replaces the CMD of the image and the entrypoint its ENTRYPOINT
+		Command:    spec.Entrypoint,
+		Args:       spec.Cmd,
+		Env:        env,
+		WorkingDir: spec.Workdir,
+	}
+
+	var warnings []string
+	if spec.User != "" {
+		uid, gid, err := numericUser(spec.User)
+		if err != nil {
+			warnings = append(warnings, fmt.Sprintf("ignoring user %q: %v", spec.User, err))
+		} else {
+			c.SecurityContext = &corev1.SecurityContext{RunAsUser: uid, RunAsGroup: gid}
+		}
+	}
+
+	limits := corev1.ResourceList{}
+	// the device IDs have no meaning in the cluster, only how many GPUs are needed ("all" is one)
+	if len(spec.GPUs) != 0 {
+		limits[k8sGPUResource] = *resource.NewQuantity(int64(len(spec.GPUs)), resource.DecimalSI)
+	}
+	res := spec.Resources
+	if res.CPUs > 0 {
+		limits[corev1.ResourceCPU] = *resource.NewMilliQuantity(int64(res.CPUs*1000), resource.DecimalSI)
+	}
+	if res.Memory > 0 {
+		limits[corev1.ResourceMemory] = *resource.NewQuantity(int64(res.Memory), resource.BinarySI)
+	}
+	if len(limits) != 0 {
+		c.Resources.Limits = limits
+	}
+	if res.MemorySwap != 0 || res.PidsLimit != 0 || len(res.Ulimits) != 0 {
+		warnings = append(warnings, "memory_swap, pids_limit and ulimits are not supported by the kubernetes runtime")
+	}
+
+	pod := corev1.PodSpec{
+		Hostname:      strings.ReplaceAll(spec.Hostname, "_", "-"),
+		RestartPolicy: corev1.RestartPolicyNever,
+	}
+
+	// the shared memory is a memory backed volume, the default /dev/shm of a pod is 64m
+	if res.ShmSize > 0 {
+		size := resource.NewQuantity(int64(res.ShmSize), resource.BinarySI)
+		pod.Volumes = append(pod.Volumes, corev1.Volume{
+			Name: "shm",
+			VolumeSource: corev1.VolumeSource{
+				EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory, SizeLimit: size},
+			},
+		})
+		c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{Name: "shm", MountPath: "/dev/shm"})
+	}
+
+	for i, m := range spec.Mounts {
+		name := fmt.Sprintf("mount-%d", i)
+		var source corev1.VolumeSource
+		switch m.Kind() {
+		case jobs.MountBind:
+			source.HostPath = &corev1.HostPathVolumeSource{Path: m.Source}
+		case jobs.MountScratch:
+			source.EmptyDir = &corev1.EmptyDirVolumeSource{}
+		default:
+			// the named volumes are persistent volume claims of the namespace
+			source.PersistentVolumeClaim = &corev1.PersistentVolumeClaimVolumeSource{ClaimName: m.Source, ReadOnly: m.ReadOnly}
+		}
+		pod.Volumes = append(pod.Volumes, corev1.Volume{Name: name, VolumeSource: source})
+		c.VolumeMounts = append(c.VolumeMounts, corev1.VolumeMount{Name: name, MountPath: m.Target, ReadOnly: m.ReadOnly})
+	}
+
+	pod.Containers = []corev1.Container{c}
+	return pod, warnings
+}
+
+// numericUser parses a "uid" or "uid:gid" user, the names of the users of the image cannot be used
+// in the security context
+func numericUser(user string) (*int64, *int64, error) {
+	u, g, hasGroup := strings.Cut(user, ":")
+	uid, err := strconv.ParseInt(u, 10, 64)
+	if err != nil {
+		return nil, nil, errors.New("the kubernetes runtime only supports numeric users")
+	}
+	if !hasGroup {
+		return &uid, nil, nil
+	}
+
+	gid, err := strconv.ParseInt(g, 10, 64)
+	if err != nil {
+		return nil, nil, errors.New("the kubernetes runtime only supports numeric groups")
+	}
+	return &uid, &gid, nil
+}
+
+func (k *kubernetesRuntime) Create(ctx context.Context, spec RunSpec) (string, []string, error) {
+	meta := metav1.ObjectMeta{
+		// the same job can run again after being preempted, so each run gets its own name. It is not
+		// left to GenerateName so that it also works with the fake clientset.
+		Name:      fmt.Sprintf("skeduler-%.8s-%s", spec.JobID.String(), rand.String(5)),
+		Namespace: k.cfg.Namespace,
+		Labels:    map[string]string{k8sJobLabel: spec.JobID.String(), k8sWorkerLabel: spec.Worker},
+	}
+	if len(spec.GPUs) != 0 {
+		meta.Annotations = map[string]string{k8sGPUsAnnotation: strings.Join(spec.GPUs, ",")}
+	}
+
+	podSpec, warnings := k.podSpec(spec)
+
+	switch k.cfg.Kind {
+	case "pod":
+		pod, err := k.client.CoreV1().Pods(k.cfg.Namespace).Create(ctx, &corev1.Pod{
+			ObjectMeta: meta,
+			Spec:       podSpec,
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return "", nil, err
+		}
+		return "pod/" + pod.Name, warnings, nil
+
+	case "job":
+		backoff := int32(0)
+		job := &batchv1.Job{
+			ObjectMeta: meta,
+			Spec: batchv1.JobSpec{
+				// retries are handled by skeduler
+				BackoffLimit: &backoff,
+				Template: corev1.PodTemplateSpec{
+					ObjectMeta: metav1.ObjectMeta{Labels: meta.Labels},
+					Spec:       podSpec,
+				},
+			},
+		}
+		if k.cfg.TTLAfterFinished > 0 {
+			ttl := int32(k.cfg.TTLAfterFinished.Seconds())
+			job.Spec.TTLSecondsAfterFinished = &ttl
+		}
+
+		job, err := k.client.BatchV1().Jobs(k.cfg.Namespace).Create(ctx, job, metav1.CreateOptions{})
+		if err != nil {
+			return "", nil, err
+		}
+		return "job/" + job.Name, warnings, nil
+	}
+
+	return "", nil, fmt.Errorf("unknown kubernetes object kind %q", k.cfg.Kind)
+}
+
+// Start does nothing, the cluster starts the pods as soon as they are created and scheduled
+func (k *kubernetesRuntime) Start(ctx context.Context, id string) error {
+	return nil
+}
+
+// pod returns the pod running the given object, nil if a job has no pod yet
+func (k *kubernetesRuntime) pod(ctx context.Context, id string) (*corev1.Pod, error) {
+	kind, name, _ := strings.Cut(id, "/")
+	if kind == "pod" {
+		return k.client.CoreV1().Pods(k.cfg.Namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+
+	pods, err := k.client.CoreV1().Pods(k.cfg.Namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: "job-name=" + name,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(pods.Items) == 0 {
+		return nil, nil
+	}
+	// the list is not sorted, and the job controller replaces the pods that are evicted or deleted:
+	// the newest one is the one running the job
+	newest := &pods.Items[0]
+	for i := range pods.Items {
+		if newest.CreationTimestamp.Before(&pods.Items[i].CreationTimestamp) {
+			newest = &pods.Items[i]
+		}
+	}
+	return newest, nil
+}
+
+// podState returns the state of the job container, an error wrapping errPodFailed if the pod will
+// never be able to run it
+func podState(pod *corev1.Pod) (ContainerState, error) {
+	state := ContainerState{Status: strings.ToLower(string(pod.Status.Phase))}
+
+	for _, cs := range pod.Status.ContainerStatuses {
+		if cs.Name != k8sContainer {
+			continue
+		}
+		if w := cs.State.Waiting; w != nil {
+			switch w.Reason {
+			case "ImagePullBackOff", "InvalidImageName", "CreateContainerConfigError", "CreateContainerError":
+				return state, fmt.Errorf("%w: %s: %s", errPodFailed, w.Reason, w.Message)
+			}
+		}
+		if t := cs.State.Terminated; t != nil {
+			state.ExitCode = int(t.ExitCode)
+			state.Status = "exited"
+			return state, nil
+		}
+	}
+
+	switch pod.Status.Phase {
+	case corev1.PodRunning:
+		state.Running = true
+	case corev1.PodFailed:
+		// failed without the container terminating: evicted, deadline exceeded...
+		return state, fmt.Errorf("%w: %s: %s", errPodFailed, pod.Status.Reason, pod.Status.Message)
+	}
+	return state, nil
+}
+
+// waitPod polls the pod until done returns true for its state
+func (k *kubernetesRuntime) waitPod(ctx context.Context, id string, done func(*corev1.Pod, ContainerState) bool) (*corev1.Pod, ContainerState, error) {
+	t := time.NewTicker(k.cfg.PollInterval)
+	defer t.Stop()
+
+	for {
+		pod, err := k.pod(ctx, id)
+		if err != nil {
+			return nil, ContainerState{}, err
+		}
+		if pod != nil {
+			state, err := podState(pod)
+			if err != nil || done(pod, state) {
+				return pod, state, err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ContainerState{}, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func podFinished(pod *corev1.Pod, _ ContainerState) bool {
+	return pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed
+}
+
+func (k *kubernetesRuntime) Logs(ctx context.Context, id string, since time.Time, stdout, stderr io.Writer) error {
+	pod, _, err := k.waitPod(ctx, id, func(pod *corev1.Pod, state ContainerState) bool {
+		return state.Running || podFinished(pod, state)
+	})
+	if err != nil {
+		return err
+	}
+
+	opts := &corev1.PodLogOptions{
+		Container:  k8sContainer,
+		Follow:     true,
+		Timestamps: true,
+	}
+	if !since.IsZero() {
+		// the cluster only has second precision, the lines already seen are skipped below
+		sinceTime := metav1.NewTime(since)
+		opts.SinceTime = &sinceTime
+	}
+
+	logs, err := k.client.CoreV1().Pods(k.cfg.Namespace).GetLogs(pod.Name, opts).Stream(ctx)
+	if err != nil {
+		return err
+	}
+	defer logs.Close()
+
+	// the cluster mixes stdout and stderr in the same stream
+	if since.IsZero() {
+		_, err = io.Copy(stdout, logs)
+		return err
+	}
+
+	scanner := bufio.NewScanner(logs)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if t, ok := lineTime(line); ok && !t.After(since) {
+			continue
+		}
+		if _, err := fmt.Fprintln(stdout, line); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func (k *kubernetesRuntime) Wait(ctx context.Context, id string) <-chan ExitStatus {
+	res := make(chan ExitStatus, 1)
+
+	go func() {
+		_, state, err := k.waitPod(ctx, id, podFinished)
+		if err != nil {
+			res <- ExitStatus{Code: -1, Err: err}
+			return
+		}
+		res <- ExitStatus{Code: int64(state.ExitCode)}
+	}()
+	return res
+}
+
+// Stop deletes the object with the grace period, the cluster sends SIGTERM and then SIGKILL
+func (k *kubernetesRuntime) Stop(ctx context.Context, id string, grace time.Duration) error {
+	kind, name, _ := strings.Cut(id, "/")
+	seconds := int64(grace.Seconds())
+	propagation := metav1.DeletePropagationForeground
+	opts := metav1.DeleteOptions{GracePeriodSeconds: &seconds, PropagationPolicy: &propagation}
+
+	var err error
+	if kind == "pod" {
+		err = k.client.CoreV1().Pods(k.cfg.Namespace).Delete(ctx, name, opts)
+	} else {
+		err = k.client.BatchV1().Jobs(k.cfg.Namespace).Delete(ctx, name, opts)
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+
+	// wait for the pod to be gone, as the other runtimes do
+	t := time.NewTicker(k.cfg.PollInterval)
+	defer t.Stop()
+	for {
+		pod, err := k.pod(ctx, id)
+		if apierrors.IsNotFound(err) || (err == nil && pod == nil) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// Remove deletes the pod, or the job and its pods in the background
+func (k *kubernetesRuntime) Remove(ctx context.Context, id string) error {
+	kind, name, _ := strings.Cut(id, "/")
+	propagation := metav1.DeletePropagationBackground
+	opts := metav1.DeleteOptions{PropagationPolicy: &propagation}
+
+	var err error
+	if kind == "pod" {
+		err = k.client.CoreV1().Pods(k.cfg.Namespace).Delete(ctx, name, opts)
+	} else {
+		err = k.client.BatchV1().Jobs(k.cfg.Namespace).Delete(ctx, name, opts)
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	return nil
+}
+
+// Stats is not supported, the usage of the pods is only available through the metrics server
+func (k *kubernetesRuntime) Stats(ctx context.Context, id string) (jobs.StatsSample, error) {
+	return jobs.StatsSample{}, errNoStats
+}
+
+// CopyFrom is not supported, the pods have to write their outputs to a volume
+func (k *kubernetesRuntime) CopyFrom(ctx context.Context, id string, path string) (io.ReadCloser, error) {
+	return nil, errNoCopy
+}
+
+func (k *kubernetesRuntime) List(ctx context.Context, worker string) ([]JobContainer, error) {
+	opts := metav1.ListOptions{LabelSelector: k8sWorkerLabel + "=" + worker}
+
+	var objects []metav1.ObjectMeta
+	switch k.cfg.Kind {
+	case "pod":
+		pods, err := k.client.CoreV1().Pods(k.cfg.Namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, pod := range pods.Items {
+			objects = append(objects, pod.ObjectMeta)
+		}
+	case "job":
+		js, err := k.client.BatchV1().Jobs(k.cfg.Namespace).List(ctx, opts)
+		if err != nil {
+			return nil, err
+		}
+		for _, job := range js.Items {
+			objects = append(objects, job.ObjectMeta)
+		}
+	}
+
+	var res []JobContainer
+	for _, obj := range objects {
+		jobID, err := uuid.FromString(obj.Labels[k8sJobLabel])
+		if err != nil {
+			continue
+		}
+
+		id := k.cfg.Kind + "/" + obj.Name
+		state, err := k.Inspect(ctx, id)
+		if err != nil && !errors.Is(err, errPodFailed) {
+			return nil, fmt.Errorf("inspecting %s: %w", id, err)
+		}
+		res = append(res, JobContainer{ID: id, JobID: jobID, State: state, GPUs: splitGPUs(obj.Annotations[k8sGPUsAnnotation]), Created: obj.CreationTimestamp.Time})
+	}
+	return res, nil
+}
+
+func (k *kubernetesRuntime) Inspect(ctx context.Context, id string) (ContainerState, error) {
+	pod, err := k.pod(ctx, id)
+	if err != nil {
+		return ContainerState{}, err
+	}
+	if pod == nil {
+		return ContainerState{Status: "pending"}, nil
+	}
+	return podState(pod)
+}
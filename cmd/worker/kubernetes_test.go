@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newTestKubernetes(kind string) (*kubernetesRuntime, *fake.Clientset) {
+	client := fake.NewSimpleClientset()
+	rt := newKubernetesRuntimeWithClient(client, kubernetesConfig{
+		Namespace:        "skeduler",
+		Kind:             kind,
+		TTLAfterFinished: time.Hour,
+		PollInterval:     10 * time.Millisecond,
+	})
+	return rt, client
+}
+
+func testRunSpec() RunSpec {
+	return RunSpec{
+		JobID:      uuid.Must(uuid.NewV4()),
+		Worker:     "w1",
+		Image:      "train:1",
+		PullPolicy: jobs.PullIfNotPresent,
+		Entrypoint: []string{"python"},
+		Cmd:        []string{"train.py", "--epochs", "10"},
+		Env:        []string{"A=1", "B=x=y"},
+		Hostname:   "exp_1234abcd",
+		Workdir:    "/workspace",
+		GPUs:       []string{"0", "1"},
+	}
+}
+
+// setPodStatus changes the status of the pod as the cluster would
+func setPodStatus(t *testing.T, rt *kubernetesRuntime, id string, status corev1.PodStatus) {
+	t.Helper()
+
+	ctx := context.Background()
+	pod, err := rt.pod(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pod.Status = status
+	if _, err := rt.client.CoreV1().Pods(rt.cfg.Namespace).UpdateStatus(ctx, pod, metav1.UpdateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func terminated(phase corev1.PodPhase, code int32) corev1.PodStatus {
+	return corev1.PodStatus{
+		Phase: phase,
+		ContainerStatuses: []corev1.ContainerStatus{{
+			Name:  k8sContainer,
+			State: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{ExitCode: code}},
+		}},
+	}
+}
+
+func TestKubernetesCreatePod(t *testing.T) {
+	rt, _ := newTestKubernetes("pod")
+	ctx := context.Background()
+	spec := testRunSpec()
+
+	id, _, err := rt.Create(ctx, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(id, "pod/skeduler-"+spec.JobID.String()[:8]) {
+		t.Errorf("unexpected id %q", id)
+	}
+
+	pod, err := rt.pod(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pod.Labels[k8sJobLabel] != spec.JobID.String() || pod.Labels[k8sWorkerLabel] != "w1" {
+		t.Errorf("unexpected labels %v", pod.Labels)
+	}
+	if pod.Annotations[k8sGPUsAnnotation] != "0,1" {
+		t.Errorf("unexpected GPUs annotation %q", pod.Annotations[k8sGPUsAnnotation])
+	}
+	if pod.Spec.Hostname != "exp-1234abcd" || pod.Spec.RestartPolicy != corev1.RestartPolicyNever {
+		t.Errorf("unexpected pod spec %+v", pod.Spec)
+	}
+
+	c := pod.Spec.Containers[0]
+	if c.Image != "train:1" || c.ImagePullPolicy != corev1.PullIfNotPresent || c.WorkingDir != "/workspace" {
+		t.Errorf("unexpected container %+v", c)
+	}
+	if !reflect.DeepEqual(c.Command, spec.Entrypoint) || !reflect.DeepEqual(c.Args, spec.Cmd) {
+		t.Errorf("command %v and args %v, want %v and %v", c.Command, c.Args, spec.Entrypoint, spec.Cmd)
+	}
+	wantEnv := []corev1.EnvVar{{Name: "A", Value: "1"}, {Name: "B", Value: "x=y"}}
+	if !reflect.DeepEqual(c.Env, wantEnv) {
+		t.Errorf("env %v, want %v", c.Env, wantEnv)
+	}
+	if gpus := c.Resources.Limits[k8sGPUResource]; gpus.Value() != 2 {
+		t.Errorf("%s limit is %s, want 2", k8sGPUResource, gpus.String())
+	}
+
+	containers, err := rt.List(ctx, "w1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(containers) != 1 || containers[0].ID != id || containers[0].JobID != spec.JobID || !reflect.DeepEqual(containers[0].GPUs, spec.GPUs) {
+		t.Errorf("listed %+v", containers)
+	}
+	if others, _ := rt.List(ctx, "w2"); len(others) != 0 {
+		t.Errorf("listed the pods of another worker: %+v", others)
+	}
+}
+
+func TestKubernetesCreateJob(t *testing.T) {
+	rt, client := newTestKubernetes("job")
+	ctx := context.Background()
+	spec := testRunSpec()
+	spec.GPUs = nil
+
+	id, _, err := rt.Create(ctx, spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kind, name, _ := strings.Cut(id, "/")
+	if kind != "job" {
+		t.Fatalf("unexpected id %q", id)
+	}
+
+	job, err := client.BatchV1().Jobs("skeduler").Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *job.Spec.BackoffLimit != 0 || *job.Spec.TTLSecondsAfterFinished != 3600 {
+		t.Errorf("unexpected job spec %+v", job.Spec)
+	}
+	if _, ok := job.Spec.Template.Spec.Containers[0].Resources.Limits[k8sGPUResource]; ok {
+		t.Errorf("a job without GPUs asks for %s", k8sGPUResource)
+	}
+
+	if err := rt.Remove(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.BatchV1().Jobs("skeduler").Get(ctx, name, metav1.GetOptions{}); !apierrors.IsNotFound(err) {
+		t.Errorf("the job was not deleted: %v", err)
+	}
+}
+
+func TestKubernetesJobPod(t *testing.T) {
+	rt, client := newTestKubernetes("job")
+	ctx := context.Background()
+
+	id, _, err := rt.Create(ctx, testRunSpec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, name, _ := strings.Cut(id, "/")
+
+	// the first pod was evicted and the job controller created a replacement, listed last
+	now := time.Now()
+	for podName, created := range map[string]time.Time{"a-evicted": now.Add(-time.Minute), "b-replacement": now} {
+		pod := &corev1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:              podName,
+			Namespace:         "skeduler",
+			Labels:            map[string]string{"job-name": name},
+			CreationTimestamp: metav1.NewTime(created),
+		}}
+		if _, err := client.CoreV1().Pods("skeduler").Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pod, err := rt.pod(ctx, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pod == nil || pod.Name != "b-replacement" {
+		t.Errorf("got pod %v, want the newest one", pod)
+	}
+}
+
+func TestKubernetesRemove(t *testing.T) {
+	rt, _ := newTestKubernetes("pod")
+	ctx := context.Background()
+
+	id, _, err := rt.Create(ctx, testRunSpec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Remove(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rt.pod(ctx, id); !apierrors.IsNotFound(err) {
+		t.Errorf("the pod was not deleted: %v", err)
+	}
+	if containers, _ := rt.List(ctx, "w1"); len(containers) != 0 {
+		t.Errorf("the deleted pod is still listed: %+v", containers)
+	}
+	// removing it again is not an error, the pod may have been deleted by someone else
+	if err := rt.Remove(ctx, id); err != nil {
+		t.Errorf("removing a deleted pod failed: %v", err)
+	}
+}
+
+func TestKubernetesLogs(t *testing.T) {
+	rt, _ := newTestKubernetes("pod")
+	ctx := context.Background()
+
+	id, _, err := rt.Create(ctx, testRunSpec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	setPodStatus(t, rt, id, corev1.PodStatus{Phase: corev1.PodRunning})
+
+	// the fake clientset always answers with the same body
+	var stdout bytes.Buffer
+	if err := rt.Logs(ctx, id, time.Time{}, &stdout, &stdout); err != nil {
+		t.Fatal(err)
+	}
+	if stdout.String() != "fake logs" {
+		t.Errorf("streamed %q", stdout.String())
+	}
+}
+
+func TestKubernetesWait(t *testing.T) {
+	rt, _ := newTestKubernetes("pod")
+	ctx := context.Background()
+
+	id, _, err := rt.Create(ctx, testRunSpec())
+	if err != nil {
+		t.Fatal(err)
+	}
+	wait := rt.Wait(ctx, id)
+	setPodStatus(t, rt, id, corev1.PodStatus{Phase: corev1.PodRunning})
+	setPodStatus(t, rt, id, terminated(corev1.PodFailed, 3))
+
+	select {
+	case s := <-wait:
+		if s.Err != nil || s.Code != 3 {
+			t.Errorf("wait returned %+v, want exit code 3", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("wait did not return")
+	}
+}
+
+func TestPodState(t *testing.T) {
+	tests := []struct {
+		name   string
+		status corev1.PodStatus
+		want   ContainerState
+		failed bool
+	}{
+		{
+			name:   "pending",
+			status: corev1.PodStatus{Phase: corev1.PodPending},
+			want:   ContainerState{Status: "pending"},
+		},
+		{
+			name:   "running",
+			status: corev1.PodStatus{Phase: corev1.PodRunning},
+			want:   ContainerState{Status: "running", Running: true},
+		},
+		{
+			name:   "succeeded",
+			status: terminated(corev1.PodSucceeded, 0),
+			want:   ContainerState{Status: "exited"},
+		},
+		{
+			name:   "failed with exit code",
+			status: terminated(corev1.PodFailed, 2),
+			want:   ContainerState{Status: "exited", ExitCode: 2},
+		},
+		{
+			name:   "evicted",
+			status: corev1.PodStatus{Phase: corev1.PodFailed, Reason: "Evicted"},
+			want:   ContainerState{Status: "failed"},
+			failed: true,
+		},
+		{
+			name: "image pull",
+			status: corev1.PodStatus{
+				Phase: corev1.PodPending,
+				ContainerStatuses: []corev1.ContainerStatus{{
+					Name:  k8sContainer,
+					State: corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "ImagePullBackOff"}},
+				}},
+			},
+			want:   ContainerState{Status: "pending"},
+			failed: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := podState(&corev1.Pod{Status: tt.status})
+			if failed := errors.Is(err, errPodFailed); failed != tt.failed || (err != nil && !failed) {
+				t.Errorf("error %v, want failed %v", err, tt.failed)
+			}
+			if state != tt.want {
+				t.Errorf("state %+v, want %+v", state, tt.want)
+			}
+		})
+	}
+}
@@ -1,30 +1,55 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
-	"os"
-	"os/signal"
-	"syscall"
+	"time"
 
-	"github.com/docker/docker/client"
 	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/config"
-	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/lifecycle"
 )
 
 var (
 	flagConfig = flag.String("config", "config.yml", "Configuration file path")
 )
 
+// QueueConfig is a slot of the worker, which runs one job at a time
 type QueueConfig struct {
+	// GPUs is deprecated, the GPUs of the worker are shared by the slots and configured in gpus
 	GPUs []string `yaml:"gpus"`
 }
 
 type conf struct {
-	Host   string        `yaml:"host"`
-	Token  string        `yaml:"token"`
-	Queues []QueueConfig `yaml:"queues"`
+	// Name identifies the worker in the server, the hostname by default
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels"`
+	Host   string            `yaml:"host"`
+	Token  string            `yaml:"token"`
+	Queues []QueueConfig     `yaml:"queues"`
+	// GPUs are the GPUs of the worker, each job gets as many as it asks for
+	GPUs gpuConfig `yaml:"gpus"`
+	// StopGracePeriod is the time given to a container to exit after being signaled to stop
+	StopGracePeriod time.Duration `yaml:"stop_grace_period"`
+	// StatsInterval is how often the resource usage of the jobs is sampled, 15s by default and
+	// disabled if negative
+	StatsInterval time.Duration `yaml:"stats_interval"`
+	// MountAllowlist are the host paths and volumes the jobs can mount by queue, "*" for every queue
+	MountAllowlist map[string]mountAllowlist `yaml:"mount_allowlist"`
+	// Runtime is the runtime used to run the jobs: "docker" (default), "process" or "kubernetes"
+	Runtime string `yaml:"runtime"`
+	// ProcessWorkdir is the directory where the process runtime creates the working directory of
+	// each job
+	ProcessWorkdir string           `yaml:"process_workdir"`
+	Kubernetes     kubernetesConfig `yaml:"kubernetes"`
+	// Registries are the credentials of the container registries by host. The images of the other
+	// registries are pulled with the credentials of the server, if it has them, or anonymously.
+	Registries map[string]registryConfig `yaml:"registries"`
+	// ImageCache pulls the images of the enqueued jobs in advance and removes the unused ones
+	ImageCache imageCacheConfig `yaml:"image_cache"`
+	// Shutdown is what happens to the running jobs when the worker is stopped
+	Shutdown shutdownConfig `yaml:"shutdown"`
 }
 
 func main() {
@@ -35,50 +60,127 @@ func main() {
 		panic(err)
 	}
 	fmt.Printf("Loaded worker configuration: %+v\n", cfg)
-
-	cli, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
-	if err != nil {
+	if cfg.StopGracePeriod <= 0 {
+		cfg.StopGracePeriod = 30 * time.Second
+	}
+	if cfg.StatsInterval == 0 {
+		cfg.StatsInterval = 15 * time.Second
+	}
+	if err := cfg.Shutdown.validate(); err != nil {
 		panic(err)
 	}
-	defer cli.Close()
 
-	tasks := make(chan jobs.Job, len(cfg.Queues))
-	waitWkEnd := make(chan struct{}, len(cfg.Queues))
-	for i, wConf := range cfg.Queues {
-		a := worker{
-			id:    i,
-			cli:   cli,
-			reqs:  tasks,
-			quit:  waitWkEnd,
-			gpus:  wConf.GPUs,
-			token: cfg.Token,
-			host:  cfg.Host,
+	credentials := newRegistryCredentials(cfg.Host, cfg.Token, cfg.Registries)
+
+	var rt Runtime
+	switch cfg.Runtime {
+	case "", "docker":
+		docker, err := newDockerRuntime(credentials)
+		if err != nil {
+			panic(err)
+		}
+		defer docker.Close()
+		rt = docker
+	case "process":
+		log.Printf("using the process runtime, jobs run directly on the host\n")
+		rt, err = newProcessRuntime(cfg.ProcessWorkdir)
+		if err != nil {
+			panic(err)
+		}
+	case "kubernetes":
+		log.Printf("using the kubernetes runtime, jobs run in namespace %q\n", cfg.Kubernetes.Namespace)
+		rt, err = newKubernetesRuntime(cfg.Kubernetes)
+		if err != nil {
+			panic(err)
 		}
-		go a.start()
+	default:
+		panic(fmt.Sprintf("unknown runtime %q", cfg.Runtime))
 	}
 
-	// puller close
-	closing := make(chan struct{}, 1)
-	go puller(tasks, closing, cfg.Host, cfg.Token)
+	discovery, err := newGPUDiscovery(cfg.GPUs, cfg.Queues)
+	if err != nil {
+		panic(err)
+	}
+	devices, err := discovery.Devices(context.TODO())
+	if err != nil {
+		panic(fmt.Sprintf("discovering GPUs: %v", err))
+	}
+	log.Printf("found %d GPUs: %v\n", len(devices), devices)
+	pool := newGPUPool(devices)
+	// without a gpus section, the jobs that do not ask for GPUs get the ones of the queue of their slot
+	slotGPUs := make([][]string, len(cfg.Queues))
+	if cfg.GPUs.legacy() {
+		slotGPUs = legacySlotGPUs(cfg.Queues, devices)
+	}
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
-	<-c
+	reg := newRegistration(cfg, devices)
+	credentials.workerID = reg.workerID
+	if err := reg.register(context.TODO(), cfg.Host, cfg.Token); err != nil {
+		log.Printf("error registering worker, retrying with the next heartbeat: %v\n", err)
+	}
 
-	log.Printf("starting gracefull shutdown. Waiting for all pending tasks to finish\n")
+	lc := lifecycle.New(cfg.Shutdown.Timeout)
+	// with the wait policy the running jobs are never interrupted
+	var interrupt <-chan struct{}
+	if cfg.Shutdown.Policy != shutdownWait {
+		interrupt = lc.Closing()
+	}
 
-	// close workers, they won't work anymore
-	close(tasks)
+	running := newTracker(len(cfg.Queues))
+	// the puller only claims jobs for the idle slots, which are waiting to receive them
+	tasks := make(chan task)
+	// stopHeartbeat stops the heartbeat once the slots are done
+	stopHeartbeat := make(chan struct{})
+	for i := range cfg.Queues {
+		a := worker{
+			id:        i,
+			name:      reg.reg.Name,
+			rt:        rt,
+			reqs:      tasks,
+			closing:   lc.Closing(),
+			interrupt: interrupt,
+			lc:        lc,
+			shutdown:  cfg.Shutdown,
+			workerID:  reg.workerID,
+			pool:      pool,
+			token:     cfg.Token,
+			host:      cfg.Host,
+
+			legacyGPUs:    slotGPUs[i],
+			tracker:       running,
+			stopGrace:     cfg.StopGracePeriod,
+			statsInterval: cfg.StatsInterval,
+			mounts:        cfg.MountAllowlist,
+		}
+		lc.Go(fmt.Sprintf("slot %d", i), func() error {
+			a.start()
+			return nil
+		})
+	}
 
-	// notify to close
-	for i := 0; i < len(closing); i++ {
-		closing <- struct{}{}
+	lc.Go("puller", func() error {
+		// the jobs left running by a previous run take their slots before new jobs are claimed
+		reattach(rt, reg.reg.Name, reg.workerID(), running, pool, tasks, lc.Closing(), cfg.StopGracePeriod, cfg.Host, cfg.Token)
+		puller(tasks, running, pool, reg, lc.Closing(), pollWaitFor(cfg.Shutdown.Timeout), cfg.Host, cfg.Token)
+		return nil
+	})
+	// the heartbeat keeps running during the shutdown, so that the running jobs can still be stopped
+	go heartbeat(running, reg, stopHeartbeat, cfg.Host, cfg.Token)
+
+	if cfg.ImageCache.Prepull > 0 || cfg.ImageCache.MinFree > 0 {
+		if store, ok := rt.(imageStore); ok {
+			go newImageCache(cfg.ImageCache, rt, store, cfg.Host, cfg.Token).run(lc.Closing())
+		} else {
+			log.Printf("the %q runtime does not keep images, ignoring image_cache\n", cfg.Runtime)
+		}
 	}
 
-	// wait for workers to close
-	for range cfg.Queues {
-		<-waitWkEnd
+	log.Printf("worker started, on shutdown the running jobs follow the %s policy\n", cfg.Shutdown.Policy)
+	pending := lc.Wait()
+	if len(pending) != 0 {
+		log.Printf("shutdown did not finish in %s, leaving the running jobs in their containers: %v\n", cfg.Shutdown.Timeout, running.ids())
 	}
+	close(stopHeartbeat)
 
 	log.Printf("shutdown!\n")
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+)
+
+// anyQueue is the key of the allowlist that applies to the jobs of every queue
+const anyQueue = "*"
+
+// mountAllowlist are the host paths and volumes that the jobs of a queue can mount
+type mountAllowlist struct {
+	// HostPaths can be mounted, as well as any path inside them
+	HostPaths []string `yaml:"host_paths"`
+	// Volumes are the names of the volumes, they can be patterns like "ckpt-*"
+	Volumes []string `yaml:"volumes"`
+}
+
+// checkMounts returns an error if the job asks for a mount that is not in the allowlist of its
+// queue or in the one for every queue. Scratch volumes are always allowed.
+func checkMounts(allowlists map[string]mountAllowlist, queue string, mounts []jobs.Mount) error {
+	allowed := allowlists[anyQueue]
+	if q, ok := allowlists[queue]; ok && queue != anyQueue {
+		allowed.HostPaths = append(append([]string{}, allowed.HostPaths...), q.HostPaths...)
+		allowed.Volumes = append(append([]string{}, allowed.Volumes...), q.Volumes...)
+	}
+
+	for _, m := range mounts {
+		switch m.Kind() {
+		case jobs.MountBind:
+			if !allowed.hostPath(m.Source) {
+				return fmt.Errorf("host path %s is not allowed in queue %q, the allowed paths are %v", m.Source, queue, allowed.HostPaths)
+			}
+		case jobs.MountVolume:
+			if !allowed.volume(m.Source) {
+				return fmt.Errorf("volume %s is not allowed in queue %q, the allowed volumes are %v", m.Source, queue, allowed.Volumes)
+			}
+		case jobs.MountScratch:
+		default:
+			return fmt.Errorf("unknown mount type %q", m.Type)
+		}
+	}
+	return nil
+}
+
+// hostPath returns true if p is one of the allowed paths or inside one of them. The symbolic
+// links of the paths that exist on this host are resolved, so that they can't point outside.
+func (a mountAllowlist) hostPath(p string) bool {
+	p = resolvePath(p)
+	for _, allowed := range a.HostPaths {
+		rel, err := filepath.Rel(resolvePath(allowed), p)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (a mountAllowlist) volume(name string) bool {
+	for _, pattern := range a.Volumes {
+		if ok, err := path.Match(pattern, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvePath cleans p and resolves its symbolic links if it exists
+func resolvePath(p string) string {
+	if resolved, err := filepath.EvalSymlinks(p); err == nil {
+		return resolved
+	}
+	return filepath.Clean(p)
+}
@@ -0,0 +1,361 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/artifacts"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+)
+
+// processRuntime runs the command of the jobs as local processes, for the hosts without Docker.
+// Each job runs in its own process group and working directory, the image is ignored.
+type processRuntime struct {
+	mu      sync.Mutex
+	workdir string
+	procs   map[string]*process
+	next    int
+}
+
+type process struct {
+	cmd *exec.Cmd
+	// the output of the process is read from the pipes by Logs
+	stdout, stderr   *io.PipeReader
+	stdoutW, stderrW *io.PipeWriter
+	// started is closed when the process starts, done when it exits
+	started chan struct{}
+	done    chan struct{}
+	// exitCode is set before closing done
+	exitCode int64
+	// dir is the working directory of the job, removed with the process
+	dir string
+}
+
+func newProcessRuntime(workdir string) (Runtime, error) {
+	if workdir == "" {
+		workdir = filepath.Join(os.TempDir(), "skeduler")
+	}
+	if err := os.MkdirAll(workdir, 0755); err != nil {
+		return nil, fmt.Errorf("creating process working directory: %w", err)
+	}
+
+	return &processRuntime{
+		workdir: workdir,
+		procs:   make(map[string]*process),
+	}, nil
+}
+
+func (p *processRuntime) process(id string) (*process, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	proc, ok := p.procs[id]
+	if !ok {
+		return nil, fmt.Errorf("no such process: %s", id)
+	}
+	return proc, nil
+}
+
+func (p *processRuntime) Pull(ctx context.Context, image string, policy jobs.PullPolicy, out io.Writer) (*jobs.PullInfo, error) {
+	_, err := fmt.Fprintf(out, "process runtime: ignoring image %s, running the command on the host\n", image)
+	return nil, err
+}
+
+func (p *processRuntime) Create(ctx context.Context, spec RunSpec) (string, []string, error) {
+	// there is no image, the entrypoint is just the start of the command
+	args := append(append([]string{}, spec.Entrypoint...), spec.Cmd...)
+	if len(args) == 0 || args[0] == "" {
+		return "", nil, errors.New("empty command")
+	}
+	if len(spec.Mounts) != 0 {
+		return "", nil, errors.New("mounts are not supported by the process runtime")
+	}
+
+	// the job cannot leave its working directory, or it could run and create directories anywhere
+	// on the host
+	if filepath.IsAbs(spec.Workdir) {
+		return "", nil, fmt.Errorf("workdir %q must be relative to the job working directory in the process runtime", spec.Workdir)
+	}
+	for _, elem := range strings.Split(filepath.ToSlash(spec.Workdir), "/") {
+		if elem == ".." {
+			return "", nil, fmt.Errorf("workdir %q cannot contain ..", spec.Workdir)
+		}
+	}
+
+	dir := filepath.Join(p.workdir, spec.JobID.String())
+	workdir := filepath.Join(dir, spec.Workdir)
+	if err := os.MkdirAll(workdir, 0755); err != nil {
+		return "", nil, fmt.Errorf("creating job working directory: %w", err)
+	}
+
+	warnings := []string{fmt.Sprintf("running on the host in %s", workdir)}
+	if spec.User != "" {
+		warnings = append(warnings, fmt.Sprintf("ignoring user %q, the process runs as the worker user", spec.User))
+	}
+	if spec.Resources.CPUs != 0 || spec.Resources.Memory != 0 || spec.Resources.MemorySwap != 0 || spec.Resources.ShmSize != 0 ||
+		spec.Resources.PidsLimit != 0 || len(spec.Resources.Ulimits) != 0 {
+		warnings = append(warnings, "ignoring the resource limits, they are not supported by the process runtime")
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = workdir
+	// only a few variables of the host are kept, the rest of the environment of the worker (tokens,
+	// proxies...) must not leak into the job
+	cmd.Env = append(hostEnv(), spec.Env...)
+	// same GPUs the Docker runtime would give to the container
+	if len(spec.GPUs) != 0 && !(len(spec.GPUs) == 1 && spec.GPUs[0] == "all") {
+		cmd.Env = append(cmd.Env, "CUDA_VISIBLE_DEVICES="+strings.Join(spec.GPUs, ","))
+	}
+	// own process group, so that the whole process tree can be signaled
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stdout, stdoutW := io.Pipe()
+	stderr, stderrW := io.Pipe()
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.next++
+	id := fmt.Sprintf("process-%d", p.next)
+	p.procs[id] = &process{
+		cmd:     cmd,
+		dir:     dir,
+		stdout:  stdout,
+		stderr:  stderr,
+		stdoutW: stdoutW,
+		stderrW: stderrW,
+		started: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	return id, warnings, nil
+}
+
+func (p *processRuntime) Start(ctx context.Context, id string) error {
+	proc, err := p.process(id)
+	if err != nil {
+		return err
+	}
+
+	if err := proc.cmd.Start(); err != nil {
+		return err
+	}
+	close(proc.started)
+
+	go func() {
+		defer close(proc.done)
+
+		_ = proc.cmd.Wait()
+		proc.exitCode = exitCode(proc.cmd.ProcessState)
+		_ = proc.stdoutW.Close()
+		_ = proc.stderrW.Close()
+	}()
+	return nil
+}
+
+// hostEnvAllowlist are the variables of the host passed to the processes
+var hostEnvAllowlist = []string{"PATH", "HOME", "LANG"}
+
+// hostEnv returns the allowed variables that are set in the host
+func hostEnv() []string {
+	var env []string
+	for _, k := range hostEnvAllowlist {
+		if v, ok := os.LookupEnv(k); ok {
+			env = append(env, k+"="+v)
+		}
+	}
+	return env
+}
+
+// exitCode returns the exit code of a process, 128 + signal if it was killed like the shells do
+func exitCode(state *os.ProcessState) int64 {
+	if state == nil {
+		return -1
+	}
+	if status, ok := state.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int64(status.Signal())
+	}
+	return int64(state.ExitCode())
+}
+
+// Logs copies the whole output, since is ignored as the processes cannot be reattached
+func (p *processRuntime) Logs(ctx context.Context, id string, since time.Time, stdout, stderr io.Writer) error {
+	proc, err := p.process(id)
+	if err != nil {
+		return err
+	}
+	<-proc.started
+
+	// both pipes are copied at the same time and the writers may be the same
+	mu := &sync.Mutex{}
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i, pipe := range []struct {
+		r *io.PipeReader
+		w io.Writer
+	}{{proc.stdout, lockedWriter{mu, stdout}}, {proc.stderr, lockedWriter{mu, stderr}}} {
+		wg.Add(1)
+		go func(i int, r *io.PipeReader, w io.Writer) {
+			defer wg.Done()
+			if _, err := io.Copy(w, r); err != nil {
+				errs[i] = err
+				// keep reading, the process blocks if its output is not consumed
+				_, _ = io.Copy(io.Discard, r)
+			}
+		}(i, pipe.r, pipe.w)
+	}
+	wg.Wait()
+
+	if errs[0] != nil {
+		return errs[0]
+	}
+	return errs[1]
+}
+
+// lockedWriter serializes the writes to w
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (l lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+func (p *processRuntime) Wait(ctx context.Context, id string) <-chan ExitStatus {
+	res := make(chan ExitStatus, 1)
+
+	proc, err := p.process(id)
+	if err != nil {
+		res <- ExitStatus{Code: -1, Err: err}
+		return res
+	}
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			res <- ExitStatus{Code: -1, Err: ctx.Err()}
+		case <-proc.done:
+			res <- ExitStatus{Code: proc.exitCode}
+		}
+	}()
+	return res
+}
+
+// Stop sends SIGTERM to the process group and SIGKILL if it is still running after the grace period
+func (p *processRuntime) Stop(ctx context.Context, id string, grace time.Duration) error {
+	proc, err := p.process(id)
+	if err != nil {
+		return err
+	}
+	<-proc.started
+
+	pgid := proc.cmd.Process.Pid
+	if err := syscall.Kill(-pgid, syscall.SIGTERM); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("sending SIGTERM to process group %d: %w", pgid, err)
+	}
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+
+	select {
+	case <-proc.done:
+		// the leader exited, make sure its children are gone too
+		_ = syscall.Kill(-pgid, syscall.SIGKILL)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+	}
+
+	if err := syscall.Kill(-pgid, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("killing process group %d: %w", pgid, err)
+	}
+
+	select {
+	case <-proc.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (p *processRuntime) Inspect(ctx context.Context, id string) (ContainerState, error) {
+	proc, err := p.process(id)
+	if err != nil {
+		return ContainerState{}, err
+	}
+
+	select {
+	case <-proc.done:
+		return ContainerState{Status: "exited", ExitCode: int(proc.exitCode)}, nil
+	default:
+	}
+
+	select {
+	case <-proc.started:
+		return ContainerState{Running: true, Status: "running"}, nil
+	default:
+		return ContainerState{Status: "created"}, nil
+	}
+}
+
+// Remove forgets the process and removes the working directory of the job, with everything the job
+// wrote there
+func (p *processRuntime) Remove(ctx context.Context, id string) error {
+	p.mu.Lock()
+	proc, ok := p.procs[id]
+	delete(p.procs, id)
+	p.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+	if err := os.RemoveAll(proc.dir); err != nil {
+		return fmt.Errorf("removing job working directory: %w", err)
+	}
+	return nil
+}
+
+// List finds nothing, the output of the processes left by a previous worker cannot be read
+func (p *processRuntime) List(ctx context.Context, worker string) ([]JobContainer, error) {
+	return nil, nil
+}
+
+func (p *processRuntime) Stats(ctx context.Context, id string) (jobs.StatsSample, error) {
+	return jobs.StatsSample{}, errNoStats
+}
+
+// CopyFrom archives a path of the host, a relative one is inside the working directory of the job
+func (p *processRuntime) CopyFrom(ctx context.Context, id string, path string) (io.ReadCloser, error) {
+	proc, err := p.process(id)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(proc.cmd.Dir, path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(artifacts.WriteTar(w, path))
+	}()
+	return r, nil
+}
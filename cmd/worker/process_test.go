@@ -0,0 +1,117 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gofrs/uuid"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+)
+
+func TestProcessWorkdir(t *testing.T) {
+	ctx := context.Background()
+	root := t.TempDir()
+	rt, err := newProcessRuntime(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jobID := uuid.Must(uuid.NewV4())
+
+	elsewhere := filepath.Join(root, "elsewhere")
+	for _, workdir := range []string{"..", "../other", "out/../../other", "/", elsewhere} {
+		if _, _, err := rt.Create(ctx, RunSpec{JobID: jobID, Cmd: []string{"true"}, Workdir: workdir}); err == nil {
+			t.Errorf("workdir %q was accepted", workdir)
+		}
+	}
+	if _, err := os.Stat(elsewhere); !os.IsNotExist(err) {
+		t.Errorf("an absolute workdir was created: %v", err)
+	}
+
+	id, _, err := rt.Create(ctx, RunSpec{JobID: jobID, Cmd: []string{"sh", "-c", "echo ok > result.txt"}, Workdir: "out"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rt.Start(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if s := <-rt.Wait(ctx, id); s.Err != nil || s.Code != 0 {
+		t.Fatalf("process exited with %+v", s)
+	}
+
+	dir := filepath.Join(root, jobID.String())
+	if _, err := os.Stat(filepath.Join(dir, "out", "result.txt")); err != nil {
+		t.Fatalf("the job did not run in its working directory: %v", err)
+	}
+	if err := rt.Remove(ctx, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("the working directory of the job was not removed: %v", err)
+	}
+}
+
+// TestProcessEnv checks that a process gets the same job variables as a container and nothing else
+// of the worker environment than PATH, HOME and LANG
+func TestProcessEnv(t *testing.T) {
+	t.Setenv("SKEDULER_TEST_SECRET", "secret")
+
+	w, fake, srv := newTestWorker(t, map[string]fakeScript{fakeAnyImage: {}})
+	j := testJob()
+	j.Description = "env"
+	j.Docker.Command = "env"
+	j.Docker.Environment = map[string]interface{}{"EPOCHS": 3}
+	if err := w.run(context.Background(), j, nil, nil); err != nil {
+		t.Fatalf("run in the fake runtime failed: %v", err)
+	}
+	if len(fake.specs) != 1 {
+		t.Fatalf("%d containers created, want 1", len(fake.specs))
+	}
+	env := fake.specs[0].Env
+	for _, want := range []string{"SKEDULER_ID=" + j.ID.String(), "SKEDULER_NAME=test", "SKEDULER_DESCRIPTION=env",
+		"SKEDULER_DOCKER_IMAGE=train:1", "SKEDULER_DOCKER_COMMAND=env", "EPOCHS=3"} {
+		if !contains(env, want) {
+			t.Errorf("container environment %v does not contain %s", env, want)
+		}
+	}
+
+	rt, err := newProcessRuntime(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.rt = rt
+	j.ID = uuid.Must(uuid.NewV4())
+	if err := w.run(context.Background(), j, nil, nil); err != nil {
+		t.Fatalf("run in the process runtime failed: %v", err)
+	}
+	srv.waitLog(t, j.ID, jobs.MagicEnd)
+
+	log := srv.log(j.ID)
+	for _, v := range env {
+		if strings.HasPrefix(v, "SKEDULER_ID=") {
+			v = "SKEDULER_ID=" + j.ID.String()
+		}
+		if !strings.Contains(log, v+"\n") {
+			t.Errorf("process environment does not contain %s:\n%s", v, log)
+		}
+	}
+	if !strings.Contains(log, "PATH=") {
+		t.Errorf("process environment does not contain PATH:\n%s", log)
+	}
+	if strings.Contains(log, "SKEDULER_TEST_SECRET") {
+		t.Errorf("the worker environment leaked into the process:\n%s", log)
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
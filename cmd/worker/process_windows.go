@@ -0,0 +1,7 @@
+package main
+
+import "errors"
+
+func newProcessRuntime(workdir string) (Runtime, error) {
+	return nil, errors.New("the process runtime is not supported on windows")
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/go-units"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+)
+
+// pullProgressInterval is how often the progress of a pull is written to the job log
+const pullProgressInterval = 10 * time.Second
+
+// pullProgress turns the JSON progress stream of a Docker pull into a few readable lines: one
+// when each layer is pulled and the overall progress every interval
+type pullProgress struct {
+	out      io.Writer
+	interval time.Duration
+	// lastReport is when the overall progress was written for the last time
+	lastReport time.Time
+
+	layers map[string]*layerProgress
+	order  []string
+}
+
+type layerProgress struct {
+	downloaded, total int64
+	done, cached      bool
+}
+
+// decodePull reads the progress stream of a pull, writing a summary to out. It returns the
+// error reported in the stream, if any, and what was pulled.
+func decodePull(r io.Reader, out io.Writer, interval time.Duration) (jobs.PullInfo, error) {
+	p := &pullProgress{
+		out:        out,
+		interval:   interval,
+		lastReport: time.Now(),
+		layers:     make(map[string]*layerProgress),
+	}
+
+	dec := json.NewDecoder(r)
+	for {
+		var msg jsonmessage.JSONMessage
+		err := dec.Decode(&msg)
+		if err == io.EOF {
+			return p.info(), nil
+		}
+		if err != nil {
+			return p.info(), fmt.Errorf("decoding pull progress: %w", err)
+		}
+
+		if msg.Error != nil {
+			return p.info(), msg.Error
+		}
+		if msg.ErrorMessage != "" {
+			return p.info(), errors.New(msg.ErrorMessage)
+		}
+		p.handle(msg)
+	}
+}
+
+func (p *pullProgress) handle(msg jsonmessage.JSONMessage) {
+	// the messages without an ID are about the whole image, like the digest and the final status
+	if msg.ID == "" || strings.HasPrefix(msg.Status, "Pulling from") {
+		_, _ = fmt.Fprintln(p.out, msg.Status)
+		return
+	}
+
+	l, ok := p.layers[msg.ID]
+	if !ok {
+		l = &layerProgress{}
+		p.layers[msg.ID] = l
+		p.order = append(p.order, msg.ID)
+	}
+
+	switch {
+	case msg.Status == "Downloading" && msg.Progress != nil:
+		l.downloaded = msg.Progress.Current
+		if msg.Progress.Total > 0 {
+			l.total = msg.Progress.Total
+		}
+		p.report()
+	case msg.Status == "Extracting":
+		p.report()
+	case msg.Status == "Download complete":
+		if l.total > 0 {
+			l.downloaded = l.total
+		}
+	case msg.Status == "Already exists":
+		l.done, l.cached = true, true
+	case msg.Status == "Pull complete":
+		l.done = true
+		_, _ = fmt.Fprintf(p.out, "layer %s pulled (%s)\n", msg.ID, units.BytesSize(float64(l.downloaded)))
+	case strings.HasPrefix(msg.Status, "Retrying"):
+		_, _ = fmt.Fprintf(p.out, "layer %s: %s\n", msg.ID, msg.Status)
+	}
+}
+
+// report writes the overall progress if interval has passed since the last time
+func (p *pullProgress) report() {
+	if time.Since(p.lastReport) < p.interval {
+		return
+	}
+	p.lastReport = time.Now()
+
+	var downloaded, total int64
+	done := 0
+	for _, l := range p.layers {
+		if l.cached {
+			done++
+			continue
+		}
+		downloaded += l.downloaded
+		total += l.total
+		if l.done {
+			done++
+		}
+	}
+
+	percent := 0.0
+	if total > 0 {
+		percent = float64(downloaded) / float64(total) * 100
+	}
+	_, _ = fmt.Fprintf(p.out, "pulling: %s of %s downloaded (%.0f%%), %d of %d layers done\n",
+		units.BytesSize(float64(downloaded)), units.BytesSize(float64(total)), percent, done, len(p.layers))
+}
+
+func (p *pullProgress) info() jobs.PullInfo {
+	info := jobs.PullInfo{Pulled: true, Layers: len(p.order)}
+	for _, id := range p.order {
+		l := p.layers[id]
+		if l.cached {
+			info.CachedLayers++
+			continue
+		}
+		info.Bytes += l.downloaded
+	}
+	return info
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+)
+
+// reattach finds the containers left by a previous run of this worker, for example before an
+// upgrade or a crash, and hands the ones whose job is still running on this worker to the slots,
+// which keep streaming their logs and report their final status. Only the newest container of each
+// job is reattached. The other containers, and the ones of the jobs that are not running here
+// anymore, are stopped and removed. The GPUs of the reattached jobs are taken from the pool.
+func reattach(rt Runtime, name string, workerID uuid.UUID, t *tracker, pool *gpuPool, tasks chan<- task, closing <-chan struct{}, grace time.Duration, host string, token string) {
+	ctx := context.TODO()
+
+	containers, err := rt.List(ctx, name)
+	if err != nil {
+		log.Printf("error listing the containers of a previous run: %v\n", err)
+		return
+	}
+
+	remove := func(c JobContainer) {
+		if c.State.Running {
+			if err := rt.Stop(ctx, c.ID, grace); err != nil {
+				log.Printf("error stopping container %s: %v\n", c.ID, err)
+			}
+		}
+		if err := rt.Remove(ctx, c.ID); err != nil {
+			log.Printf("error removing container %s: %v\n", c.ID, err)
+		}
+	}
+
+	// a job requeued while the worker was down may have been claimed by it again, keeping an older
+	// container next to the new one
+	newest := make(map[uuid.UUID]JobContainer)
+	var order []uuid.UUID
+	for _, c := range containers {
+		prev, ok := newest[c.JobID]
+		switch {
+		case !ok:
+			order = append(order, c.JobID)
+		case c.Created.After(prev.Created):
+			log.Printf("job %s has a newer container %s, removing container %s\n", c.JobID, c.ID, prev.ID)
+			remove(prev)
+		default:
+			log.Printf("job %s has a newer container %s, removing container %s\n", c.JobID, prev.ID, c.ID)
+			remove(c)
+			continue
+		}
+		newest[c.JobID] = c
+	}
+
+	for _, jobID := range order {
+		c := newest[jobID]
+
+		job, err := getJob(ctx, host, token, c.JobID)
+		if err != nil {
+			log.Printf("error getting job %s of container %s, leaving it: %v\n", c.JobID, c.ID, err)
+			continue
+		}
+
+		if job.Status != jobs.Running {
+			log.Printf("job %s of container %s is %s, removing the container\n", job.ID, c.ID, job.Status)
+			remove(c)
+			continue
+		}
+		// the job was requeued and is now running somewhere else
+		if workerID != uuid.Nil && job.Worker != nil && *job.Worker != workerID {
+			log.Printf("job %s of container %s is running on worker %s, removing the container\n", job.ID, c.ID, *job.Worker)
+			remove(c)
+			continue
+		}
+
+		log.Printf("found job %s running in container %s, reattaching\n", job.ID, c.ID)
+		t.claimSlot()
+		pool.reserve(job.ID, c.GPUs)
+		select {
+		case tasks <- task{job: job, container: &c, gpus: c.GPUs}:
+		case <-closing:
+			// the container keeps running, it is reattached the next time the worker starts
+			t.releaseSlot()
+			pool.release(job.ID)
+			return
+		}
+	}
+}
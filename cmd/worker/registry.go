@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/workers"
+)
+
+// defaultTokenTTL is how long the token printed by a registry command is used, unless it is
+// rejected earlier
+const defaultTokenTTL = 10 * time.Minute
+
+// registryConfig are the credentials of a registry in the configuration of the worker. The
+// password can be given as is, read from a file on every pull or printed by a command, so that
+// short-lived tokens are refreshed.
+type registryConfig struct {
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	// PasswordFile is read on every pull, so that a rotated token is picked up
+	PasswordFile string `yaml:"password_file"`
+	// Command prints the password, it is run again once TokenTTL passes or the registry rejects it
+	Command  []string      `yaml:"command"`
+	TokenTTL time.Duration `yaml:"token_ttl"`
+	// IdentityToken is an OAuth refresh token, used instead of the username and password
+	IdentityToken string `yaml:"identity_token"`
+}
+
+// String hides the secrets, so that the credentials can be logged with the configuration
+func (c registryConfig) String() string {
+	return fmt.Sprintf("{Username:%s PasswordFile:%s Command:%v}", c.Username, c.PasswordFile, c.Command)
+}
+
+// registryCredentials finds the credentials of the registries: the ones in the configuration of
+// the worker, or else the ones the server has
+type registryCredentials struct {
+	host, token string
+	// workerID returns the ID of the worker, the server only gives credentials to registered workers
+	workerID func() uuid.UUID
+
+	local map[string]registryConfig
+
+	mu sync.Mutex
+	// tokens are the passwords printed by the commands, by registry
+	tokens map[string]commandToken
+}
+
+type commandToken struct {
+	password string
+	expires  time.Time
+}
+
+func newRegistryCredentials(host, token string, local map[string]registryConfig) *registryCredentials {
+	c := &registryCredentials{
+		host:     host,
+		token:    token,
+		workerID: func() uuid.UUID { return uuid.Nil },
+		local:    make(map[string]registryConfig, len(local)),
+		tokens:   make(map[string]commandToken),
+	}
+	for registry, cfg := range local {
+		c.local[workers.NormalizeRegistry(registry)] = cfg
+	}
+	return c
+}
+
+// get returns the credentials of a registry and where they come from, or nil if there are none
+// and the image has to be pulled anonymously
+func (c *registryCredentials) get(ctx context.Context, registry string) (*workers.RegistryAuth, string, error) {
+	if cfg, ok := c.local[registry]; ok {
+		auth, err := c.fromConfig(ctx, registry, cfg)
+		if err != nil {
+			return nil, "", err
+		}
+		return auth, "worker configuration", nil
+	}
+
+	if c.host == "" || c.workerID() == uuid.Nil {
+		return nil, "", nil
+	}
+	auth, err := getRegistryAuth(ctx, c.host, c.token, c.workerID(), registry)
+	if err != nil {
+		return nil, "", fmt.Errorf("getting credentials from the server: %w", err)
+	}
+	if auth == nil {
+		return nil, "", nil
+	}
+	return auth, "server", nil
+}
+
+func (c *registryCredentials) fromConfig(ctx context.Context, registry string, cfg registryConfig) (*workers.RegistryAuth, error) {
+	auth := &workers.RegistryAuth{Username: cfg.Username, Password: cfg.Password, IdentityToken: cfg.IdentityToken}
+
+	switch {
+	case cfg.PasswordFile != "":
+		b, err := os.ReadFile(cfg.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading password file: %w", err)
+		}
+		auth.Password = strings.TrimSpace(string(b))
+
+	case len(cfg.Command) != 0:
+		password, err := c.commandToken(ctx, registry, cfg)
+		if err != nil {
+			return nil, err
+		}
+		auth.Password = password
+	}
+	return auth, nil
+}
+
+// commandToken returns the password printed by the command of the registry, running it again if
+// the previous one expired
+func (c *registryCredentials) commandToken(ctx context.Context, registry string, cfg registryConfig) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if t, ok := c.tokens[registry]; ok && time.Now().Before(t.expires) {
+		return t.password, nil
+	}
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, cfg.Command[0], cfg.Command[1:]...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("running credentials command: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	password := strings.TrimSpace(string(out))
+	if password == "" {
+		return "", errors.New("credentials command printed no password")
+	}
+
+	ttl := cfg.TokenTTL
+	if ttl <= 0 {
+		ttl = defaultTokenTTL
+	}
+	c.tokens[registry] = commandToken{password: password, expires: time.Now().Add(ttl)}
+	return password, nil
+}
+
+// refresh forgets the token of a registry after it has been rejected. It returns true if there
+// was one, so that the pull is worth retrying with a new token.
+func (c *registryCredentials) refresh(registry string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	_, ok := c.tokens[registry]
+	delete(c.tokens, registry)
+	return ok
+}
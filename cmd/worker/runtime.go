@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+)
+
+// Runtime runs the containers of the jobs. The worker drives a job through it: pull the image,
+// create and start the container, stream its logs and wait for it to exit (or stop it).
+type Runtime interface {
+	// Pull makes the image available following the pull policy, writing the progress to out. It
+	// returns what was pulled, or nil if the runtime does not pull the images itself.
+	Pull(ctx context.Context, image string, policy jobs.PullPolicy, out io.Writer) (*jobs.PullInfo, error)
+	// Create creates a container for spec and returns its ID and the warnings to show to the user
+	Create(ctx context.Context, spec RunSpec) (string, []string, error)
+	Start(ctx context.Context, id string) error
+	// Logs copies the output of the container written after since to stdout and stderr until it
+	// exits
+	Logs(ctx context.Context, id string, since time.Time, stdout, stderr io.Writer) error
+	// Wait returns a channel that receives the exit status once the container stops running
+	Wait(ctx context.Context, id string) <-chan ExitStatus
+	// Stop asks the container to exit and kills it if it is still running after the grace period
+	Stop(ctx context.Context, id string, grace time.Duration) error
+	Inspect(ctx context.Context, id string) (ContainerState, error)
+	// Remove deletes a container that is no longer running
+	Remove(ctx context.Context, id string) error
+	// List returns the containers created for the given worker that have not been removed, so
+	// that the worker can reattach to them after restarting. The runtimes that find containers
+	// must start every log line with its RFC 3339 timestamp, which is used to resume the logs.
+	List(ctx context.Context, worker string) ([]JobContainer, error)
+	// Stats returns the current resource usage of a running container, errNoStats if the runtime
+	// cannot measure it
+	Stats(ctx context.Context, id string) (jobs.StatsSample, error)
+	// CopyFrom returns a tar archive of a file or directory of a container that has not been
+	// removed, whose entries start with its base name. It returns errNoCopy if the runtime cannot
+	// copy files out of the containers.
+	CopyFrom(ctx context.Context, id string, path string) (io.ReadCloser, error)
+}
+
+// errNoStats is returned by the runtimes that do not report the resource usage of the containers
+var errNoStats = errors.New("runtime does not report resource usage")
+
+// errNoCopy is returned by the runtimes that cannot copy files out of the containers
+var errNoCopy = errors.New("runtime does not support copying files from the containers")
+
+// RunSpec describes the container to create for a job
+type RunSpec struct {
+	JobID uuid.UUID
+	// Worker is the name of the worker creating the container, it is set as a label together with
+	// the job ID
+	Worker     string
+	Image      string
+	PullPolicy jobs.PullPolicy
+	// Cmd replaces the CMD of the image and Entrypoint its ENTRYPOINT, the image default is kept
+	// if they are empty
+	Cmd        []string
+	Entrypoint []string
+	Env        []string
+	Hostname   string
+	// Workdir and User replace the ones of the image if they are set
+	Workdir string
+	User    string
+	// GPUs are the device IDs of the GPUs given to the container, none if empty
+	GPUs      []string
+	Resources jobs.Resources
+	// Mounts have been checked against the allowlist, the runtime creates the scratch volumes
+	// and removes them with the container
+	Mounts []jobs.Mount
+}
+
+// JobContainer is a container found by Runtime.List
+type JobContainer struct {
+	ID    string
+	JobID uuid.UUID
+	State ContainerState
+	// GPUs are the devices given to the container when it was created
+	GPUs []string
+	// Created is when the container was created, to find the newest one of a job
+	Created time.Time
+}
+
+// ExitStatus is the result of waiting for a container. Err is set when the wait itself failed.
+type ExitStatus struct {
+	Code int64
+	Err  error
+}
+
+// ContainerState is the current state of a container
+type ContainerState struct {
+	Running  bool
+	ExitCode int
+	Status   string
+}
+
+func (s ContainerState) String() string {
+	if s.Running {
+		return s.Status
+	}
+	return fmt.Sprintf("%s (exit code %d)", s.Status, s.ExitCode)
+}
+
+// splitGPUs parses the GPUs stored in a label of a container, separated by commas
+func splitGPUs(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
+// lineTime returns the timestamp at the start of a log line written by the runtimes
+func lineTime(line string) (time.Time, bool) {
+	ts, _, _ := strings.Cut(line, " ")
+	t, err := time.Parse(time.RFC3339Nano, ts)
+	return t, err == nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/workers"
+)
+
+// shutdownPolicy is what the worker does with the running jobs when it shuts down
+type shutdownPolicy string
+
+const (
+	// shutdownWait lets the jobs finish
+	shutdownWait shutdownPolicy = "wait"
+	// shutdownCheckpoint stops the jobs with SIGTERM, giving them the stop grace period to save a
+	// checkpoint, and hands them back to the server
+	shutdownCheckpoint shutdownPolicy = "checkpoint"
+	// shutdownKill kills the jobs right away and hands them back to the server
+	shutdownKill shutdownPolicy = "kill"
+)
+
+// handBackMargin is the time left before the shutdown deadline to hand the stopped jobs back to
+// the server
+const handBackMargin = 5 * time.Second
+
+// shutdownConfig configures what happens when the worker receives SIGINT or SIGTERM. It stops
+// claiming jobs and returns the claimed ones that have not started, the running ones follow the
+// policy.
+type shutdownConfig struct {
+	// Policy is "wait" (default), "checkpoint" or "kill"
+	Policy shutdownPolicy `yaml:"policy"`
+	// Timeout is the longest the shutdown takes, zero waits forever. The jobs still running are left
+	// in their containers and reattached when the worker starts again.
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+func (c *shutdownConfig) validate() error {
+	switch c.Policy {
+	case "":
+		c.Policy = shutdownWait
+	case shutdownWait, shutdownCheckpoint, shutdownKill:
+	default:
+		return fmt.Errorf("unknown shutdown policy %q, it must be %s, %s or %s", c.Policy, shutdownWait, shutdownCheckpoint, shutdownKill)
+	}
+	return nil
+}
+
+// shutdownGrace returns the time a job has to exit when the worker shuts down, shortened so that it
+// can be handed back before the deadline
+func (w *worker) shutdownGrace() time.Duration {
+	if w.shutdown.Policy == shutdownKill {
+		return 0
+	}
+
+	grace := w.stopGrace
+	if deadline, ok := w.lc.Deadline(); ok {
+		left := time.Until(deadline) - handBackMargin
+		if left < 0 {
+			left = 0
+		}
+		if left < grace {
+			grace = left
+		}
+	}
+	return grace
+}
+
+// handBack returns a job stopped by the shutdown to the server, which enqueues it again
+func (w *worker) handBack(id uuid.UUID) {
+	reason := workers.ReturnCheckpoint
+	if w.shutdown.Policy == shutdownKill {
+		reason = workers.ReturnKill
+	}
+	w.returnJob(id, reason)
+}
+
+// returnJob returns a running job to the server, which enqueues it again without counting the
+// attempt
+func (w *worker) returnJob(id uuid.UUID, reason workers.ReturnReason) {
+	err := returnJobs(context.TODO(), w.host, w.token, workers.ReturnedJobs{
+		WorkerID: w.workerID(),
+		Jobs:     []uuid.UUID{id},
+		Reason:   reason,
+	})
+	if err != nil {
+		log.Printf("failed to hand back job %s: %v\n", id, err)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+)
+
+// maxPendingStats is the most samples kept while the server cannot be reached, the oldest ones are
+// dropped
+const maxPendingStats = 1000
+
+// sampleStats samples the resource usage of the container every statsInterval and uploads it to
+// the server until ctx is done
+func (w *worker) sampleStats(ctx context.Context, logr *log.Logger, jobID uuid.UUID, containerID string) {
+	t := time.NewTicker(w.statsInterval)
+	defer t.Stop()
+
+	var pending []jobs.StatsSample
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+
+		sample, err := w.rt.Stats(ctx, containerID)
+		if errors.Is(err, errNoStats) {
+			logr.Printf("the runtime does not report the resource usage of the job")
+			return
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("error getting stats of container %s: %v\n", containerID, err)
+			}
+			continue
+		}
+
+		pending = append(pending, sample)
+		if len(pending) > maxPendingStats {
+			pending = pending[len(pending)-maxPendingStats:]
+		}
+
+		if err := uploadStats(ctx, w.host, w.token, jobID, pending); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("error uploading stats of job %s, %d samples pending: %v\n", jobID, len(pending), err)
+			continue
+		}
+		pending = nil
+	}
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/workers"
+)
+
+// tracker keeps track of the jobs that are running in this worker, so that the server can ask
+// to stop them through the heartbeat, and of how many slots are busy
+type tracker struct {
+	mu      sync.Mutex
+	running map[uuid.UUID]chan jobs.StopSignal
+	slots   int
+	// busy is the number of slots that have claimed a job, started or not
+	busy int
+	// released receives a value when a slot becomes idle
+	released chan struct{}
+}
+
+func newTracker(slots int) *tracker {
+	return &tracker{
+		running:  make(map[uuid.UUID]chan jobs.StopSignal),
+		slots:    slots,
+		released: make(chan struct{}, 1),
+	}
+}
+
+// claimSlot marks a slot as busy, releaseSlot as idle again
+func (t *tracker) claimSlot() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.busy++
+}
+
+func (t *tracker) releaseSlot() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.busy--
+	select {
+	case t.released <- struct{}{}:
+	default:
+	}
+}
+
+// freeSlots returns the number of slots waiting for a job
+func (t *tracker) freeSlots() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.slots - t.busy
+}
+
+// add starts tracking a job. The returned channel receives the stop signals sent by the server
+func (t *tracker) add(id uuid.UUID) <-chan jobs.StopSignal {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ch := make(chan jobs.StopSignal, 1)
+	t.running[id] = ch
+	return ch
+}
+
+func (t *tracker) remove(id uuid.UUID) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.running, id)
+}
+
+func (t *tracker) ids() []uuid.UUID {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ids := make([]uuid.UUID, 0, len(t.running))
+	for id := range t.running {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// signal delivers a stop signal to a running job. Signals for jobs that are not running, or that
+// already have a pending signal, are dropped
+func (t *tracker) signal(s jobs.StopSignal) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	ch, ok := t.running[s.ID]
+	if !ok {
+		return
+	}
+
+	select {
+	case ch <- s:
+	default:
+	}
+}
+
+// heartbeat periodically tells the server which jobs are running and how many slots are free, and
+// delivers the stop signals it answers with. The worker registers again if the server does not know it.
+func heartbeat(t *tracker, r *registration, closing <-chan struct{}, host string, token string) {
+	ticker := time.NewTicker(time.Second * 5)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-closing:
+			return
+		case <-ticker.C:
+			if r.workerID() == uuid.Nil {
+				if err := r.register(context.TODO(), host, token); err != nil {
+					log.Printf("error registering worker: %v\n", err)
+				}
+			}
+
+			res, err := sendHeartbeat(context.TODO(), host, token, workers.Heartbeat{
+				WorkerID:  r.workerID(),
+				Running:   t.ids(),
+				Load:      loadAverage(),
+				FreeSlots: t.freeSlots(),
+			})
+			if err != nil {
+				log.Printf("error sending heartbeat: %v\n", err)
+				continue
+			}
+
+			for _, s := range res.Stop {
+				t.signal(s)
+			}
+
+			if r.setCordon(res.Cordoned, res.Drain) {
+				switch {
+				case res.Drain != "":
+					log.Printf("worker is being drained (%s), not fetching new jobs\n", res.Drain)
+				case res.Cordoned:
+					log.Printf("worker cordoned, not fetching new jobs\n")
+				default:
+					log.Printf("worker uncordoned, fetching new jobs again\n")
+				}
+			}
+			if res.Drain == workers.DrainRequeue {
+				for _, id := range t.ids() {
+					t.signal(jobs.StopSignal{ID: id, Reason: jobs.StopDrain, By: "drain"})
+				}
+			}
+
+			if res.Register {
+				log.Printf("the server does not know this worker, registering again\n")
+				if err := r.register(context.TODO(), host, token); err != nil {
+					log.Printf("error registering worker: %v\n", err)
+				}
+			}
+		}
+	}
+}
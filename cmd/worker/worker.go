@@ -3,83 +3,264 @@ package main
 import (
 	"bytes"
 	"context"
-	"encoding/base64"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/url"
 	"os"
-	"strings"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/gofrs/uuid"
 	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/lifecycle"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/workers"
 )
 
+// errTimedOut is returned by worker.run when the job exceeded its timeout and had to be stopped
+var errTimedOut = errors.New("job exceeded its timeout")
+
+// errCancelled is returned by worker.run when the server asked to cancel the job
+var errCancelled = errors.New("job cancelled")
+
+// errPreempted is returned by worker.run when the server preempted the job to make room for a
+// higher priority one
+var errPreempted = errors.New("job preempted")
+
+// errDrained is returned by worker.run when the job was stopped to be requeued because the worker
+// is being drained
+var errDrained = errors.New("job stopped by drain")
+
+// errShutdown is returned by worker.run when the job was stopped to be handed back because the
+// worker is shutting down
+var errShutdown = errors.New("job stopped by shutdown")
+
+// requeued returns true if the error of worker.run means that the job will run again, so its log
+// and outputs are not finished
+func requeued(err error) bool {
+	return errors.Is(err, errPreempted) || errors.Is(err, errDrained) || errors.Is(err, errShutdown)
+}
+
+// task is a job handed to a slot. Container is set when the job is already running in a
+// container that the slot has to reattach to.
+type task struct {
+	job       jobs.Job
+	container *JobContainer
+	// gpus are the devices of the pool allocated to the job, the slot releases them when it ends
+	gpus []string
+}
+
 type worker struct {
-	id    int
-	cli   *client.Client
-	reqs  <-chan jobs.Job
-	quit  chan<- struct{}
-	gpus  []string
-	token string
-	host  string
+	id int
+	// name is the name of the worker, set as a label on the containers
+	name string
+	rt   Runtime
+	// reqs receives the jobs claimed for this slot, only while it is idle
+	reqs <-chan task
+	// closing is closed when the worker is shutting down, the slot stops taking jobs
+	closing <-chan struct{}
+	// interrupt is closed when the running job has to be stopped because the worker is shutting
+	// down, it is nil if the shutdown policy waits for the jobs
+	interrupt <-chan struct{}
+	lc        *lifecycle.Manager
+	shutdown  shutdownConfig
+	workerID  func() uuid.UUID
+	// pool are the GPUs of the worker, the ones of each job are allocated when it is claimed
+	pool *gpuPool
+	// legacyGPUs are the GPUs of the queue of the slot in the old configurations, given to the jobs
+	// that do not set gpus
+	legacyGPUs []string
+	token      string
+	host       string
+	// tracker receives the stop signals for the running jobs
+	tracker *tracker
+	// stopGrace is the time a container has to exit after receiving the stop signal before
+	// it is killed
+	stopGrace time.Duration
+	// statsInterval is how often the resource usage of the containers is sampled, zero disables it
+	statsInterval time.Duration
+	// mounts are the allowed mounts by queue
+	mounts map[string]mountAllowlist
 }
 
+// start runs the jobs handed to the slot until the worker starts shutting down
 func (w *worker) start() {
-	for t := range w.reqs {
-		if err := w.run(context.TODO(), t); err != nil {
-			log.Printf("error running task: %s", err)
-			t.Status = jobs.Cancelled
-		} else {
-			t.Status = jobs.Finished
+	for {
+		select {
+		case <-w.closing:
+			return
+		case t := <-w.reqs:
+			if t.container == nil && t.job.GPUs == 0 && len(w.legacyGPUs) != 0 {
+				t.gpus = w.legacyGPUs
+				w.pool.reserve(t.job.ID, t.gpus)
+			}
+			w.runJob(t)
+			w.pool.release(t.job.ID)
+			w.tracker.releaseSlot()
 		}
+	}
+}
 
-		if err := updateJob(context.TODO(), w.host, t, w.token); err != nil {
-			log.Printf("failed to update job %+v status: %v\n", t.ID, err)
-		}
+const (
+	// pollWait is how long a poll waits in the server for new jobs
+	pollWait = 30 * time.Second
+	// busyPollWait is how long a poll waits while some GPUs are in use, so that the jobs that need
+	// them are claimed soon after they are released
+	busyPollWait = 5 * time.Second
+	// maxPollBackoff is the longest the puller waits to retry after the server failed
+	maxPollBackoff = 30 * time.Second
+)
+
+// pollWaitFor returns how long the polls wait in the server, below the shutdown timeout so that
+// the worker can wait for the poll in flight when it shuts down
+func pollWaitFor(shutdownTimeout time.Duration) time.Duration {
+	if shutdownTimeout > 0 && shutdownTimeout/2 < pollWait {
+		return shutdownTimeout / 2
 	}
-	w.quit <- struct{}{}
+	return pollWait
 }
 
-func puller(tasks chan<- jobs.Job, closing <-chan struct{}, host string, token string) {
-	t := time.NewTicker(time.Second * 3)
-	defer t.Stop()
+// puller long-polls the server for as many jobs as there are idle slots and hands them to the
+// slots, so that no job is claimed before a slot can run it. Only the jobs that fit in the free
+// GPUs are claimed, and their GPUs are allocated before handing them. A poll is never cancelled,
+// the server may have claimed jobs for it already; the jobs claimed while the worker is shutting
+// down are returned to the server.
+func puller(tasks chan<- task, t *tracker, pool *gpuPool, r *registration, closing <-chan struct{}, wait time.Duration, host string, token string) {
+	var backoff time.Duration
 
 	for {
 		select {
 		case <-closing:
 			return
-		case <-t.C:
-			// all workers are being used
-			if len(tasks) == cap(tasks) {
-				continue
+		default:
+		}
+
+		free := t.freeSlots()
+		// all slots busy, cordoned or being drained
+		if free == 0 || r.cordoned() {
+			select {
+			case <-closing:
+				return
+			case <-t.released:
+			case <-time.After(3 * time.Second):
 			}
+			continue
+		}
+
+		gpus := pool.free()
+		pollFor := wait
+		if gpus < pool.size() && busyPollWait < pollFor {
+			pollFor = busyPollWait
+		}
+		claimed, err := pollJobs(context.Background(), host, token, r.workerID(), pollFor, free, gpus)
 
-			job, err := fetchJobs(context.TODO(), host, token)
-			if err != nil {
-				// no job available
-				if errors.Is(err, errNoJob) {
-					continue
-				}
-				log.Printf("error pulling: %v\n", err)
+		select {
+		case <-closing:
+			returnClaimed(host, token, r.workerID(), claimed)
+			return
+		default:
+		}
+
+		if err != nil {
+			// the server may be restarting, wait a bit longer after each failure
+			backoff *= 2
+			if backoff == 0 {
+				backoff = time.Second
+			}
+			if backoff > maxPollBackoff {
+				backoff = maxPollBackoff
+			}
+			log.Printf("error pulling, retrying in %s: %v\n", backoff, err)
+			select {
+			case <-closing:
+				return
+			case <-time.After(backoff):
+			}
+			continue
+		}
+		backoff = 0
+
+		for i, job := range claimed {
+			gpus, ok := pool.allocate(job.ID, job.GPUs)
+			if !ok {
+				// only an older server gives jobs that do not fit
+				log.Printf("job %s needs %d GPUs and only %d are free\n", job.ID, job.GPUs, pool.free())
+				returnClaimed(host, token, r.workerID(), claimed[i:i+1])
 				continue
 			}
 
-			tasks <- job
-
-			break
+			t.claimSlot()
+			select {
+			case tasks <- task{job: job, gpus: gpus}:
+			case <-closing:
+				t.releaseSlot()
+				pool.release(job.ID)
+				returnClaimed(host, token, r.workerID(), claimed[i:])
+				return
+			}
 		}
 	}
 }
 
-func (w *worker) run(ctx context.Context, j jobs.Job) error {
+// returnClaimed hands the claimed jobs that have not started back to the server
+func returnClaimed(host string, token string, workerID uuid.UUID, claimed []jobs.Job) {
+	if len(claimed) == 0 {
+		return
+	}
+
+	ids := make([]uuid.UUID, len(claimed))
+	for i, job := range claimed {
+		ids[i] = job.ID
+	}
+	log.Printf("shutting down, returning %d claimed tasks to the server\n", len(ids))
+
+	err := returnJobs(context.TODO(), host, token, workers.ReturnedJobs{WorkerID: workerID, Jobs: ids})
+	if err != nil {
+		log.Printf("failed to return jobs %v: %v\n", ids, err)
+	}
+}
+
+// runJob runs a claimed job and reports its final status to the server
+func (w *worker) runJob(tk task) {
+	t := tk.job
+	err := w.run(context.TODO(), t, tk.container, tk.gpus)
+	switch {
+	case errors.Is(err, errTimedOut):
+		log.Printf("task %s timed out after %s", t.ID, t.Timeout)
+		t.Status = jobs.TimedOut
+	case errors.Is(err, errCancelled):
+		log.Printf("task %s cancelled", t.ID)
+		t.Status = jobs.Cancelled
+	case errors.Is(err, errPreempted):
+		// the server enqueues it again without counting the attempt
+		log.Printf("task %s preempted, handing it back", t.ID)
+		w.returnJob(t.ID, workers.ReturnPreempted)
+		return
+	case errors.Is(err, errDrained):
+		log.Printf("task %s stopped because the worker is being drained, handing it back", t.ID)
+		w.returnJob(t.ID, workers.ReturnDrained)
+		return
+	case errors.Is(err, errShutdown):
+		log.Printf("task %s stopped because the worker is shutting down, handing it back", t.ID)
+		w.handBack(t.ID)
+		return
+	case err != nil:
+		log.Printf("error running task: %s", err)
+		t.Status = jobs.Failed
+	default:
+		t.Status = jobs.Finished
+	}
+
+	if err := updateJob(context.TODO(), w.host, t, w.token); err != nil {
+		log.Printf("failed to update job %+v status: %v\n", t.ID, err)
+	}
+}
+
+// run runs the job with the given GPUs in a new container, or in the given one if it was already
+// running
+func (w *worker) run(ctx context.Context, j jobs.Job, reattach *JobContainer, gpus []string) (runErr error) {
 	u, err := url.Parse(w.host)
 	if err != nil {
 		return err
@@ -114,23 +295,164 @@ func (w *worker) run(ctx context.Context, j jobs.Job) error {
 	}()
 
 	defer func() {
+		// a requeued job will run again and keep writing to the same log
+		if requeued(runErr) {
+			return
+		}
 		_, _ = logWriter.Write([]byte(jobs.MagicEnd))
 		_, _ = logWriter.Write([]byte{'\n'})
 	}()
 
-	logr.Printf("[%d] worker running task %+v at %s\n", w.id, j, time.Now())
+	stop := w.tracker.add(j.ID)
+	defer w.tracker.remove(j.ID)
+
+	var (
+		containerID string
+		since       time.Time
+	)
+	if reattach == nil {
+		logr.Printf("[%d] worker running task %+v at %s\n", w.id, j, time.Now())
+		switch {
+		case len(gpus) != 0:
+			logr.Printf("[%d] allocated GPUs %v to the job", w.id, gpus)
+		case j.GPUs == 0 && w.pool.size() != 0:
+			logr.Printf("[%d] the job does not set gpus, it runs without GPUs although the worker has %d", w.id, w.pool.size())
+		}
 
-	// la variable reader conté el progrés/log del pull de la imatge.
-	reader, err := w.cli.ImagePull(ctx, j.Docker.Image, types.ImagePullOptions{
-		// pas de registre autenticació amb funció de authCredentials
-		// RegistryAuth: "",
-	})
-	if err != nil {
-		return fmt.Errorf("pulling docker image: %w", err)
+		containerID, err = w.createContainer(ctx, j, gpus, logr, logWriter)
+		if err != nil {
+			return err
+		}
+	} else {
+		containerID = reattach.ID
+		logr.Printf("[%d] worker restarted, reattaching to container %s which is %s", w.id, containerID, reattach.State)
+
+		// the output already uploaded is not sent again
+		since, err = lastLogTime(ctx, w.host, w.token, j.ID)
+		if err != nil {
+			logr.Printf("error getting the last log line, the output may be repeated: %v", err)
+		}
+
+		// the previous worker exited between creating and starting the container
+		if reattach.State.Status == "created" {
+			if err := w.rt.Start(ctx, containerID); err != nil {
+				logr.Printf("error starting container: %v", err)
+				return fmt.Errorf("starting container: %w", err)
+			}
+		}
+	}
+	defer func() {
+		// a requeued job will run again and write its outputs then
+		if !requeued(runErr) {
+			w.collectArtifacts(logr, j, containerID)
+		}
+		if err := w.rt.Remove(context.TODO(), containerID); err != nil {
+			log.Printf("error removing container %s: %v\n", containerID, err)
+		}
+	}()
+
+	if w.statsInterval > 0 {
+		statsCtx, stopStats := context.WithCancel(ctx)
+		defer stopStats()
+		go w.sampleStats(statsCtx, logr, j.ID, containerID)
+	}
+
+	doneLogs := make(chan struct{})
+	go func() {
+		defer close(doneLogs)
+		if err := w.rt.Logs(ctx, containerID, since, logWriter, logWriter); err != nil {
+			logr.Printf("error copying logs to file: %v\n", err)
+		}
+	}()
+
+	var timeout <-chan time.Time
+	if j.Timeout > 0 {
+		remaining := j.Timeout.Std()
+		// a reattached job has been running since before the worker restarted
+		if reattach != nil && j.StartedAt != nil {
+			remaining -= time.Since(*j.StartedAt)
+		}
+		timer := time.NewTimer(remaining)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case s := <-w.rt.Wait(ctx, containerID):
+		if s.Err != nil {
+			logr.Printf("job %s container %s received error: %v", j.ID, containerID, s.Err)
+			if state, err := w.rt.Inspect(ctx, containerID); err == nil {
+				logr.Printf("container %s is %s", containerID, state)
+			}
+			return fmt.Errorf("waiting for container: %w", s.Err)
+		}
+		logr.Printf("container %s stopped with status code = %v\n", containerID, s.Code)
+		if s.Code != 0 {
+			return fmt.Errorf("container exited with status code %d", s.Code)
+		}
+	case <-timeout:
+		logr.Printf("job exceeded its timeout of %s, stopping container %s (grace period %s)", j.Timeout, containerID, w.stopGrace)
+		w.stopContainer(ctx, logr, containerID, w.stopGrace)
+		<-doneLogs
+		logr.Printf("job marked as %s after exceeding its timeout of %s", jobs.TimedOut, j.Timeout)
+		return errTimedOut
+	case <-w.interrupt:
+		grace := w.shutdownGrace()
+		logr.Printf("worker is shutting down, stopping container %s (shutdown policy %s, grace period %s)", containerID, w.shutdown.Policy, grace)
+		w.stopContainer(ctx, logr, containerID, grace)
+		<-doneLogs
+		logr.Printf("job handed back to the server to run again as %s", jobs.Enqueued)
+		return errShutdown
+	case sig := <-stop:
+		grace := w.stopGrace
+		if sig.Grace > 0 {
+			grace = sig.Grace.Std()
+		}
+
+		if sig.Reason == jobs.StopPreempt {
+			logr.Printf("job preempted by the %s, stopping container %s (checkpoint grace period %s)", sig.By, containerID, grace)
+			w.stopContainer(ctx, logr, containerID, grace)
+			<-doneLogs
+			logr.Printf("job preempted, requeueing it as %s (attempt %d)", jobs.Enqueued, j.Attempts)
+			return errPreempted
+		}
+
+		if sig.Reason == jobs.StopDrain {
+			logr.Printf("worker is being drained, stopping container %s (grace period %s)", containerID, grace)
+			w.stopContainer(ctx, logr, containerID, grace)
+			<-doneLogs
+			logr.Printf("job requeued as %s because its worker is being drained", jobs.Enqueued)
+			return errDrained
+		}
+
+		logr.Printf("job cancelled by %s, stopping container %s (grace period %s)", sig.By, containerID, grace)
+		w.stopContainer(ctx, logr, containerID, grace)
+		<-doneLogs
+		logr.Printf("job marked as %s, cancelled by %s", jobs.Cancelled, sig.By)
+		return errCancelled
 	}
 
-	if _, err := io.Copy(logWriter, reader); err != nil {
-		logr.Printf("error copying pull output to log for %v: %v\n", j.ID, err)
+	<-doneLogs
+
+	return nil
+}
+
+// createContainer pulls the image of the job and creates and starts its container with the GPUs
+func (w *worker) createContainer(ctx context.Context, j jobs.Job, gpus []string, logr *log.Logger, logWriter io.Writer) (string, error) {
+	if err := checkMounts(w.mounts, j.Queue, j.Docker.Mounts); err != nil {
+		logr.Printf("refusing to run the job, it asks for a mount that this worker does not allow: %v", err)
+		return "", fmt.Errorf("checking mounts: %w", err)
+	}
+
+	pull, err := w.rt.Pull(ctx, j.Docker.Image, j.Docker.Pull(), logWriter)
+	if err != nil {
+		logr.Printf("error pulling image %s: %v", j.Docker.Image, err)
+		return "", fmt.Errorf("pulling docker image: %w", err)
+	}
+	if pull != nil {
+		if err := uploadPull(ctx, w.host, w.token, j.ID, *pull); err != nil {
+			log.Printf("error storing the pull of job %s: %v\n", j.ID, err)
+		}
 	}
 
 	logr.Printf("starting task at %s", time.Now())
@@ -138,7 +460,7 @@ func (w *worker) run(ctx context.Context, j jobs.Job) error {
 		j.Docker.Environment = make(map[string]interface{})
 	}
 	// establir variables d'entorn que també volem guardar a la base de dades
-	j.Docker.Environment["SKEDULER_GPUS"] = fmt.Sprintf("%s", w.gpus)
+	j.Docker.Environment["SKEDULER_GPUS"] = fmt.Sprintf("%s", gpus)
 
 	envNew := make(map[string]interface{})
 	for k, v := range j.Docker.Environment {
@@ -150,105 +472,58 @@ func (w *worker) run(ctx context.Context, j jobs.Job) error {
 	envNew["SKEDULER_NAME"] = j.Name
 	envNew["SKEDULER_DESCRIPTION"] = j.Description
 	envNew["SKEDULER_DOCKER_IMAGE"] = j.Docker.Image
-	envNew["SKEDULER_DOCKER_COMMAND"] = j.Docker.Command
+	envNew["SKEDULER_DOCKER_COMMAND"] = j.Docker.CommandString()
 
 	var env []string
-	for k, v := range j.Docker.Environment {
+	for k, v := range envNew {
 		env = append(env, fmt.Sprintf("%s=%v", k, v))
 	}
+	sort.Strings(env)
 
-	cmd := strings.Split(j.Docker.Command, " ")
-	containerConfig := &container.Config{
-		Image:    j.Docker.Image,
-		Cmd:      cmd,
-		Hostname: fmt.Sprintf("exp_%.8s", j.ID.String()),
-		Env:      env,
-	}
-
-	hostConfig := &container.HostConfig{
-		AutoRemove: true,
-		Resources:  container.Resources{
-			// CPUCount: 2,
-			// Memory:   1024 * 1024 * 256, // 256mb
-		},
-	}
-
-	if len(w.gpus) != 0 {
-		hostConfig.Resources.DeviceRequests = []container.DeviceRequest{
-			{
-				Driver:       "nvidia",
-				DeviceIDs:    w.gpus, // especificar que es vol utilitzar la GPU 0, també podria ser "all"
-				Capabilities: [][]string{{"compute", "utility"}},
-			},
-		}
+	cmd, err := j.Docker.Argv()
+	if err != nil {
+		logr.Printf("invalid command: %v", err)
+		return "", fmt.Errorf("parsing command: %w", err)
 	}
 
-	resp, err := w.cli.ContainerCreate(ctx, containerConfig, hostConfig, nil, nil, "")
+	containerID, warnings, err := w.rt.Create(ctx, RunSpec{
+		JobID:      j.ID,
+		Worker:     w.name,
+		Image:      j.Docker.Image,
+		PullPolicy: j.Docker.Pull(),
+		Cmd:        cmd,
+		Entrypoint: j.Docker.Entrypoint,
+		Env:        env,
+		Hostname:   fmt.Sprintf("exp_%.8s", j.ID.String()),
+		Workdir:    j.Docker.Workdir,
+		User:       j.Docker.User,
+		GPUs:       gpus,
+		Resources:  j.Docker.Resources,
+		Mounts:     j.Docker.Mounts,
+	})
 	if err != nil {
 		logr.Printf("error creating container: %v", err)
-		return fmt.Errorf("creating container: %w", err)
+		return "", fmt.Errorf("creating container: %w", err)
 	}
-	for _, warning := range resp.Warnings {
+	for _, warning := range warnings {
 		logr.Printf("container create warning: %v", warning)
 	}
-	containerID := resp.ID
 
-	if err := w.cli.ContainerStart(ctx, containerID, types.ContainerStartOptions{}); err != nil {
+	if err := w.rt.Start(ctx, containerID); err != nil {
 		logr.Printf("error starting container: %v", err)
-		return fmt.Errorf("starting container: %w", err)
-	}
-
-	containerLogs, err := w.cli.ContainerLogs(ctx, containerID, types.ContainerLogsOptions{
-		ShowStdout: true,
-		ShowStderr: true,
-		Timestamps: true,
-		Follow:     true,
-		Tail:       "all",
-		Details:    true,
-	})
-	if err != nil {
-		_ = w.cli.ContainerStop(ctx, containerID, nil)
-		logr.Printf("error getting container logs, stopping container: %v", err)
-		return fmt.Errorf("getting logs: %w", err)
-	}
-	defer containerLogs.Close()
-
-	doneLogs := make(chan struct{}, 1)
-	go func() {
-		_, err := stdcopy.StdCopy(logWriter, logWriter, containerLogs)
-		if err != nil {
-			logr.Printf("error copying logs to file: %v\n", err)
-			return
-		}
-		doneLogs <- struct{}{}
-	}()
-
-	statusCh, errCh := w.cli.ContainerWait(ctx, containerID, container.WaitConditionNotRunning)
-	select {
-	case err := <-errCh:
-		if err != nil {
-			logr.Printf("container %s received error: %v", j.ID, containerID, err)
+		// otherwise reattach would start it after the worker restarts
+		if err := w.rt.Remove(context.TODO(), containerID); err != nil {
+			log.Printf("error removing container %s: %v\n", containerID, err)
 		}
-	case s := <-statusCh:
-		logr.Printf("container %s stopped with status code = %v and error = %v\n", containerID, s.StatusCode, s.Error)
-		break
+		return "", fmt.Errorf("starting container: %w", err)
 	}
 
-	<-doneLogs
-
-	return nil
+	return containerID, nil
 }
 
-func authCredentials(username, password string) (string, error) {
-	authConfig := types.AuthConfig{
-		Username: username,
-		Password: password,
+// stopContainer stops the container, which is killed if it is still running after the grace period
+func (w *worker) stopContainer(ctx context.Context, logr *log.Logger, containerID string, grace time.Duration) {
+	if err := w.rt.Stop(ctx, containerID, grace); err != nil {
+		logr.Printf("error stopping container %s: %v", containerID, err)
 	}
-
-	encodedJSON, err := json.Marshal(authConfig)
-	if err != nil {
-		return "", fmt.Errorf("marshaling authconfig to json: %w", err)
-	}
-
-	return base64.URLEncoding.EncodeToString(encodedJSON), nil
 }
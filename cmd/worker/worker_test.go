@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/lifecycle"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/workers"
+)
+
+// testWorkerName is the name of the worker in the tests, the fake runtime lists its containers by it
+const testWorkerName = "test"
+
+// testServer implements the endpoints of the server used by a slot and the puller: the log
+// upload, the job lookup of reattach, the pull stats, the poll and the returned jobs
+type testServer struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	logs map[uuid.UUID]*bytes.Buffer
+	jobs map[uuid.UUID]jobs.Job
+	// returned are the jobs handed back through /workers/return
+	returned []workers.ReturnedJobs
+	// pending are given to the next poll after pollDelay, polls receives a value when a poll arrives
+	pending   []jobs.Job
+	pollDelay time.Duration
+	polls     chan struct{}
+}
+
+func newTestServer(t *testing.T) *testServer {
+	s := &testServer{
+		logs:  make(map[uuid.UUID]*bytes.Buffer),
+		jobs:  make(map[uuid.UUID]jobs.Job),
+		polls: make(chan struct{}, 1),
+	}
+
+	upgrader := websocket.Upgrader{}
+	r := mux.NewRouter()
+	r.HandleFunc("/logs/{id}/upload", func(w http.ResponseWriter, r *http.Request) {
+		id := uuid.FromStringOrNil(mux.Vars(r)["id"])
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			if s.logs[id] == nil {
+				s.logs[id] = &bytes.Buffer{}
+			}
+			s.logs[id].Write(msg)
+			s.mu.Unlock()
+		}
+	})
+	r.HandleFunc("/logs/{id}", func(w http.ResponseWriter, r *http.Request) {
+		log := s.log(uuid.FromStringOrNil(mux.Vars(r)["id"]))
+		if log == "" {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		_, _ = w.Write([]byte(log))
+	}).Methods("GET")
+	r.HandleFunc("/experiments/{id}", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		job, ok := s.jobs[uuid.FromStringOrNil(mux.Vars(r)["id"])]
+		s.mu.Unlock()
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(job)
+	}).Methods("GET")
+	r.HandleFunc("/experiments/{id}/pull", func(w http.ResponseWriter, r *http.Request) {}).Methods("POST")
+	r.HandleFunc("/workers/poll", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case s.polls <- struct{}{}:
+		default:
+		}
+
+		s.mu.Lock()
+		delay := s.pollDelay
+		s.mu.Unlock()
+		time.Sleep(delay)
+
+		s.mu.Lock()
+		claimed := s.pending
+		s.pending = nil
+		s.mu.Unlock()
+		if len(claimed) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(claimed)
+	}).Methods("GET")
+	r.HandleFunc("/workers/return", func(w http.ResponseWriter, r *http.Request) {
+		var returned workers.ReturnedJobs
+		if err := json.NewDecoder(r.Body).Decode(&returned); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		s.returned = append(s.returned, returned)
+		s.mu.Unlock()
+	}).Methods("POST")
+
+	s.Server = httptest.NewServer(r)
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *testServer) log(id uuid.UUID) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.logs[id] == nil {
+		return ""
+	}
+	return s.logs[id].String()
+}
+
+// waitLog waits until the log of the job contains text
+func (s *testServer) waitLog(t *testing.T, id uuid.UUID, text string) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !strings.Contains(s.log(id), text) {
+		if time.Now().After(deadline) {
+			t.Fatalf("log of job %s does not contain %q:\n%s", id, text, s.log(id))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// newTestWorker returns a slot running the containers in a fake runtime with the given scripts
+func newTestWorker(t *testing.T, scripts map[string]fakeScript) (*worker, *fakeRuntime, *testServer) {
+	srv := newTestServer(t)
+	rt := newFakeRuntime(scripts)
+	workerID := uuid.Must(uuid.NewV4())
+
+	w := &worker{
+		name:      testWorkerName,
+		rt:        rt,
+		closing:   make(chan struct{}),
+		lc:        lifecycle.New(0),
+		shutdown:  shutdownConfig{Policy: shutdownWait},
+		workerID:  func() uuid.UUID { return workerID },
+		pool:      newGPUPool([]string{"0", "1"}),
+		token:     "test",
+		host:      srv.URL,
+		tracker:   newTracker(1),
+		stopGrace: time.Second,
+	}
+	return w, rt, srv
+}
+
+func testJob() jobs.Job {
+	return jobs.Job{
+		ID:     uuid.Must(uuid.NewV4()),
+		Name:   "test",
+		Status: jobs.Running,
+		Docker: jobs.Docker{Image: "train:1", Command: "python train.py"},
+	}
+}
+
+// waitRunning waits until the slot is running the job, so that it can receive stop signals
+func waitRunning(t *testing.T, tr *tracker, id uuid.UUID) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		for _, running := range tr.ids() {
+			if running == id {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("job %s did not start", id)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// runAsync runs the job in the slot and returns the error of run once it ends
+func runAsync(w *worker, j jobs.Job) <-chan error {
+	res := make(chan error, 1)
+	go func() {
+		res <- w.run(context.Background(), j, nil, nil)
+	}()
+	return res
+}
+
+func waitRun(t *testing.T, res <-chan error) error {
+	t.Helper()
+
+	select {
+	case err := <-res:
+		return err
+	case <-time.After(10 * time.Second):
+		t.Fatal("run did not return")
+		return nil
+	}
+}
+
+func TestRunFinishes(t *testing.T) {
+	w, rt, srv := newTestWorker(t, map[string]fakeScript{
+		fakeAnyImage: {Output: []string{"epoch 1", "epoch 2"}, Duration: 200 * time.Millisecond},
+	})
+	j := testJob()
+
+	if err := w.run(context.Background(), j, nil, []string{"1"}); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+
+	srv.waitLog(t, j.ID, "epoch 2")
+	srv.waitLog(t, j.ID, jobs.MagicEnd)
+	if len(rt.containers) != 0 {
+		t.Errorf("the container was not removed: %v", rt.containers)
+	}
+}
+
+func TestRunFailsWithExitCode(t *testing.T) {
+	w, _, _ := newTestWorker(t, map[string]fakeScript{
+		fakeAnyImage: {Duration: 50 * time.Millisecond, ExitCode: 2},
+	})
+
+	err := w.run(context.Background(), testJob(), nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "status code 2") {
+		t.Fatalf("run returned %v, want the exit code", err)
+	}
+	if requeued(err) {
+		t.Errorf("a failed job must not be requeued by the worker")
+	}
+}
+
+func TestRunRemovesUnstartedContainer(t *testing.T) {
+	w, rt, _ := newTestWorker(t, map[string]fakeScript{
+		fakeAnyImage: {StartError: "no such device"},
+	})
+
+	if err := w.run(context.Background(), testJob(), nil, nil); err == nil || !strings.Contains(err.Error(), "no such device") {
+		t.Fatalf("run returned %v, want the start error", err)
+	}
+	if len(rt.containers) != 0 {
+		t.Errorf("the container that failed to start was not removed: %v", rt.containers)
+	}
+}
+
+func TestRunTimeout(t *testing.T) {
+	w, rt, srv := newTestWorker(t, map[string]fakeScript{
+		fakeAnyImage: {Output: []string{"epoch 1"}, Duration: time.Minute},
+	})
+	j := testJob()
+	j.Timeout = jobs.Duration(200 * time.Millisecond)
+
+	start := time.Now()
+	err := w.run(context.Background(), j, nil, nil)
+	if !errors.Is(err, errTimedOut) {
+		t.Fatalf("run returned %v, want %v", err, errTimedOut)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the job was stopped after %s", elapsed)
+	}
+
+	srv.waitLog(t, j.ID, "exceeded its timeout")
+	srv.waitLog(t, j.ID, jobs.MagicEnd)
+	if len(rt.containers) != 0 {
+		t.Errorf("the container was not removed: %v", rt.containers)
+	}
+}
+
+func TestRunCancel(t *testing.T) {
+	w, _, srv := newTestWorker(t, map[string]fakeScript{
+		fakeAnyImage: {Duration: time.Minute},
+	})
+	j := testJob()
+
+	res := runAsync(w, j)
+	waitRunning(t, w.tracker, j.ID)
+	w.tracker.signal(jobs.StopSignal{ID: j.ID, Reason: jobs.StopCancel, By: "alice"})
+
+	if err := waitRun(t, res); !errors.Is(err, errCancelled) {
+		t.Fatalf("run returned %v, want %v", err, errCancelled)
+	}
+	srv.waitLog(t, j.ID, "cancelled by alice")
+	srv.waitLog(t, j.ID, jobs.MagicEnd)
+}
+
+func TestRunPreempt(t *testing.T) {
+	// the job ignores SIGTERM, so it is killed once the checkpoint grace period ends
+	w, _, srv := newTestWorker(t, map[string]fakeScript{
+		fakeAnyImage: {Duration: time.Minute, IgnoreStop: true},
+	})
+	j := testJob()
+
+	res := runAsync(w, j)
+	waitRunning(t, w.tracker, j.ID)
+	start := time.Now()
+	w.tracker.signal(jobs.StopSignal{ID: j.ID, Reason: jobs.StopPreempt, By: "preemption policy", Grace: jobs.Duration(100 * time.Millisecond)})
+
+	err := waitRun(t, res)
+	if !errors.Is(err, errPreempted) || !requeued(err) {
+		t.Fatalf("run returned %v, want %v", err, errPreempted)
+	}
+	if elapsed := time.Since(start); elapsed > w.stopGrace {
+		t.Errorf("the grace period of the signal was not used, the job took %s to stop", elapsed)
+	}
+
+	srv.waitLog(t, j.ID, "requeueing it")
+	// the job runs again and keeps writing to the same log
+	if strings.Contains(srv.log(j.ID), jobs.MagicEnd) {
+		t.Errorf("the log of a preempted job was closed")
+	}
+}
+
+func TestRunJobReturnsPreempted(t *testing.T) {
+	w, _, srv := newTestWorker(t, map[string]fakeScript{
+		fakeAnyImage: {Duration: time.Minute},
+	})
+	j := testJob()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.runJob(task{job: j})
+	}()
+	waitRunning(t, w.tracker, j.ID)
+	w.tracker.signal(jobs.StopSignal{ID: j.ID, Reason: jobs.StopPreempt, By: "preemption policy", Grace: jobs.Duration(100 * time.Millisecond)})
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("runJob did not return")
+	}
+
+	// the server enqueues it again, checking that the job is still running in this worker
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.returned) != 1 || len(srv.returned[0].Jobs) != 1 || srv.returned[0].Jobs[0] != j.ID ||
+		srv.returned[0].WorkerID != w.workerID() || srv.returned[0].Reason != workers.ReturnPreempted {
+		t.Fatalf("returned %+v, want job %s preempted in worker %s", srv.returned, j.ID, w.workerID())
+	}
+}
+
+func TestRunGPUs(t *testing.T) {
+	w, _, srv := newTestWorker(t, map[string]fakeScript{
+		fakeAnyImage: {Duration: 500 * time.Millisecond},
+	})
+	reqs := make(chan task)
+	closing := make(chan struct{})
+	w.reqs, w.closing = reqs, closing
+	go w.start()
+	defer close(closing)
+
+	// with the pool, a job that does not set gpus runs without GPUs and is told so
+	j := testJob()
+	w.tracker.claimSlot()
+	reqs <- task{job: j}
+	srv.waitLog(t, j.ID, "does not set gpus")
+	srv.waitLog(t, j.ID, jobs.MagicEnd)
+
+	// with the old configuration, it gets the GPUs of the queue of the slot while it runs
+	w.legacyGPUs = []string{"1"}
+	j = testJob()
+	w.tracker.claimSlot()
+	reqs <- task{job: j}
+	deadline := time.Now().Add(5 * time.Second)
+	for w.pool.free() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d GPUs are free while the legacy job runs, want 1", w.pool.free())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	srv.waitLog(t, j.ID, "allocated GPUs [1]")
+	srv.waitLog(t, j.ID, jobs.MagicEnd)
+}
+
+func TestPullerReturnsJobsClaimedWhileClosing(t *testing.T) {
+	w, _, srv := newTestWorker(t, nil)
+	j := testJob()
+	srv.pending = []jobs.Job{j}
+	srv.pollDelay = 200 * time.Millisecond
+
+	closing := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		puller(make(chan task), w.tracker, w.pool, &registration{id: w.workerID()}, closing, time.Second, srv.URL, w.token)
+	}()
+
+	// the worker shuts down while the server is claiming the job, which must not be lost
+	<-srv.polls
+	close(closing)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the puller did not return")
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if len(srv.returned) != 1 || len(srv.returned[0].Jobs) != 1 || srv.returned[0].Jobs[0] != j.ID {
+		t.Fatalf("returned %+v, want job %s", srv.returned, j.ID)
+	}
+}
+
+func TestReattach(t *testing.T) {
+	w, rt, srv := newTestWorker(t, map[string]fakeScript{
+		fakeAnyImage: {Output: []string{"epoch 1", "epoch 2"}, Duration: 300 * time.Millisecond},
+	})
+	ctx := context.Background()
+
+	// a job still running, one that finished while the worker was down and one that was requeued
+	// and is now running on another worker
+	workerID, otherWorker := w.workerID(), uuid.Must(uuid.NewV4())
+	running, finished, moved := testJob(), testJob(), testJob()
+	running.Worker = &workerID
+	finished.Status = jobs.Finished
+	moved.Worker = &otherWorker
+	srv.jobs[running.ID] = running
+	srv.jobs[finished.ID] = finished
+	srv.jobs[moved.ID] = moved
+
+	// the running job has an older container left from a previous attempt
+	var ids []string
+	for _, j := range []jobs.Job{running, finished, moved, running} {
+		id, _, err := rt.Create(ctx, RunSpec{JobID: j.ID, Worker: testWorkerName, Image: j.Docker.Image, GPUs: []string{"1"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := rt.Start(ctx, id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+		time.Sleep(time.Millisecond)
+	}
+
+	tasks := make(chan task, 4)
+	reattach(rt, testWorkerName, workerID, w.tracker, w.pool, tasks, w.closing, time.Second, w.host, w.token)
+	close(tasks)
+
+	var reattached []task
+	for tk := range tasks {
+		reattached = append(reattached, tk)
+	}
+	if len(reattached) != 1 || reattached[0].job.ID != running.ID || reattached[0].container.ID != ids[3] {
+		t.Fatalf("reattached %+v, want job %s in container %s", reattached, running.ID, ids[3])
+	}
+	for i, what := range []string{"the older container of the running job", "the container of the finished job", "the container of the job running on another worker"} {
+		if _, err := rt.container(ids[i]); err == nil {
+			t.Errorf("%s was not removed", what)
+		}
+	}
+	if free := w.pool.free(); free != 1 {
+		t.Errorf("%d GPUs are free, the one of the reattached job must be reserved", free)
+	}
+
+	tk := reattached[0]
+	if err := w.run(ctx, tk.job, tk.container, tk.gpus); err != nil {
+		t.Fatalf("run failed: %v", err)
+	}
+	srv.waitLog(t, running.ID, "reattaching to container "+ids[3])
+	srv.waitLog(t, running.ID, "epoch 2")
+	srv.waitLog(t, running.ID, jobs.MagicEnd)
+}
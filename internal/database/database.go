@@ -2,29 +2,121 @@ package database
 
 import (
 	"context"
+	"errors"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/workers"
 )
 
 type Database interface {
-	// FetchJob gets a job and updates its status to "RUNNING"
-	FetchJob(context.Context) (*jobs.Job, error)
+	// FetchJob gets the enqueued job with the highest priority that does not exceed any limit and
+	// updates its status to "RUNNING". The skipped jobs get their blocked reason updated.
+	FetchJob(context.Context, FetchParams) (*jobs.Job, error)
+	// UpdateBlockedReasons checks every enqueued job against the limits, setting the blocked reason
+	// of the ones that exceed a limit and clearing it for the ones that do not anymore
+	UpdateBlockedReasons(context.Context, []Limit) error
 
 	GetAll(ctx context.Context) ([]jobs.Job, error)
+	// GetByStatus returns the jobs with the given status, sorted by priority and age
+	GetByStatus(context.Context, jobs.JobStatus) ([]jobs.Job, error)
 	GetById(context.Context, uuid.UUID) (*jobs.Job, error)
 
 	Insert(context.Context, InsertParams) (*jobs.Job, error)
+	// InsertIdempotent inserts a job only once per idempotency key. Replaying a key returns the
+	// original job and true, or ErrIdempotencyMismatch if the request was different.
+	InsertIdempotent(context.Context, IdempotencyKey, InsertParams) (*jobs.Job, bool, error)
 	Update(context.Context, UpdateParams) (*jobs.Job, error)
 
+	// Cancel cancels an "ENQUEUED" or "HELD" job or asks the worker of a "RUNNING" job to stop it. Returns nil
+	// if the job does not exist or cannot be cancelled anymore
+	Cancel(ctx context.Context, id uuid.UUID, by string) (*jobs.Job, error)
+	// Hold moves the "ENQUEUED" jobs matching the filter to "HELD", so that they are not fetched
+	Hold(context.Context, JobFilter) ([]jobs.Job, error)
+	// Release moves the "HELD" jobs matching the filter back to "ENQUEUED"
+	Release(context.Context, JobFilter) ([]jobs.Job, error)
+
+	// ExpireJobs marks as "EXPIRED" the enqueued and held jobs past their expiration date, moving
+	// them to the dead-letter list, and returns them
+	ExpireJobs(context.Context) ([]jobs.Job, error)
+	// DeadLetters returns the expired jobs and the failed jobs that exhausted their retries
+	DeadLetters(context.Context) ([]jobs.Job, error)
+	// Requeue moves the dead-lettered jobs matching the filter back to "ENQUEUED", resetting their
+	// attempts and expiration date
+	Requeue(context.Context, JobFilter) ([]jobs.Job, error)
+
+	// ReturnJobs moves back to "ENQUEUED" the given "RUNNING" jobs of the worker, which it claimed
+	// but never started or stopped to be run again (shutdown, preemption, drain), undoing their
+	// attempt. The jobs of other workers are left untouched.
+	ReturnJobs(ctx context.Context, worker uuid.UUID, ids []uuid.UUID) ([]jobs.Job, error)
+
+	// RequestStop asks the worker of a "RUNNING" job to stop it. Returns nil if the job is not
+	// running or has already been asked to stop
+	RequestStop(ctx context.Context, id uuid.UUID, reason jobs.StopReason) (*jobs.Job, error)
+	// StopRequests returns the jobs from the given ones that have been asked to stop
+	StopRequests(ctx context.Context, ids []uuid.UUID) ([]jobs.Job, error)
+
+	// AddStats stores resource usage samples of a job and adds them to its usage summary. Returns
+	// nil if the job does not exist
+	AddStats(ctx context.Context, id uuid.UUID, samples []jobs.StatsSample) (*jobs.Job, error)
+	// GetStats returns the resource usage samples of a job sorted by time
+	GetStats(ctx context.Context, id uuid.UUID) ([]jobs.StatsSample, error)
+	// SetPull stores how the worker got the image of a job. Returns nil if the job does not exist
+	SetPull(ctx context.Context, id uuid.UUID, pull jobs.PullInfo) (*jobs.Job, error)
+
+	// TimeoutJobs marks as "TIMED_OUT" the running jobs that have exceeded their timeout
+	// by more than grace, and returns them
+	TimeoutJobs(ctx context.Context, grace time.Duration) ([]jobs.Job, error)
+
+	// RegisterWorker adds a worker, or replaces the one with the same name, and marks it as online
+	RegisterWorker(context.Context, workers.Registration) (*workers.Worker, error)
+	// WorkerHeartbeat records the state reported by a worker and marks it as online. Returns nil if
+	// the worker is not registered
+	WorkerHeartbeat(ctx context.Context, id uuid.UUID, hb workers.Heartbeat) (*workers.Worker, error)
+	GetWorkers(context.Context) ([]workers.Worker, error)
+	// GetWorker returns nil if the worker is not registered
+	GetWorker(context.Context, uuid.UUID) (*workers.Worker, error)
+	// CordonWorker sets whether the worker can be given new jobs and how it is being drained.
+	// Returns nil if the worker is not registered
+	CordonWorker(ctx context.Context, id uuid.UUID, cordoned bool, drain workers.DrainMode) (*workers.Worker, error)
+	// MarkWorkersOffline marks as "OFFLINE" the online workers that have not been seen for longer
+	// than after, and returns them
+	MarkWorkersOffline(ctx context.Context, after time.Duration) ([]workers.Worker, error)
+
 	Close() error
 }
 
+// ErrIdempotencyMismatch is returned when an idempotency key is reused with a different request
+var ErrIdempotencyMismatch = errors.New("idempotency key already used with a different request")
+
+// IdempotencyKey identifies a request that must not be applied more than once
+type IdempotencyKey struct {
+	Key string
+	// RequestHash is used to detect that a key is reused with a different request
+	RequestHash string
+	// TTL is how long keys are remembered
+	TTL time.Duration
+}
+
 type InsertParams struct {
-	Name        string      `json:"name"`
-	Description string      `json:"description"`
-	Docker      jobs.Docker `json:"docker"`
-	Metadata    interface{} `json:"metadata"`
+	Name        string        `json:"name"`
+	Description string        `json:"description"`
+	Docker      jobs.Docker   `json:"docker"`
+	Metadata    interface{}   `json:"metadata"`
+	Queue       string        `json:"queue"`
+	Timeout     jobs.Duration `json:"timeout"`
+	Priority    int           `json:"priority"`
+	Preemptible bool          `json:"preemptible"`
+	User        string        `json:"user"`
+	Tags        []string      `json:"tags"`
+	GPUs        int           `json:"gpus"`
+	// ExpiresAt has precedence over MaxQueueTime
+	ExpiresAt    *time.Time    `json:"expires_at"`
+	MaxQueueTime jobs.Duration `json:"max_queue_time"`
+	MaxRetries   int           `json:"max_retries"`
+	// Hold enqueues the job as "HELD", it won't start until it is released
+	Hold bool `json:"hold"`
 }
 
 type UpdateParams struct {
@@ -34,3 +126,16 @@ type UpdateParams struct {
 	Metadata    interface{}    `json:"metadata"`
 	Status      jobs.JobStatus `json:"status"`
 }
+
+// JobFilter selects the jobs affected by a bulk operation. Empty fields match every job, but at
+// least one of them has to be set.
+type JobFilter struct {
+	IDs        []uuid.UUID `json:"ids"`
+	Queue      string      `json:"queue"`
+	NamePrefix string      `json:"name_prefix"`
+}
+
+// Empty returns true when the filter would match every job
+func (f JobFilter) Empty() bool {
+	return len(f.IDs) == 0 && f.Queue == "" && f.NamePrefix == ""
+}
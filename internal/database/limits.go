@@ -0,0 +1,102 @@
+package database
+
+import (
+	"fmt"
+
+	"github.com/gofrs/uuid"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+)
+
+// EachUser makes a Limit apply to every user separately
+const EachUser = "*"
+
+// Limit restricts how many jobs (or GPUs) matching it can be running at the same time. A job that
+// would exceed a limit stays enqueued with its blocked reason set.
+type Limit struct {
+	Name string `yaml:"name" json:"name"`
+	// Tag makes the limit apply only to the jobs with the given tag
+	Tag string `yaml:"tag" json:"tag"`
+	// User makes the limit apply only to the jobs of the given user, or to each user separately
+	// when it is EachUser
+	User string `yaml:"user" json:"user"`
+	// MaxJobs is the maximum number of running jobs, zero means no limit
+	MaxJobs int `yaml:"max_jobs" json:"max_jobs"`
+	// MaxGPUs is the maximum number of GPUs used by the running jobs, zero means no limit
+	MaxGPUs int `yaml:"max_gpus" json:"max_gpus"`
+}
+
+// fetchCandidates is how many enqueued jobs are read at a time to be checked against the limits
+const fetchCandidates = 100
+
+// FetchParams are the conditions a job has to meet to be fetched
+type FetchParams struct {
+	Limits []Limit
+	// MaxGPUs skips the jobs that need more GPUs, the ones the worker has free. Nil does not check
+	// it, for the workers that do not report their GPUs.
+	MaxGPUs *int
+	// Worker is the worker claiming the job, stored in it so that the worker can tell its own jobs
+	// apart after restarting. uuid.Nil for the clients that do not send it.
+	Worker uuid.UUID
+}
+
+// worker returns the worker of the claimed job, NULL if it is not known
+func (p FetchParams) worker() interface{} {
+	return nullWorker(p.Worker)
+}
+
+// nullWorker returns the worker as a query parameter, NULL for the workers that did not register
+func nullWorker(id uuid.UUID) interface{} {
+	if id == uuid.Nil {
+		return nil
+	}
+	return id
+}
+
+// matches returns true if job is restricted by the limit. With EachUser, only the jobs of owner
+// are restricted.
+func (l Limit) matches(job jobs.Job, owner string) bool {
+	if l.Tag != "" && !job.HasTag(l.Tag) {
+		return false
+	}
+
+	switch l.User {
+	case "":
+		return true
+	case EachUser:
+		return job.User == owner
+	default:
+		return job.User == l.User
+	}
+}
+
+// blockedReason returns why job cannot start because of the limits, given the jobs that are
+// already running, or an empty string if it can start.
+func blockedReason(limits []Limit, job jobs.Job, running []jobs.Job) string {
+	for _, l := range limits {
+		if !l.matches(job, job.User) {
+			continue
+		}
+
+		count, gpus := 1, job.GPUs
+		for _, r := range running {
+			if l.matches(r, job.User) {
+				count++
+				gpus += r.GPUs
+			}
+		}
+
+		name := l.Name
+		if name == "" {
+			name = fmt.Sprintf("tag=%q user=%q", l.Tag, l.User)
+		}
+
+		if l.MaxJobs > 0 && count > l.MaxJobs {
+			return fmt.Sprintf("limit %s: at most %d running jobs", name, l.MaxJobs)
+		}
+		if l.MaxGPUs > 0 && gpus > l.MaxGPUs {
+			return fmt.Sprintf("limit %s: at most %d GPUs in use", name, l.MaxGPUs)
+		}
+	}
+
+	return ""
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"time"
 
 	"github.com/georgysavva/scany/pgxscan"
 	"github.com/gofrs/uuid"
@@ -12,8 +13,23 @@ import (
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
 	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/workers"
 )
 
+// pgJobColumns are the columns returned by every query that scans into a jobs.Job
+const pgJobColumns = `id, name, description, docker_image AS "docker_embedded.docker_image", docker_command AS "docker_embedded.docker_command",
+		docker_args AS "docker_embedded.docker_args", docker_shell AS "docker_embedded.docker_shell",
+		docker_environment AS "docker_embedded.docker_environment", docker_entrypoint AS "docker_embedded.docker_entrypoint",
+		docker_workdir AS "docker_embedded.docker_workdir", docker_user AS "docker_embedded.docker_user",
+		docker_resources AS "docker_embedded.docker_resources", docker_mounts AS "docker_embedded.docker_mounts",
+		docker_outputs AS "docker_embedded.docker_outputs", docker_pull_policy AS "docker_embedded.docker_pull_policy", created_at, updated_at, status, metadata, queue, timeout, started_at,
+		stop_request, cancelled_by, priority, preemptible, attempts, username, tags, gpus, blocked_reason,
+		expires_at, max_queue_time, max_retries, dead_lettered_at, usage, pull, worker_id`
+
+// pgWorkerColumns are the columns returned by every query that scans into a workers.Worker
+const pgWorkerColumns = `id, name, hostname, version, labels, gpus, cpus, memory, slots, status, cordoned, drain, load, running,
+		free_slots, registered_at, last_seen_at`
+
 type postgresDb struct {
 	db *pgxpool.Pool
 }
@@ -31,7 +47,7 @@ func NewPostgres(ctx context.Context, uri string) (*postgresDb, error) {
 			Name:  "uuid",
 			OID:   pgtype.UUIDOID,
 		})
-		enumType := pgtype.NewEnumType("job_status", []string{"ENQUEUED", "RUNNING", "FINISHED", "CANCELLED"})
+		enumType := pgtype.NewEnumType("job_status", []string{"ENQUEUED", "RUNNING", "FINISHED", "CANCELLED", "TIMED_OUT", "HELD", "FAILED", "EXPIRED"})
 		conn.ConnInfo().RegisterDataType(pgtype.DataType{
 			Value: enumType,
 			Name:  "job_status",
@@ -51,21 +67,136 @@ func NewPostgres(ctx context.Context, uri string) (*postgresDb, error) {
 	return &postgresDb{db: db}, nil
 }
 
-func (p postgresDb) FetchJob(ctx context.Context) (*jobs.Job, error) {
+// pgClaimJob is the SET clause that moves a job to "RUNNING", $2 is the worker claiming it
+const pgClaimJob = `SET status         = 'RUNNING'::job_status,
+		    worker_id      = $2::uuid,
+		    updated_at     = current_timestamp,
+		    started_at     = current_timestamp,
+		    attempts       = attempts + 1,
+		    blocked_reason = ''`
+
+// pgNotExpired is the condition that excludes the expired jobs that have not been reaped yet
+const pgNotExpired = `(expires_at IS NULL OR expires_at > current_timestamp)`
+
+// pgFetchLockKey is the advisory lock held while fetching a job with limits, so that two workers
+// cannot start at the same time the last job allowed by a limit
+const pgFetchLockKey = 0x736b6564
+
+func (p postgresDb) FetchJob(ctx context.Context, params FetchParams) (*jobs.Job, error) {
+	if len(params.Limits) == 0 {
+		return p.fetchFirst(ctx, params.MaxGPUs, params.worker())
+	}
+
+	var job *jobs.Job
+	err := p.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, pgFetchLockKey); err != nil {
+			return fmt.Errorf("taking fetch lock: %w", err)
+		}
+
+		var running []jobs.Job
+		if err := pgxscan.Select(ctx, tx, &running, `SELECT `+pgJobColumns+` FROM jobs WHERE status = 'RUNNING'::job_status`); err != nil {
+			return fmt.Errorf("getting running jobs: %w", err)
+		}
+
+		// the jobs that need more GPUs than the worker has are not blocked, another worker may run them
+		for offset := 0; ; offset += fetchCandidates {
+			var candidates []jobs.Job
+			err := pgxscan.Select(ctx, tx, &candidates, `SELECT `+pgJobColumns+`
+				FROM jobs
+				WHERE status = 'ENQUEUED'::job_status AND `+pgNotExpired+`
+				  AND ($3::int IS NULL OR gpus <= $3::int)
+				ORDER BY priority DESC, created_at, id
+				LIMIT $1 OFFSET $2`, fetchCandidates, offset, params.MaxGPUs)
+			if err != nil {
+				return fmt.Errorf("getting enqueued jobs: %w", err)
+			}
+
+			for _, candidate := range candidates {
+				if reason := blockedReason(params.Limits, candidate, running); reason != "" {
+					if reason == candidate.BlockedReason {
+						continue
+					}
+					if _, err := tx.Exec(ctx, `UPDATE jobs SET blocked_reason = $2 WHERE id = $1`, candidate.ID, reason); err != nil {
+						return fmt.Errorf("updating blocked reason: %w", err)
+					}
+					continue
+				}
+
+				var claimed jobs.Job
+				err := pgxscan.Get(ctx, tx, &claimed, `UPDATE jobs `+pgClaimJob+`
+					WHERE id = $1 AND status = 'ENQUEUED'::job_status
+					RETURNING `+pgJobColumns, candidate.ID, params.worker())
+				if err != nil {
+					// cancelled or held in the meantime
+					if pgxscan.NotFound(err) {
+						continue
+					}
+					return fmt.Errorf("claiming job: %w", err)
+				}
+
+				job = &claimed
+				return nil
+			}
+
+			if len(candidates) < fetchCandidates {
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fetching job: %w", err)
+	}
+
+	return job, nil
+}
+
+func (p postgresDb) UpdateBlockedReasons(ctx context.Context, limits []Limit) error {
+	err := p.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, pgFetchLockKey); err != nil {
+			return fmt.Errorf("taking fetch lock: %w", err)
+		}
+
+		var running []jobs.Job
+		if err := pgxscan.Select(ctx, tx, &running, `SELECT `+pgJobColumns+` FROM jobs WHERE status = 'RUNNING'::job_status`); err != nil {
+			return fmt.Errorf("getting running jobs: %w", err)
+		}
+
+		var enqueued []jobs.Job
+		if err := pgxscan.Select(ctx, tx, &enqueued, `SELECT `+pgJobColumns+` FROM jobs WHERE status = 'ENQUEUED'::job_status`); err != nil {
+			return fmt.Errorf("getting enqueued jobs: %w", err)
+		}
+
+		for _, job := range enqueued {
+			reason := blockedReason(limits, job, running)
+			if reason == job.BlockedReason {
+				continue
+			}
+			if _, err := tx.Exec(ctx, `UPDATE jobs SET blocked_reason = $2 WHERE id = $1`, job.ID, reason); err != nil {
+				return fmt.Errorf("updating blocked reason: %w", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("updating blocked reasons: %w", err)
+	}
+	return nil
+}
+
+// fetchFirst claims for worker the first enqueued job that needs at most maxGPUs, without checking
+// any limit
+func (p postgresDb) fetchFirst(ctx context.Context, maxGPUs *int, worker interface{}) (*jobs.Job, error) {
 	var job jobs.Job
-	err := p.runQuery(ctx, &job, `UPDATE jobs
-		SET status     = 'RUNNING'::job_status,
-		    updated_at = current_timestamp
+	err := p.runQuery(ctx, &job, `UPDATE jobs `+pgClaimJob+`
 		WHERE id = (
 		    SELECT id
 		    FROM jobs
-		    WHERE status = 'ENQUEUED'::job_status
-		    ORDER BY created_at
+		    WHERE status = 'ENQUEUED'::job_status AND `+pgNotExpired+`
+		      AND ($1::int IS NULL OR gpus <= $1::int)
+		    ORDER BY priority DESC, created_at
 		        FOR UPDATE SKIP LOCKED
 		    LIMIT 1)
-		RETURNING id, name, description, docker_image AS "docker_embedded.docker_image", docker_command AS "docker_embedded.docker_command",
-		    docker_environment AS "docker_embedded.docker_environment", created_at, updated_at, status, metadata
-    `)
+		RETURNING `+pgJobColumns, maxGPUs, worker)
 
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
@@ -78,8 +209,7 @@ func (p postgresDb) FetchJob(ctx context.Context) (*jobs.Job, error) {
 }
 
 func (p postgresDb) GetAll(ctx context.Context) ([]jobs.Job, error) {
-	rows, err := p.db.Query(ctx, `SELECT id, name, description, docker_image AS "docker_embedded.docker_image", docker_command AS "docker_embedded.docker_command",
-		    docker_environment AS "docker_embedded.docker_environment", created_at, updated_at, status, metadata FROM jobs ORDER BY updated_at ASC`)
+	rows, err := p.db.Query(ctx, `SELECT `+pgJobColumns+` FROM jobs ORDER BY updated_at ASC`)
 	if err != nil {
 		return nil, fmt.Errorf("running query: %w", err)
 	}
@@ -96,10 +226,16 @@ func (p postgresDb) GetAll(ctx context.Context) ([]jobs.Job, error) {
 	return data, nil
 }
 
+func (p postgresDb) GetByStatus(ctx context.Context, status jobs.JobStatus) ([]jobs.Job, error) {
+	return p.runQueryAll(ctx, `SELECT `+pgJobColumns+`
+		FROM jobs
+		WHERE status = $1::text::job_status
+		ORDER BY priority DESC, created_at`, status)
+}
+
 func (p postgresDb) GetById(ctx context.Context, id uuid.UUID) (*jobs.Job, error) {
 	var job jobs.Job
-	err := p.runQuery(ctx, &job, `SELECT id, name, description, docker_image AS "docker_embedded.docker_image", docker_command AS "docker_embedded.docker_command",
-       docker_environment AS "docker_embedded.docker_environment", created_at, updated_at, status, metadata
+	err := p.runQuery(ctx, &job, `SELECT `+pgJobColumns+`
        FROM jobs
        WHERE id = $1`, id)
 
@@ -114,11 +250,108 @@ func (p postgresDb) GetById(ctx context.Context, id uuid.UUID) (*jobs.Job, error
 }
 
 func (p postgresDb) Insert(ctx context.Context, params InsertParams) (*jobs.Job, error) {
+	return p.insert(ctx, p.db, params)
+}
+
+func (p postgresDb) InsertIdempotent(ctx context.Context, key IdempotencyKey, params InsertParams) (*jobs.Job, bool, error) {
+	var (
+		job      *jobs.Job
+		replayed bool
+	)
+	err := p.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `DELETE FROM idempotency_keys WHERE created_at < current_timestamp - make_interval(secs => $1)`,
+			int64(key.TTL/time.Second))
+		if err != nil {
+			return fmt.Errorf("deleting expired keys: %w", err)
+		}
+
+		// a concurrent request with the same key blocks here until the other transaction finishes
+		tag, err := tx.Exec(ctx, `INSERT INTO idempotency_keys (key, request_hash) VALUES ($1, $2) ON CONFLICT (key) DO NOTHING`,
+			key.Key, key.RequestHash)
+		if err != nil {
+			return fmt.Errorf("inserting idempotency key: %w", err)
+		}
+
+		if tag.RowsAffected() == 0 {
+			var (
+				hash  string
+				jobId uuid.UUID
+			)
+			err := tx.QueryRow(ctx, `SELECT request_hash, job_id FROM idempotency_keys WHERE key = $1`, key.Key).Scan(&hash, &jobId)
+			if err != nil {
+				return fmt.Errorf("getting idempotency key: %w", err)
+			}
+			if hash != key.RequestHash {
+				return ErrIdempotencyMismatch
+			}
+
+			var original jobs.Job
+			if err := pgxscan.Get(ctx, tx, &original, `SELECT `+pgJobColumns+` FROM jobs WHERE id = $1`, jobId); err != nil {
+				return fmt.Errorf("getting original job: %w", err)
+			}
+			job, replayed = &original, true
+			return nil
+		}
+
+		job, err = p.insert(ctx, tx, params)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(ctx, `UPDATE idempotency_keys SET job_id = $2 WHERE key = $1`, key.Key, job.ID); err != nil {
+			return fmt.Errorf("updating idempotency key: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, false, err
+	}
+
+	return job, replayed, nil
+}
+
+func (p postgresDb) insert(ctx context.Context, q pgxscan.Querier, params InsertParams) (*jobs.Job, error) {
 	job := &jobs.Job{}
-	err := p.runQuery(ctx, job, `INSERT INTO jobs (name, description, docker_image, docker_command, docker_environment, metadata) VALUES ($1, $2, $3, $4, $5, $6)
-		RETURNING id, name, description, docker_image AS "docker_embedded.docker_image", docker_command AS "docker_embedded.docker_command",
-       		docker_environment AS "docker_embedded.docker_environment", created_at, updated_at, status, metadata`,
-		params.Name, params.Description, params.Docker.Image, params.Docker.Command, params.Docker.Environment, params.Metadata)
+	status := jobs.Enqueued
+	if params.Hold {
+		status = jobs.Held
+	}
+
+	tags := params.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+
+	entrypoint := params.Docker.Entrypoint
+	if entrypoint == nil {
+		entrypoint = []string{}
+	}
+	args := params.Docker.Args
+	if args == nil {
+		args = []string{}
+	}
+	mounts := params.Docker.Mounts
+	if mounts == nil {
+		mounts = []jobs.Mount{}
+	}
+	outputs := params.Docker.Outputs
+	if outputs == nil {
+		outputs = []string{}
+	}
+
+	err := pgxscan.Get(ctx, q, job, `INSERT INTO jobs (name, description, docker_image, docker_command, docker_environment, metadata, queue, timeout, status,
+			priority, preemptible, username, tags, gpus, expires_at, max_queue_time, max_retries,
+			docker_entrypoint, docker_workdir, docker_user, docker_resources, docker_args, docker_shell, docker_mounts, docker_outputs,
+			docker_pull_policy)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9::text::job_status, $10, $11, $12, $13, $14,
+			COALESCE($15::timestamptz, CASE WHEN $16::integer > 0 THEN current_timestamp + make_interval(secs => $16::integer) END), $16::integer, $17,
+			$18, $19, $20, $21, $22, $23, $24, $25, $26)
+		RETURNING `+pgJobColumns,
+		params.Name, params.Description, params.Docker.Image, params.Docker.Command, params.Docker.Environment, params.Metadata,
+		params.Queue, params.Timeout.Seconds(), status, params.Priority, params.Preemptible, params.User, tags, params.GPUs,
+		params.ExpiresAt, params.MaxQueueTime.Seconds(), params.MaxRetries,
+		entrypoint, params.Docker.Workdir, params.Docker.User, params.Docker.Resources, args, params.Docker.Shell, mounts, outputs,
+		string(params.Docker.PullPolicy))
 
 	if err != nil {
 		return nil, fmt.Errorf("inserting job: %w", err)
@@ -127,13 +360,19 @@ func (p postgresDb) Insert(ctx context.Context, params InsertParams) (*jobs.Job,
 	return job, nil
 }
 
+// Update changes the given fields of a job. A job reported as "FAILED" is requeued if it has
+// retries left, or dead-lettered otherwise.
 func (p postgresDb) Update(ctx context.Context, params UpdateParams) (*jobs.Job, error) {
 	job := &jobs.Job{}
 	err := p.runQuery(ctx, job, `UPDATE jobs
-		SET name = COALESCE(NULLIF($2, ''), name), description = COALESCE(NULLIF($3, ''), description), updated_at = current_timestamp, status = COALESCE(NULLIF($4::text, '')::job_status, status), metadata = COALESCE($5, metadata)
+		SET name = COALESCE(NULLIF($2, ''), name), description = COALESCE(NULLIF($3, ''), description), updated_at = current_timestamp, metadata = COALESCE($5, metadata),
+		    status = CASE
+		        WHEN $4::text = 'FAILED' AND attempts <= max_retries THEN 'ENQUEUED'::job_status
+		        ELSE COALESCE(NULLIF($4::text, '')::job_status, status) END,
+		    stop_request = CASE WHEN $4::text IN ('ENQUEUED', 'FAILED') THEN '' ELSE stop_request END,
+		    dead_lettered_at = CASE WHEN $4::text = 'FAILED' AND attempts > max_retries THEN current_timestamp ELSE dead_lettered_at END
 		WHERE id = $1
-		RETURNING id, name, description, docker_image AS "docker_embedded.docker_image", docker_command AS "docker_embedded.docker_command",
-       		docker_environment AS "docker_embedded.docker_environment", created_at, updated_at, status, metadata`,
+		RETURNING `+pgJobColumns,
 		params.Id, params.Name, params.Description, params.Status, params.Metadata)
 	if err != nil {
 		return nil, fmt.Errorf("updating job: %w", err)
@@ -141,6 +380,298 @@ func (p postgresDb) Update(ctx context.Context, params UpdateParams) (*jobs.Job,
 	return job, nil
 }
 
+func (p postgresDb) Cancel(ctx context.Context, id uuid.UUID, by string) (*jobs.Job, error) {
+	job := &jobs.Job{}
+	err := p.runQuery(ctx, job, `UPDATE jobs
+		SET status       = CASE WHEN status = 'RUNNING'::job_status THEN status ELSE 'CANCELLED'::job_status END,
+		    stop_request = CASE WHEN status = 'RUNNING'::job_status THEN $3 ELSE stop_request END,
+		    cancelled_by = $2,
+		    updated_at   = current_timestamp
+		WHERE id = $1
+		  AND status IN ('ENQUEUED'::job_status, 'HELD'::job_status, 'RUNNING'::job_status)
+		RETURNING `+pgJobColumns, id, by, jobs.StopCancel)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cancelling job: %w", err)
+	}
+	return job, nil
+}
+
+func (p postgresDb) Hold(ctx context.Context, filter JobFilter) ([]jobs.Job, error) {
+	return p.setStatus(ctx, filter, jobs.Enqueued, jobs.Held)
+}
+
+func (p postgresDb) Release(ctx context.Context, filter JobFilter) ([]jobs.Job, error) {
+	return p.setStatus(ctx, filter, jobs.Held, jobs.Enqueued)
+}
+
+// setStatus moves the jobs matching the filter from one status to another
+func (p postgresDb) setStatus(ctx context.Context, filter JobFilter, from, to jobs.JobStatus) ([]jobs.Job, error) {
+	return p.runQueryAll(ctx, `UPDATE jobs
+		SET status     = $5::text::job_status,
+		    updated_at = current_timestamp
+		WHERE status = $4::text::job_status
+		  AND (COALESCE(cardinality($1::uuid[]), 0) = 0 OR id = ANY($1))
+		  AND ($2 = '' OR queue = $2)
+		  AND ($3 = '' OR starts_with(name, $3))
+		RETURNING `+pgJobColumns, filter.IDs, filter.Queue, filter.NamePrefix, from, to)
+}
+
+func (p postgresDb) ExpireJobs(ctx context.Context) ([]jobs.Job, error) {
+	return p.runQueryAll(ctx, `UPDATE jobs
+		SET status           = 'EXPIRED'::job_status,
+		    updated_at       = current_timestamp,
+		    dead_lettered_at = current_timestamp
+		WHERE status IN ('ENQUEUED'::job_status, 'HELD'::job_status)
+		  AND expires_at <= current_timestamp
+		RETURNING `+pgJobColumns)
+}
+
+func (p postgresDb) DeadLetters(ctx context.Context) ([]jobs.Job, error) {
+	return p.runQueryAll(ctx, `SELECT `+pgJobColumns+`
+		FROM jobs
+		WHERE dead_lettered_at IS NOT NULL
+		ORDER BY dead_lettered_at`)
+}
+
+func (p postgresDb) Requeue(ctx context.Context, filter JobFilter) ([]jobs.Job, error) {
+	return p.runQueryAll(ctx, `UPDATE jobs
+		SET status           = 'ENQUEUED'::job_status,
+		    updated_at       = current_timestamp,
+		    attempts         = 0,
+		    dead_lettered_at = NULL,
+		    stop_request     = '',
+		    expires_at       = CASE WHEN max_queue_time > 0 THEN current_timestamp + make_interval(secs => max_queue_time) END
+		WHERE dead_lettered_at IS NOT NULL
+		  AND (COALESCE(cardinality($1::uuid[]), 0) = 0 OR id = ANY($1))
+		  AND ($2 = '' OR queue = $2)
+		  AND ($3 = '' OR starts_with(name, $3))
+		RETURNING `+pgJobColumns, filter.IDs, filter.Queue, filter.NamePrefix)
+}
+
+func (p postgresDb) ReturnJobs(ctx context.Context, worker uuid.UUID, ids []uuid.UUID) ([]jobs.Job, error) {
+	return p.runQueryAll(ctx, `UPDATE jobs
+		SET status       = 'ENQUEUED'::job_status,
+		    updated_at   = current_timestamp,
+		    started_at   = NULL,
+		    worker_id    = NULL,
+		    attempts     = GREATEST(attempts - 1, 0),
+		    stop_request = ''
+		WHERE id = ANY($1) AND status = 'RUNNING'::job_status AND worker_id IS NOT DISTINCT FROM $2::uuid
+		RETURNING `+pgJobColumns, ids, nullWorker(worker))
+}
+
+func (p postgresDb) RequestStop(ctx context.Context, id uuid.UUID, reason jobs.StopReason) (*jobs.Job, error) {
+	job := &jobs.Job{}
+	err := p.runQuery(ctx, job, `UPDATE jobs
+		SET stop_request = $2,
+		    updated_at   = current_timestamp
+		WHERE id = $1
+		  AND status = 'RUNNING'::job_status
+		  AND stop_request = ''
+		RETURNING `+pgJobColumns, id, reason)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("requesting job stop: %w", err)
+	}
+	return job, nil
+}
+
+func (p postgresDb) SetPull(ctx context.Context, id uuid.UUID, pull jobs.PullInfo) (*jobs.Job, error) {
+	job := &jobs.Job{}
+	err := p.runQuery(ctx, job, `UPDATE jobs SET pull = $2 WHERE id = $1 RETURNING `+pgJobColumns, id, pull)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("setting pull: %w", err)
+	}
+	return job, nil
+}
+
+func (p postgresDb) StopRequests(ctx context.Context, ids []uuid.UUID) ([]jobs.Job, error) {
+	return p.runQueryAll(ctx, `SELECT `+pgJobColumns+`
+		FROM jobs
+		WHERE id = ANY($1) AND status = 'RUNNING'::job_status AND stop_request <> ''`, ids)
+}
+
+func (p postgresDb) AddStats(ctx context.Context, id uuid.UUID, samples []jobs.StatsSample) (*jobs.Job, error) {
+	var job *jobs.Job
+	err := p.db.BeginFunc(ctx, func(tx pgx.Tx) error {
+		var current jobs.Job
+		err := pgxscan.Get(ctx, tx, &current, `SELECT `+pgJobColumns+` FROM jobs WHERE id = $1 FOR UPDATE`, id)
+		if err != nil {
+			if pgxscan.NotFound(err) {
+				return nil
+			}
+			return fmt.Errorf("getting job: %w", err)
+		}
+
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{"job_stats"},
+			[]string{"job_id", "time", "cpu", "memory", "memory_limit", "net_rx", "net_tx", "block_read", "block_write"},
+			pgx.CopyFromSlice(len(samples), func(i int) ([]interface{}, error) {
+				s := samples[i]
+				return []interface{}{id, s.Time, s.CPU, s.Memory, s.MemoryLimit, s.NetRx, s.NetTx, s.BlockRead, s.BlockWrite}, nil
+			}))
+		if err != nil {
+			return fmt.Errorf("inserting samples: %w", err)
+		}
+
+		var usage jobs.Usage
+		if current.Usage != nil {
+			usage = *current.Usage
+		}
+
+		var updated jobs.Job
+		err = pgxscan.Get(ctx, tx, &updated, `UPDATE jobs SET usage = $2 WHERE id = $1 RETURNING `+pgJobColumns, id, usage.Add(samples...))
+		if err != nil {
+			return fmt.Errorf("updating usage: %w", err)
+		}
+		job = &updated
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("adding stats: %w", err)
+	}
+	return job, nil
+}
+
+func (p postgresDb) GetStats(ctx context.Context, id uuid.UUID) ([]jobs.StatsSample, error) {
+	var samples []jobs.StatsSample
+	err := pgxscan.Select(ctx, p.db, &samples, `SELECT time, cpu, memory, memory_limit, net_rx, net_tx, block_read, block_write
+		FROM job_stats
+		WHERE job_id = $1
+		ORDER BY time`, id)
+	if err != nil {
+		return nil, fmt.Errorf("getting stats: %w", err)
+	}
+	return samples, nil
+}
+
+func (p postgresDb) TimeoutJobs(ctx context.Context, grace time.Duration) ([]jobs.Job, error) {
+	return p.runQueryAll(ctx, `UPDATE jobs
+		SET status     = 'TIMED_OUT'::job_status,
+		    updated_at = current_timestamp
+		WHERE status = 'RUNNING'::job_status
+		  AND timeout > 0
+		  AND started_at + make_interval(secs => timeout + $1) < current_timestamp
+		RETURNING `+pgJobColumns, int64(grace/time.Second))
+}
+
+func (p postgresDb) RegisterWorker(ctx context.Context, reg workers.Registration) (*workers.Worker, error) {
+	labels := reg.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	gpus := reg.GPUs
+	if gpus == nil {
+		gpus = []string{}
+	}
+
+	w := &workers.Worker{}
+	err := pgxscan.Get(ctx, p.db, w, `INSERT INTO workers (name, hostname, version, labels, gpus, cpus, memory, slots, free_slots)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $8)
+		ON CONFLICT (name) DO UPDATE
+		SET hostname      = excluded.hostname,
+		    version       = excluded.version,
+		    labels        = excluded.labels,
+		    gpus          = excluded.gpus,
+		    cpus          = excluded.cpus,
+		    memory        = excluded.memory,
+		    slots         = excluded.slots,
+		    status        = 'ONLINE',
+		    load          = 0,
+		    running       = '{}',
+		    free_slots    = excluded.slots,
+		    registered_at = current_timestamp,
+		    last_seen_at  = current_timestamp
+		RETURNING `+pgWorkerColumns,
+		reg.Name, reg.Hostname, reg.Version, labels, gpus, reg.CPUs, reg.Memory, reg.Slots)
+	if err != nil {
+		return nil, fmt.Errorf("registering worker: %w", err)
+	}
+	return w, nil
+}
+
+func (p postgresDb) WorkerHeartbeat(ctx context.Context, id uuid.UUID, hb workers.Heartbeat) (*workers.Worker, error) {
+	running := hb.Running
+	if running == nil {
+		running = []uuid.UUID{}
+	}
+
+	w := &workers.Worker{}
+	err := pgxscan.Get(ctx, p.db, w, `UPDATE workers
+		SET status       = 'ONLINE',
+		    load         = $2,
+		    running      = $3::uuid[],
+		    free_slots   = $4,
+		    last_seen_at = current_timestamp
+		WHERE id = $1
+		RETURNING `+pgWorkerColumns, id, hb.Load, running, hb.FreeSlots)
+	if err != nil {
+		if pgxscan.NotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("updating worker: %w", err)
+	}
+	return w, nil
+}
+
+func (p postgresDb) GetWorkers(ctx context.Context) ([]workers.Worker, error) {
+	var ws []workers.Worker
+	if err := pgxscan.Select(ctx, p.db, &ws, `SELECT `+pgWorkerColumns+` FROM workers ORDER BY name`); err != nil {
+		return nil, fmt.Errorf("getting workers: %w", err)
+	}
+	return ws, nil
+}
+
+func (p postgresDb) GetWorker(ctx context.Context, id uuid.UUID) (*workers.Worker, error) {
+	w := &workers.Worker{}
+	if err := pgxscan.Get(ctx, p.db, w, `SELECT `+pgWorkerColumns+` FROM workers WHERE id = $1`, id); err != nil {
+		if pgxscan.NotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("getting worker: %w", err)
+	}
+	return w, nil
+}
+
+func (p postgresDb) CordonWorker(ctx context.Context, id uuid.UUID, cordoned bool, drain workers.DrainMode) (*workers.Worker, error) {
+	w := &workers.Worker{}
+	err := pgxscan.Get(ctx, p.db, w, `UPDATE workers
+		SET cordoned = $2,
+		    drain    = $3
+		WHERE id = $1
+		RETURNING `+pgWorkerColumns, id, cordoned, string(drain))
+	if err != nil {
+		if pgxscan.NotFound(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cordoning worker: %w", err)
+	}
+	return w, nil
+}
+
+func (p postgresDb) MarkWorkersOffline(ctx context.Context, after time.Duration) ([]workers.Worker, error) {
+	var ws []workers.Worker
+	err := pgxscan.Select(ctx, p.db, &ws, `UPDATE workers
+		SET status     = 'OFFLINE',
+		    load       = 0,
+		    running    = '{}',
+		    free_slots = 0
+		WHERE status = 'ONLINE'
+		  AND last_seen_at < current_timestamp - make_interval(secs => $1)
+		RETURNING `+pgWorkerColumns, int64(after/time.Second))
+	if err != nil {
+		return nil, fmt.Errorf("marking workers offline: %w", err)
+	}
+	return ws, nil
+}
+
 func (p postgresDb) Close() error {
 	p.db.Close()
 	return nil
@@ -163,6 +694,20 @@ func (p postgresDb) runQuery(ctx context.Context, job *jobs.Job, query string, a
 	return nil
 }
 
+func (p postgresDb) runQueryAll(ctx context.Context, query string, args ...interface{}) ([]jobs.Job, error) {
+	rows, err := p.db.Query(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("running query: %w", err)
+	}
+	defer rows.Close()
+
+	var data []jobs.Job
+	if err := pgxscan.ScanAll(&data, rows); err != nil {
+		return nil, fmt.Errorf("scanning rows: %w", err)
+	}
+	return data, nil
+}
+
 func jobFromRows(rows pgx.Rows, job *jobs.Job) error {
 	if err := pgxscan.ScanOne(job, rows); err != nil && errors.Is(err, pgx.ErrNoRows) {
 		return fmt.Errorf("scaning into struct: %w", err)
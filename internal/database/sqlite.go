@@ -7,20 +7,23 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gofrs/uuid"
 	_ "github.com/mattn/go-sqlite3"
 	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/workers"
 )
 
 type sqliteDb struct {
 	db *sql.DB
+	mu *sync.Mutex
 }
 
 func (s sqliteDb) GetById(ctx context.Context, id uuid.UUID) (*jobs.Job, error) {
 	var job jobs.Job
-	err := s.runQuery(ctx, &job, "SELECT id, name, description, docker_image, docker_cmd, docker_env, created_at, updated_at, status, metadata FROM jobs WHERE id = ?", id)
+	err := s.runQuery(ctx, &job, "SELECT "+sqliteJobColumns+" FROM jobs WHERE id = ?", id)
 
 	if err != nil {
 		return nil, fmt.Errorf("getting job by id: %w", err)
@@ -41,10 +44,78 @@ func (s sqliteDb) Insert(ctx context.Context, params InsertParams) (*jobs.Job, e
 		return nil, fmt.Errorf("generating uuid: %w", err)
 	}
 
+	status := jobs.Enqueued
+	if params.Hold {
+		status = jobs.Held
+	}
+
+	tags := params.Tags
+	if tags == nil {
+		tags = []string{}
+	}
+	tagsJson, err := json.Marshal(tags)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling tags into json: %w", err)
+	}
+
+	entrypoint := params.Docker.Entrypoint
+	if entrypoint == nil {
+		entrypoint = []string{}
+	}
+	entrypointJson, err := json.Marshal(entrypoint)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling entrypoint into json: %w", err)
+	}
+	resourcesJson, err := json.Marshal(params.Docker.Resources)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling resources into json: %w", err)
+	}
+	args := params.Docker.Args
+	if args == nil {
+		args = []string{}
+	}
+	argsJson, err := json.Marshal(args)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling args into json: %w", err)
+	}
+	mounts := params.Docker.Mounts
+	if mounts == nil {
+		mounts = []jobs.Mount{}
+	}
+	mountsJson, err := json.Marshal(mounts)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling mounts into json: %w", err)
+	}
+	outputs := params.Docker.Outputs
+	if outputs == nil {
+		outputs = []string{}
+	}
+	outputsJson, err := json.Marshal(outputs)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling outputs into json: %w", err)
+	}
+
+	var expiresAt *int64
+	switch {
+	case params.ExpiresAt != nil:
+		unix := params.ExpiresAt.Unix()
+		expiresAt = &unix
+	case params.MaxQueueTime > 0:
+		unix := time.Now().Add(params.MaxQueueTime.Std()).Unix()
+		expiresAt = &unix
+	}
+
 	job := &jobs.Job{}
-	err = s.runQuery(ctx, job, `INSERT INTO jobs (id, name, description, docker_image, docker_cmd, docker_env, metadata) VALUES (?, ?, ?, ?, ?, ?, ?)
-		RETURNING id, 'name', description, docker_image, docker_cmd, docker_env, datetime(created_at,'unixepoch'), datetime(updated_at,'unixepoch'), status, metadata`,
-		id, params.Name, params.Description, params.Docker.Image, params.Docker.Command, env, string(b))
+	err = s.runQuery(ctx, job, `INSERT INTO jobs (id, name, description, docker_image, docker_cmd, docker_env, metadata, queue, timeout, status,
+			priority, preemptible, username, tags, gpus, expires_at, max_queue_time, max_retries,
+			docker_entrypoint, docker_workdir, docker_user, docker_resources, docker_args, docker_shell, docker_mounts, docker_outputs,
+			docker_pull_policy)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		RETURNING `+sqliteJobColumns,
+		id, params.Name, params.Description, params.Docker.Image, params.Docker.Command, env, string(b), params.Queue, params.Timeout, status,
+		params.Priority, params.Preemptible, params.User, string(tagsJson), params.GPUs, expiresAt, params.MaxQueueTime, params.MaxRetries,
+		string(entrypointJson), params.Docker.Workdir, params.Docker.User, string(resourcesJson), string(argsJson), params.Docker.Shell, string(mountsJson), string(outputsJson),
+		string(params.Docker.PullPolicy))
 
 	if err != nil {
 		return nil, fmt.Errorf("inserting job: %w", err)
@@ -53,6 +124,48 @@ func (s sqliteDb) Insert(ctx context.Context, params InsertParams) (*jobs.Job, e
 	return job, nil
 }
 
+func (s sqliteDb) InsertIdempotent(ctx context.Context, key IdempotencyKey, params InsertParams) (*jobs.Job, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx, `DELETE FROM idempotency_keys WHERE created_at < strftime('%s', 'now') - ?`, int64(key.TTL/time.Second))
+	if err != nil {
+		return nil, false, fmt.Errorf("deleting expired keys: %w", err)
+	}
+
+	var (
+		hash  string
+		jobId uuid.UUID
+	)
+	err = s.db.QueryRowContext(ctx, `SELECT request_hash, job_id FROM idempotency_keys WHERE key = ?`, key.Key).Scan(&hash, &jobId)
+	switch {
+	case err == nil:
+		if hash != key.RequestHash {
+			return nil, false, ErrIdempotencyMismatch
+		}
+		job, err := s.GetById(ctx, jobId)
+		if err != nil {
+			return nil, false, fmt.Errorf("getting original job: %w", err)
+		}
+		return job, true, nil
+
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, false, fmt.Errorf("getting idempotency key: %w", err)
+	}
+
+	job, err := s.Insert(ctx, params)
+	if err != nil {
+		return nil, false, err
+	}
+
+	_, err = s.db.ExecContext(ctx, `INSERT INTO idempotency_keys (key, request_hash, job_id) VALUES (?, ?, ?)`, key.Key, key.RequestHash, job.ID)
+	if err != nil {
+		return nil, false, fmt.Errorf("inserting idempotency key: %w", err)
+	}
+
+	return job, false, nil
+}
+
 func (s sqliteDb) Update(ctx context.Context, params UpdateParams) (*jobs.Job, error) {
 	b, err := json.Marshal(params.Metadata)
 	if err != nil {
@@ -60,10 +173,13 @@ func (s sqliteDb) Update(ctx context.Context, params UpdateParams) (*jobs.Job, e
 	}
 
 	job := &jobs.Job{}
-	err = s.runQuery(ctx, job, `UPDATE jobs SET name = ?, description = ?, metadata = ?, status = ?, updated_at = strftime('%s', 'now')
-			WHERE id = ?
-			RETURNING id, 'name', description, docker_image, docker_cmd, docker_env, datetime(created_at,'unixepoch'), datetime(updated_at,'unixepoch'), status, metadata`,
-		params.Name, params.Description, string(b), params.Status, job.ID)
+	err = s.runQuery(ctx, job, `UPDATE jobs SET name = ?1, description = ?2, metadata = ?3, updated_at = strftime('%s', 'now'),
+			status = CASE WHEN ?4 = 'FAILED' AND attempts <= max_retries THEN 'ENQUEUED' ELSE ?4 END,
+			stop_request = CASE WHEN ?4 IN ('ENQUEUED', 'FAILED') THEN '' ELSE stop_request END,
+			dead_lettered_at = CASE WHEN ?4 = 'FAILED' AND attempts > max_retries THEN strftime('%s', 'now') ELSE dead_lettered_at END
+			WHERE id = ?5
+			RETURNING `+sqliteJobColumns,
+		params.Name, params.Description, string(b), params.Status, params.Id)
 
 	if err != nil {
 		return nil, fmt.Errorf("updating job: %w", err)
@@ -72,6 +188,12 @@ func (s sqliteDb) Update(ctx context.Context, params UpdateParams) (*jobs.Job, e
 	return job, nil
 }
 
+// sqliteJobColumns are the columns returned by every query that scans into a jobs.Job
+const sqliteJobColumns = `id, name, description, docker_image, docker_cmd, docker_env, datetime(created_at,'unixepoch'), datetime(updated_at,'unixepoch'),
+	status, metadata, queue, timeout, datetime(started_at,'unixepoch'), stop_request, cancelled_by, priority, preemptible, attempts,
+	username, tags, gpus, blocked_reason, datetime(expires_at,'unixepoch'), max_queue_time, max_retries, datetime(dead_lettered_at,'unixepoch'), usage,
+	docker_entrypoint, docker_workdir, docker_user, docker_resources, docker_args, docker_shell, docker_mounts, docker_outputs, docker_pull_policy, pull, worker_id`
+
 const (
 	timeFormat = "2006-01-02 15:04:05"
 	envSplit   = "_#&#_"
@@ -85,17 +207,106 @@ func NewSqlite(filename string) (*sqliteDb, error) {
 		return nil, fmt.Errorf("opening sqlite db: %w", err)
 	}
 
-	return &sqliteDb{db: db}, nil
+	return &sqliteDb{db: db, mu: &sync.Mutex{}}, nil
+}
+
+// sqliteNotExpired is the condition that excludes the expired jobs that have not been reaped yet.
+// strftime returns text, which sqlite always sorts after the integers, so it has to be cast.
+const sqliteNotExpired = `(expires_at IS NULL OR expires_at > CAST(strftime('%s', 'now') AS INTEGER))`
+
+// sqliteClaimJob is the SET clause that moves a job to "RUNNING", ?2 is the worker claiming it
+const sqliteClaimJob = `SET status = 'RUNNING', updated_at = strftime('%s', 'now'), started_at = strftime('%s', 'now'),
+	attempts = attempts + 1, blocked_reason = '', worker_id = ?2`
+
+func (s sqliteDb) FetchJob(ctx context.Context, params FetchParams) (*jobs.Job, error) {
+	if len(params.Limits) == 0 {
+		return s.fetchFirst(ctx, params.MaxGPUs, params.worker())
+	}
+
+	// there is a single sqlite writer, holding the lock while checking the limits is the
+	// equivalent of the postgres advisory lock
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	running, err := s.GetByStatus(ctx, jobs.Running)
+	if err != nil {
+		return nil, fmt.Errorf("getting running jobs: %w", err)
+	}
+
+	// the jobs that need more GPUs than the worker has are not blocked, another worker may run them
+	for offset := 0; ; offset += fetchCandidates {
+		candidates, err := s.runQueryAll(ctx, `SELECT `+sqliteJobColumns+` FROM jobs WHERE status = 'ENQUEUED' AND `+sqliteNotExpired+`
+			AND (?3 IS NULL OR gpus <= ?3)
+			ORDER BY priority DESC, rowid LIMIT ?1 OFFSET ?2`, fetchCandidates, offset, params.MaxGPUs)
+		if err != nil {
+			return nil, fmt.Errorf("getting enqueued jobs: %w", err)
+		}
+
+		for _, candidate := range candidates {
+			if reason := blockedReason(params.Limits, candidate, running); reason != "" {
+				if reason == candidate.BlockedReason {
+					continue
+				}
+				if _, err := s.db.ExecContext(ctx, `UPDATE jobs SET blocked_reason = ? WHERE id = ?`, reason, candidate.ID); err != nil {
+					return nil, fmt.Errorf("updating blocked reason: %w", err)
+				}
+				continue
+			}
+
+			var job jobs.Job
+			err := s.runQuery(ctx, &job, `UPDATE jobs `+sqliteClaimJob+`
+				WHERE id = ?1 AND status = 'ENQUEUED'
+				RETURNING `+sqliteJobColumns, candidate.ID, params.worker())
+			if err != nil {
+				if errors.Is(err, sql.ErrNoRows) {
+					continue
+				}
+				return nil, fmt.Errorf("claiming job: %w", err)
+			}
+			return &job, nil
+		}
+
+		if len(candidates) < fetchCandidates {
+			return nil, nil
+		}
+	}
 }
 
-func (s sqliteDb) FetchJob(ctx context.Context) (*jobs.Job, error) {
+func (s sqliteDb) UpdateBlockedReasons(ctx context.Context, limits []Limit) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	running, err := s.GetByStatus(ctx, jobs.Running)
+	if err != nil {
+		return fmt.Errorf("getting running jobs: %w", err)
+	}
+	enqueued, err := s.GetByStatus(ctx, jobs.Enqueued)
+	if err != nil {
+		return fmt.Errorf("getting enqueued jobs: %w", err)
+	}
+
+	for _, job := range enqueued {
+		reason := blockedReason(limits, job, running)
+		if reason == job.BlockedReason {
+			continue
+		}
+		if _, err := s.db.ExecContext(ctx, `UPDATE jobs SET blocked_reason = ? WHERE id = ?`, reason, job.ID); err != nil {
+			return fmt.Errorf("updating blocked reason: %w", err)
+		}
+	}
+	return nil
+}
+
+// fetchFirst claims for worker the first enqueued job that needs at most maxGPUs, without checking
+// any limit
+func (s sqliteDb) fetchFirst(ctx context.Context, maxGPUs *int, worker interface{}) (*jobs.Job, error) {
 	var job jobs.Job
-	err := s.runQuery(ctx, &job, `UPDATE jobs SET status = 'RUNNING', updated_at = strftime('%s', 'now')
+	err := s.runQuery(ctx, &job, `UPDATE jobs `+sqliteClaimJob+`
 		WHERE rowid = (
-		    SELECT min(rowid) FROM jobs WHERE status = 'ENQUEUED'
+		    SELECT rowid FROM jobs WHERE status = 'ENQUEUED' AND `+sqliteNotExpired+` AND (?1 IS NULL OR gpus <= ?1)
+		    ORDER BY priority DESC, rowid LIMIT 1
 	    )
-	    RETURNING id, 'name', description, docker_image, docker_cmd, docker_env, datetime(created_at,'unixepoch'), datetime(updated_at,'unixepoch'), status, metadata
-    `)
+	    RETURNING `+sqliteJobColumns, maxGPUs, worker)
 
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -111,20 +322,283 @@ func (s sqliteDb) GetAll(ctx context.Context) ([]jobs.Job, error) {
 	panic("GetAll in sqlite not implemented")
 }
 
+func (s sqliteDb) Cancel(ctx context.Context, id uuid.UUID, by string) (*jobs.Job, error) {
+	job := &jobs.Job{}
+	err := s.runQuery(ctx, job, `UPDATE jobs
+		SET status = CASE WHEN status = 'RUNNING' THEN status ELSE 'CANCELLED' END,
+		    stop_request = CASE WHEN status = 'RUNNING' THEN ? ELSE stop_request END,
+		    cancelled_by = ?, updated_at = strftime('%s', 'now')
+		WHERE id = ? AND status IN ('ENQUEUED', 'HELD', 'RUNNING')
+		RETURNING `+sqliteJobColumns, jobs.StopCancel, by, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cancelling job: %w", err)
+	}
+	return job, nil
+}
+
+func (s sqliteDb) Hold(ctx context.Context, filter JobFilter) ([]jobs.Job, error) {
+	return s.setStatus(ctx, filter, jobs.Enqueued, jobs.Held)
+}
+
+func (s sqliteDb) Release(ctx context.Context, filter JobFilter) ([]jobs.Job, error) {
+	return s.setStatus(ctx, filter, jobs.Held, jobs.Enqueued)
+}
+
+// setStatus moves the jobs matching the filter from one status to another
+func (s sqliteDb) setStatus(ctx context.Context, filter JobFilter, from, to jobs.JobStatus) ([]jobs.Job, error) {
+	where, args := sqliteFilter(filter)
+	args = append([]interface{}{to, from}, args...)
+	return s.runQueryAll(ctx, `UPDATE jobs SET status = ?, updated_at = strftime('%s', 'now')
+		WHERE status = ?`+where+`
+		RETURNING `+sqliteJobColumns, args...)
+}
+
+// sqliteFilter returns the conditions (to be appended to a WHERE clause) and arguments matching the filter
+func sqliteFilter(filter JobFilter) (string, []interface{}) {
+	var (
+		sb   strings.Builder
+		args []interface{}
+	)
+
+	if len(filter.IDs) > 0 {
+		sb.WriteString(" AND id IN (?" + strings.Repeat(", ?", len(filter.IDs)-1) + ")")
+		for _, id := range filter.IDs {
+			args = append(args, id)
+		}
+	}
+	if filter.Queue != "" {
+		sb.WriteString(" AND queue = ?")
+		args = append(args, filter.Queue)
+	}
+	if filter.NamePrefix != "" {
+		sb.WriteString(" AND substr(name, 1, length(?)) = ?")
+		args = append(args, filter.NamePrefix, filter.NamePrefix)
+	}
+
+	return sb.String(), args
+}
+
+func (s sqliteDb) StopRequests(ctx context.Context, ids []uuid.UUID) ([]jobs.Job, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return s.runQueryAll(ctx, `SELECT `+sqliteJobColumns+` FROM jobs
+		WHERE id IN (?`+strings.Repeat(", ?", len(ids)-1)+`) AND status = 'RUNNING' AND stop_request <> ''`, args...)
+}
+
+func (s sqliteDb) AddStats(ctx context.Context, id uuid.UUID, samples []jobs.StatsSample) (*jobs.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, fmt.Errorf("starting transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var current jobs.Job
+	if err := scanJob(tx.QueryRowContext(ctx, `SELECT `+sqliteJobColumns+` FROM jobs WHERE id = ?`, id), &current); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("getting job: %w", err)
+	}
+
+	for _, sample := range samples {
+		_, err := tx.ExecContext(ctx, `INSERT INTO job_stats (job_id, time, cpu, memory, memory_limit, net_rx, net_tx, block_read, block_write)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			id, sample.Time.Unix(), sample.CPU, sample.Memory, sample.MemoryLimit, sample.NetRx, sample.NetTx, sample.BlockRead, sample.BlockWrite)
+		if err != nil {
+			return nil, fmt.Errorf("inserting sample: %w", err)
+		}
+	}
+
+	var usage jobs.Usage
+	if current.Usage != nil {
+		usage = *current.Usage
+	}
+	usageJson, err := json.Marshal(usage.Add(samples...))
+	if err != nil {
+		return nil, fmt.Errorf("marshaling usage into json: %w", err)
+	}
+
+	job := &jobs.Job{}
+	if err := scanJob(tx.QueryRowContext(ctx, `UPDATE jobs SET usage = ? WHERE id = ? RETURNING `+sqliteJobColumns, string(usageJson), id), job); err != nil {
+		return nil, fmt.Errorf("updating usage: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("committing transaction: %w", err)
+	}
+	return job, nil
+}
+
+func (s sqliteDb) GetStats(ctx context.Context, id uuid.UUID) ([]jobs.StatsSample, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT datetime(time, 'unixepoch'), cpu, memory, memory_limit, net_rx, net_tx, block_read, block_write
+		FROM job_stats WHERE job_id = ? ORDER BY time`, id)
+	if err != nil {
+		return nil, fmt.Errorf("getting stats: %w", err)
+	}
+	defer rows.Close()
+
+	var samples []jobs.StatsSample
+	for rows.Next() {
+		var (
+			sample jobs.StatsSample
+			t      string
+		)
+		if err := rows.Scan(&t, &sample.CPU, &sample.Memory, &sample.MemoryLimit, &sample.NetRx, &sample.NetTx, &sample.BlockRead, &sample.BlockWrite); err != nil {
+			return nil, fmt.Errorf("scanning result to struct: %w", err)
+		}
+		sample.Time, _ = time.Parse(timeFormat, t)
+		samples = append(samples, sample)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+	return samples, nil
+}
+
+func (s sqliteDb) TimeoutJobs(ctx context.Context, grace time.Duration) ([]jobs.Job, error) {
+	return s.runQueryAll(ctx, `UPDATE jobs SET status = 'TIMED_OUT', updated_at = strftime('%s', 'now')
+		WHERE status = 'RUNNING' AND timeout > 0 AND started_at + timeout + ? < CAST(strftime('%s', 'now') AS INTEGER)
+		RETURNING `+sqliteJobColumns, int64(grace/time.Second))
+}
+
+func (s sqliteDb) GetByStatus(ctx context.Context, status jobs.JobStatus) ([]jobs.Job, error) {
+	return s.runQueryAll(ctx, `SELECT `+sqliteJobColumns+` FROM jobs WHERE status = ? ORDER BY priority DESC, rowid`, status)
+}
+
+func (s sqliteDb) ExpireJobs(ctx context.Context) ([]jobs.Job, error) {
+	return s.runQueryAll(ctx, `UPDATE jobs SET status = 'EXPIRED', updated_at = strftime('%s', 'now'), dead_lettered_at = strftime('%s', 'now')
+		WHERE status IN ('ENQUEUED', 'HELD') AND expires_at <= CAST(strftime('%s', 'now') AS INTEGER)
+		RETURNING `+sqliteJobColumns)
+}
+
+func (s sqliteDb) DeadLetters(ctx context.Context) ([]jobs.Job, error) {
+	return s.runQueryAll(ctx, `SELECT `+sqliteJobColumns+` FROM jobs WHERE dead_lettered_at IS NOT NULL ORDER BY dead_lettered_at`)
+}
+
+func (s sqliteDb) Requeue(ctx context.Context, filter JobFilter) ([]jobs.Job, error) {
+	where, args := sqliteFilter(filter)
+	return s.runQueryAll(ctx, `UPDATE jobs SET status = 'ENQUEUED', updated_at = strftime('%s', 'now'), attempts = 0,
+			dead_lettered_at = NULL, stop_request = '',
+			expires_at = CASE WHEN max_queue_time > 0 THEN strftime('%s', 'now') + max_queue_time END
+		WHERE dead_lettered_at IS NOT NULL`+where+`
+		RETURNING `+sqliteJobColumns, args...)
+}
+
+func (s sqliteDb) ReturnJobs(ctx context.Context, worker uuid.UUID, ids []uuid.UUID) ([]jobs.Job, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	args := []interface{}{nullWorker(worker)}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	return s.runQueryAll(ctx, `UPDATE jobs SET status = 'ENQUEUED', updated_at = strftime('%s', 'now'), started_at = NULL,
+			worker_id = NULL, attempts = max(attempts - 1, 0), stop_request = ''
+		WHERE worker_id IS ? AND id IN (?`+strings.Repeat(", ?", len(ids)-1)+`) AND status = 'RUNNING'
+		RETURNING `+sqliteJobColumns, args...)
+}
+
+func (s sqliteDb) RequestStop(ctx context.Context, id uuid.UUID, reason jobs.StopReason) (*jobs.Job, error) {
+	job := &jobs.Job{}
+	err := s.runQuery(ctx, job, `UPDATE jobs SET stop_request = ?, updated_at = strftime('%s', 'now')
+		WHERE id = ? AND status = 'RUNNING' AND stop_request = ''
+		RETURNING `+sqliteJobColumns, reason, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("requesting job stop: %w", err)
+	}
+	return job, nil
+}
+
+func (s sqliteDb) SetPull(ctx context.Context, id uuid.UUID, pull jobs.PullInfo) (*jobs.Job, error) {
+	pullJson, err := json.Marshal(pull)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling pull into json: %w", err)
+	}
+
+	job := &jobs.Job{}
+	err = s.runQuery(ctx, job, `UPDATE jobs SET pull = ? WHERE id = ? RETURNING `+sqliteJobColumns, string(pullJson), id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("setting pull: %w", err)
+	}
+	return job, nil
+}
+
 func (s sqliteDb) runQuery(ctx context.Context, job *jobs.Job, query string, args ...interface{}) error {
 	row := s.db.QueryRowContext(ctx, query, args...)
 	if err := row.Err(); err != nil {
 		return fmt.Errorf("fetching job: %w", err)
 	}
 
+	return scanJob(row, job)
+}
+
+func (s sqliteDb) runQueryAll(ctx context.Context, query string, args ...interface{}) ([]jobs.Job, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("running query: %w", err)
+	}
+	defer rows.Close()
+
+	var data []jobs.Job
+	for rows.Next() {
+		var job jobs.Job
+		if err := scanJob(rows, &job); err != nil {
+			return nil, err
+		}
+		data = append(data, job)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+	return data, nil
+}
+
+// scanJob scans a row returned by a query selecting sqliteJobColumns
+func scanJob(row interface{ Scan(...interface{}) error }, job *jobs.Job) error {
 	var (
-		createdAt string
-		updatedAt string
-		dockerEnv string
-		meta      string
+		createdAt      string
+		updatedAt      string
+		startedAt      sql.NullString
+		expiresAt      sql.NullString
+		deadLetteredAt sql.NullString
+		dockerEnv      string
+		meta           string
+		tags           string
+		usage          sql.NullString
+		pull           sql.NullString
+		worker         uuid.NullUUID
+		entrypoint     string
+		resources      string
+		args           string
+		mounts         string
+		outputs        string
 	)
 
-	err := row.Scan(&job.ID, &job.Name, &job.Description, &job.Docker.Image, &job.Docker.Command, &dockerEnv, &createdAt, &updatedAt, &job.Status, &meta)
+	err := row.Scan(&job.ID, &job.Name, &job.Description, &job.Docker.Image, &job.Docker.Command, &dockerEnv, &createdAt, &updatedAt,
+		&job.Status, &meta, &job.Queue, &job.Timeout, &startedAt, &job.StopRequest, &job.CancelledBy,
+		&job.Priority, &job.Preemptible, &job.Attempts, &job.User, &tags, &job.GPUs, &job.BlockedReason,
+		&expiresAt, &job.MaxQueueTime, &job.MaxRetries, &deadLetteredAt, &usage,
+		&entrypoint, &job.Docker.Workdir, &job.Docker.User, &resources, &args, &job.Docker.Shell, &mounts, &outputs, &job.Docker.PullPolicy, &pull, &worker)
 	if err != nil {
 		return fmt.Errorf("scanning result to struct: %w", err)
 	}
@@ -132,11 +606,229 @@ func (s sqliteDb) runQuery(ctx context.Context, job *jobs.Job, query string, arg
 	job.Docker.Environment = stringToEnv(dockerEnv)
 	job.CreatedAt, _ = time.Parse(timeFormat, createdAt)
 	job.UpdatedAt, _ = time.Parse(timeFormat, updatedAt)
+	job.StartedAt = parseNullTime(startedAt)
+	job.ExpiresAt = parseNullTime(expiresAt)
+	job.DeadLetteredAt = parseNullTime(deadLetteredAt)
+	if worker.Valid {
+		job.Worker = &worker.UUID
+	}
 
 	if err := json.Unmarshal([]byte(meta), &job.Metadata); err != nil {
 		return fmt.Errorf("unmarshaling metadata: %w", err)
 	}
 
+	if err := json.Unmarshal([]byte(tags), &job.Tags); err != nil {
+		return fmt.Errorf("unmarshaling tags: %w", err)
+	}
+
+	if usage.Valid {
+		if err := json.Unmarshal([]byte(usage.String), &job.Usage); err != nil {
+			return fmt.Errorf("unmarshaling usage: %w", err)
+		}
+	}
+	if pull.Valid {
+		if err := json.Unmarshal([]byte(pull.String), &job.Pull); err != nil {
+			return fmt.Errorf("unmarshaling pull: %w", err)
+		}
+	}
+
+	if err := json.Unmarshal([]byte(entrypoint), &job.Docker.Entrypoint); err != nil {
+		return fmt.Errorf("unmarshaling entrypoint: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(resources), &job.Docker.Resources); err != nil {
+		return fmt.Errorf("unmarshaling resources: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(args), &job.Docker.Args); err != nil {
+		return fmt.Errorf("unmarshaling args: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(mounts), &job.Docker.Mounts); err != nil {
+		return fmt.Errorf("unmarshaling mounts: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(outputs), &job.Docker.Outputs); err != nil {
+		return fmt.Errorf("unmarshaling outputs: %w", err)
+	}
+
+	return nil
+}
+
+// sqliteWorkerColumns are the columns returned by every query that scans into a workers.Worker
+const sqliteWorkerColumns = `id, name, hostname, version, labels, gpus, cpus, memory, slots, status, cordoned, drain, load, running,
+		free_slots, datetime(registered_at, 'unixepoch'), datetime(last_seen_at, 'unixepoch')`
+
+func (s sqliteDb) RegisterWorker(ctx context.Context, reg workers.Registration) (*workers.Worker, error) {
+	labels := reg.Labels
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	labelsJson, err := json.Marshal(labels)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling labels into json: %w", err)
+	}
+
+	gpus := reg.GPUs
+	if gpus == nil {
+		gpus = []string{}
+	}
+	gpusJson, err := json.Marshal(gpus)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling gpus into json: %w", err)
+	}
+
+	id, err := uuid.NewV4()
+	if err != nil {
+		return nil, fmt.Errorf("generating uuid: %w", err)
+	}
+
+	w := &workers.Worker{}
+	err = scanWorker(s.db.QueryRowContext(ctx, `INSERT INTO workers (id, name, hostname, version, labels, gpus, cpus, memory, slots, free_slots)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE
+		SET hostname      = excluded.hostname,
+		    version       = excluded.version,
+		    labels        = excluded.labels,
+		    gpus          = excluded.gpus,
+		    cpus          = excluded.cpus,
+		    memory        = excluded.memory,
+		    slots         = excluded.slots,
+		    status        = 'ONLINE',
+		    load          = 0,
+		    running       = '[]',
+		    free_slots    = excluded.slots,
+		    registered_at = strftime('%s', 'now'),
+		    last_seen_at  = strftime('%s', 'now')
+		RETURNING `+sqliteWorkerColumns,
+		id, reg.Name, reg.Hostname, reg.Version, string(labelsJson), string(gpusJson), reg.CPUs, reg.Memory, reg.Slots, reg.Slots), w)
+	if err != nil {
+		return nil, fmt.Errorf("registering worker: %w", err)
+	}
+	return w, nil
+}
+
+func (s sqliteDb) WorkerHeartbeat(ctx context.Context, id uuid.UUID, hb workers.Heartbeat) (*workers.Worker, error) {
+	running := hb.Running
+	if running == nil {
+		running = []uuid.UUID{}
+	}
+	runningJson, err := json.Marshal(running)
+	if err != nil {
+		return nil, fmt.Errorf("marshaling running jobs into json: %w", err)
+	}
+
+	w := &workers.Worker{}
+	err = scanWorker(s.db.QueryRowContext(ctx, `UPDATE workers
+		SET status       = 'ONLINE',
+		    load         = ?,
+		    running      = ?,
+		    free_slots   = ?,
+		    last_seen_at = strftime('%s', 'now')
+		WHERE id = ?
+		RETURNING `+sqliteWorkerColumns, hb.Load, string(runningJson), hb.FreeSlots, id), w)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("updating worker: %w", err)
+	}
+	return w, nil
+}
+
+func (s sqliteDb) GetWorkers(ctx context.Context) ([]workers.Worker, error) {
+	return s.runWorkerQueryAll(ctx, `SELECT `+sqliteWorkerColumns+` FROM workers ORDER BY name`)
+}
+
+func (s sqliteDb) GetWorker(ctx context.Context, id uuid.UUID) (*workers.Worker, error) {
+	w := &workers.Worker{}
+	err := scanWorker(s.db.QueryRowContext(ctx, `SELECT `+sqliteWorkerColumns+` FROM workers WHERE id = ?`, id), w)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("getting worker: %w", err)
+	}
+	return w, nil
+}
+
+func (s sqliteDb) CordonWorker(ctx context.Context, id uuid.UUID, cordoned bool, drain workers.DrainMode) (*workers.Worker, error) {
+	w := &workers.Worker{}
+	err := scanWorker(s.db.QueryRowContext(ctx, `UPDATE workers
+		SET cordoned = ?,
+		    drain    = ?
+		WHERE id = ?
+		RETURNING `+sqliteWorkerColumns, cordoned, string(drain), id), w)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("cordoning worker: %w", err)
+	}
+	return w, nil
+}
+
+func (s sqliteDb) MarkWorkersOffline(ctx context.Context, after time.Duration) ([]workers.Worker, error) {
+	return s.runWorkerQueryAll(ctx, `UPDATE workers
+		SET status     = 'OFFLINE',
+		    load       = 0,
+		    running    = '[]',
+		    free_slots = 0
+		WHERE status = 'ONLINE'
+		  AND last_seen_at < strftime('%s', 'now') - ?
+		RETURNING `+sqliteWorkerColumns, int64(after/time.Second))
+}
+
+func (s sqliteDb) runWorkerQueryAll(ctx context.Context, query string, args ...interface{}) ([]workers.Worker, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("running query: %w", err)
+	}
+	defer rows.Close()
+
+	var data []workers.Worker
+	for rows.Next() {
+		var w workers.Worker
+		if err := scanWorker(rows, &w); err != nil {
+			return nil, err
+		}
+		data = append(data, w)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("rows error: %w", err)
+	}
+	return data, nil
+}
+
+// scanWorker scans a row returned by a query selecting sqliteWorkerColumns
+func scanWorker(row interface{ Scan(...interface{}) error }, w *workers.Worker) error {
+	var (
+		labels       string
+		gpus         string
+		running      string
+		registeredAt string
+		lastSeenAt   string
+	)
+
+	err := row.Scan(&w.ID, &w.Name, &w.Hostname, &w.Version, &labels, &gpus, &w.CPUs, &w.Memory, &w.Slots,
+		&w.Status, &w.Cordoned, &w.Drain, &w.Load, &running, &w.FreeSlots, &registeredAt, &lastSeenAt)
+	if err != nil {
+		return fmt.Errorf("scanning result to struct: %w", err)
+	}
+
+	w.RegisteredAt, _ = time.Parse(timeFormat, registeredAt)
+	w.LastSeenAt, _ = time.Parse(timeFormat, lastSeenAt)
+
+	if err := json.Unmarshal([]byte(labels), &w.Labels); err != nil {
+		return fmt.Errorf("unmarshaling labels: %w", err)
+	}
+	if err := json.Unmarshal([]byte(gpus), &w.GPUs); err != nil {
+		return fmt.Errorf("unmarshaling gpus: %w", err)
+	}
+	if err := json.Unmarshal([]byte(running), &w.Running); err != nil {
+		return fmt.Errorf("unmarshaling running jobs: %w", err)
+	}
+
 	return nil
 }
 
@@ -144,6 +836,14 @@ func (s sqliteDb) Close() error {
 	return s.db.Close()
 }
 
+func parseNullTime(val sql.NullString) *time.Time {
+	if !val.Valid {
+		return nil
+	}
+	t, _ := time.Parse(timeFormat, val.String)
+	return &t
+}
+
 func envToString(env map[string]interface{}) string {
 	var sb strings.Builder
 	for k, v := range env {
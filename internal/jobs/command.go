@@ -0,0 +1,181 @@
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// shellCommand is how the command is run when Docker.Shell is set
+var shellCommand = []string{"/bin/sh", "-c"}
+
+// Argv returns the arguments of the container: Args, or Command split in words or run by the
+// shell if Shell is set. It is empty when the CMD of the image has to be kept.
+func (d Docker) Argv() ([]string, error) {
+	if len(d.Args) > 0 {
+		if d.Shell {
+			return nil, errors.New("shell requires the command as a string")
+		}
+		return d.Args, nil
+	}
+
+	if strings.TrimSpace(d.Command) == "" {
+		return nil, nil
+	}
+	if d.Shell {
+		return append(append([]string{}, shellCommand...), d.Command), nil
+	}
+	return SplitWords(d.Command)
+}
+
+// CommandString returns the command as a single line, to show it to the user
+func (d Docker) CommandString() string {
+	if len(d.Args) > 0 {
+		return strings.Join(d.Args, " ")
+	}
+	return d.Command
+}
+
+// UnmarshalJSON accepts the command and the entrypoint either as an argv array or as a string,
+// which is split in words
+func (d *Docker) UnmarshalJSON(b []byte) error {
+	type plain Docker
+	var v struct {
+		plain
+		Command    json.RawMessage `json:"command"`
+		Entrypoint json.RawMessage `json:"entrypoint"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	*d = Docker(v.plain)
+
+	var err error
+	if d.Command, d.Args, err = stringOrArgv(v.Command); err != nil {
+		return fmt.Errorf("invalid command: %w", err)
+	}
+
+	line, entrypoint, err := stringOrArgv(v.Entrypoint)
+	if err != nil {
+		return fmt.Errorf("invalid entrypoint: %w", err)
+	}
+	d.Entrypoint = entrypoint
+	if line != "" {
+		if d.Entrypoint, err = SplitWords(line); err != nil {
+			return fmt.Errorf("invalid entrypoint: %w", err)
+		}
+	}
+	return nil
+}
+
+// MarshalJSON writes the command as it was given, as an array or as a string
+func (d Docker) MarshalJSON() ([]byte, error) {
+	type plain Docker
+	var command interface{} = d.Command
+	if len(d.Args) > 0 {
+		command = d.Args
+	}
+	return json.Marshal(struct {
+		plain
+		Command interface{} `json:"command"`
+	}{plain(d), command})
+}
+
+// stringOrArgv decodes a json string or array of strings
+func stringOrArgv(raw json.RawMessage) (string, []string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", nil, nil
+	}
+
+	var line string
+	if err := json.Unmarshal(raw, &line); err == nil {
+		return line, nil, nil
+	}
+
+	var argv []string
+	if err := json.Unmarshal(raw, &argv); err != nil {
+		return "", nil, errors.New("expected a string or an array of strings")
+	}
+	return "", argv, nil
+}
+
+// SplitWords splits a command line in words like a POSIX shell does, without expanding variables
+// or globs: the words are separated by blanks, single quotes keep everything literally, double
+// quotes keep everything but the backslash escapes of $, `, ", \ and newline, and a backslash
+// outside quotes escapes the next character.
+func SplitWords(line string) ([]string, error) {
+	var (
+		words   []string
+		word    strings.Builder
+		inWord  bool
+		escaped bool
+		quote   rune
+	)
+
+	for _, c := range line {
+		switch {
+		case escaped:
+			// an escaped newline joins the lines
+			if c != '\n' {
+				word.WriteRune(c)
+				inWord = true
+			}
+			escaped = false
+
+		case quote == '\'':
+			if c == '\'' {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+
+		case quote == '"':
+			switch c {
+			case '"':
+				quote = 0
+			case '\\':
+				// only some characters can be escaped, the backslash is kept before the others
+				quote = '\\'
+			default:
+				word.WriteRune(c)
+			}
+
+		case quote == '\\':
+			// the character after a backslash inside double quotes
+			if !strings.ContainsRune("$`\"\\\n", c) {
+				word.WriteRune('\\')
+			}
+			if c != '\n' {
+				word.WriteRune(c)
+			}
+			quote = '"'
+
+		case c == '\\':
+			escaped = true
+
+		case c == '\'' || c == '"':
+			quote = c
+			inWord = true
+
+		case c == ' ' || c == '\t' || c == '\n':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+
+		default:
+			word.WriteRune(c)
+			inWord = true
+		}
+	}
+
+	if escaped || quote != 0 {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
@@ -0,0 +1,95 @@
+package jobs
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Duration is a time.Duration that is encoded as a human-readable string ("1h30m") in json and
+// yaml, and as a number of seconds in the database. A zero Duration means "not set".
+type Duration time.Duration
+
+// Std returns the value as a time.Duration
+func (d Duration) Std() time.Duration {
+	return time.Duration(d)
+}
+
+// Seconds returns the duration as whole seconds, which is how it is stored in the database
+func (d Duration) Seconds() int64 {
+	return int64(time.Duration(d) / time.Second)
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	if d == 0 {
+		return []byte(`""`), nil
+	}
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON accepts either a duration string ("90s", "2h") or a number of seconds
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch value := v.(type) {
+	case nil:
+		*d = 0
+	case float64:
+		*d = Duration(value * float64(time.Second))
+	case string:
+		if value == "" {
+			*d = 0
+			return nil
+		}
+		parsed, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("parsing duration %q: %w", value, err)
+		}
+		*d = Duration(parsed)
+	default:
+		return fmt.Errorf("invalid duration %s", string(b))
+	}
+
+	return nil
+}
+
+func (d *Duration) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return fmt.Errorf("parsing duration %q: %w", s, err)
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// Value stores the duration as whole seconds
+func (d Duration) Value() (driver.Value, error) {
+	return d.Seconds(), nil
+}
+
+func (d *Duration) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case nil:
+		*d = 0
+	case int64:
+		*d = Duration(time.Duration(v) * time.Second)
+	case int32:
+		*d = Duration(time.Duration(v) * time.Second)
+	default:
+		return fmt.Errorf("cannot scan %T into Duration", src)
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package jobs
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+// PullPolicy tells the worker when to pull the image of a job, like in Kubernetes
+type PullPolicy string
+
+const (
+	// PullAlways pulls the image before every run
+	PullAlways PullPolicy = "Always"
+	// PullIfNotPresent only pulls the image if the worker does not have it
+	PullIfNotPresent PullPolicy = "IfNotPresent"
+	// PullNever uses the image of the worker, failing if it does not have it
+	PullNever PullPolicy = "Never"
+)
+
+// ParsePullPolicy parses a pull policy ignoring the case, the empty one is kept empty
+func ParsePullPolicy(s string) (PullPolicy, error) {
+	for _, p := range []PullPolicy{PullAlways, PullIfNotPresent, PullNever, ""} {
+		if strings.EqualFold(s, string(p)) {
+			return p, nil
+		}
+	}
+	return "", fmt.Errorf("unknown pull policy %q, it must be %s, %s or %s", s, PullAlways, PullIfNotPresent, PullNever)
+}
+
+// Pull returns the pull policy of the job. Without one, the images pinned by digest or with a tag
+// other than latest are pulled if they are not present, and the rest always.
+func (d Docker) Pull() PullPolicy {
+	if d.PullPolicy != "" {
+		return d.PullPolicy
+	}
+
+	named, err := reference.ParseNormalizedNamed(d.Image)
+	if err != nil {
+		return PullAlways
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return PullIfNotPresent
+	}
+	if tagged, ok := named.(reference.Tagged); ok && tagged.Tag() != "latest" {
+		return PullIfNotPresent
+	}
+	return PullAlways
+}
+
+// ValidateImage checks that the image is a valid reference, and that its digest is well formed
+// when it is pinned by one
+func ValidateImage(image string) error {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return fmt.Errorf("invalid image %q: %w", image, err)
+	}
+	if strings.Contains(image, "@") {
+		digested, ok := named.(reference.Digested)
+		if !ok {
+			return fmt.Errorf("invalid digest in image %q", image)
+		}
+		if err := digested.Digest().Validate(); err != nil {
+			return fmt.Errorf("invalid digest in image %q: %w", image, err)
+		}
+	}
+	return nil
+}
+
+// PullInfo describes how the worker made the image of a job available
+type PullInfo struct {
+	// Pulled is false when the image was already present and the pull policy allowed using it
+	Pulled   bool     `json:"pulled"`
+	Duration Duration `json:"duration"`
+	// Bytes are the bytes downloaded, the layers that were already present are not counted
+	Bytes        int64 `json:"bytes"`
+	Layers       int   `json:"layers"`
+	CachedLayers int   `json:"cached_layers"`
+	// ImageID and Digest identify the image that was used
+	ImageID string `json:"image_id,omitempty"`
+	Digest  string `json:"digest,omitempty"`
+}
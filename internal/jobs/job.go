@@ -13,11 +13,37 @@ type JobStatus string
 
 const (
 	Enqueued  JobStatus = "ENQUEUED"
+	Held      JobStatus = "HELD"
+	Failed    JobStatus = "FAILED"
+	Expired   JobStatus = "EXPIRED"
 	Running   JobStatus = "RUNNING"
 	Finished  JobStatus = "FINISHED"
 	Cancelled JobStatus = "CANCELLED"
+	TimedOut  JobStatus = "TIMED_OUT"
 )
 
+// StopReason is the reason why the server asks a worker to stop one of its running jobs
+type StopReason string
+
+const (
+	StopCancel  StopReason = "CANCEL"
+	StopPreempt StopReason = "PREEMPT"
+	// StopDrain requeues the job because its worker is being drained
+	StopDrain StopReason = "DRAIN"
+)
+
+// StopSignal tells a worker to stop one of its running jobs
+type StopSignal struct {
+	ID     uuid.UUID  `json:"id"`
+	Reason StopReason `json:"reason"`
+	By     string     `json:"by,omitempty"`
+	// Grace is the time the job has to exit after being signaled, overriding the worker default
+	Grace Duration `json:"grace,omitempty"`
+}
+
+// DefaultQueue is the queue a job is enqueued to when it does not specify one
+const DefaultQueue = "default"
+
 type Job struct {
 	ID          uuid.UUID   `json:"id" db:"id"`
 	Name        string      `json:"name" db:"name"`
@@ -27,12 +53,70 @@ type Job struct {
 	UpdatedAt   time.Time   `json:"updated_at" db:"updated_at"`
 	Status      JobStatus   `json:"status" db:"status"`
 	Metadata    interface{} `json:"metadata" db:"metadata"`
+	Queue       string      `json:"queue" db:"queue"`
+	// Timeout is the maximum time the job can be running. Zero means no limit.
+	Timeout   Duration   `json:"timeout" db:"timeout"`
+	StartedAt *time.Time `json:"started_at,omitempty" db:"started_at"`
+	// StopRequest is set when the job has been asked to stop while it was running
+	StopRequest StopReason `json:"stop_request,omitempty" db:"stop_request"`
+	CancelledBy string     `json:"cancelled_by,omitempty" db:"cancelled_by"`
+	// Priority orders the enqueued jobs, higher priorities are fetched first
+	Priority int `json:"priority" db:"priority"`
+	// Preemptible jobs can be stopped and requeued to make room for higher priority jobs
+	Preemptible bool `json:"preemptible" db:"preemptible"`
+	// Attempts is the number of times the job has been fetched by a worker
+	Attempts int `json:"attempts" db:"attempts"`
+	// User is the owner of the job, used to apply per-user limits
+	User string   `json:"user" db:"username"`
+	Tags []string `json:"tags" db:"tags"`
+	// GPUs is the number of GPUs the job uses
+	GPUs int `json:"gpus" db:"gpus"`
+	// BlockedReason explains why an enqueued job is not starting, like a concurrency limit
+	BlockedReason string `json:"blocked_reason,omitempty" db:"blocked_reason"`
+	// ExpiresAt is when the job expires if it has not started yet
+	ExpiresAt    *time.Time `json:"expires_at,omitempty" db:"expires_at"`
+	MaxQueueTime Duration   `json:"max_queue_time" db:"max_queue_time"`
+	// MaxRetries is how many times a failed job is requeued before it is dead-lettered
+	MaxRetries     int        `json:"max_retries" db:"max_retries"`
+	DeadLetteredAt *time.Time `json:"dead_lettered_at,omitempty" db:"dead_lettered_at"`
+	// Usage summarizes the resource usage reported by the worker while running
+	Usage *Usage `json:"usage,omitempty" db:"usage"`
+	// Pull is how the worker got the image in the last run
+	Pull *PullInfo `json:"pull,omitempty" db:"pull"`
+	// Worker is the ID of the worker that fetched the job the last time, cleared when the worker returns it
+	Worker *uuid.UUID `json:"worker,omitempty" db:"worker_id"`
+}
+
+// HasTag returns true if the job has the given tag
+func (j Job) HasTag(tag string) bool {
+	for _, t := range j.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
 }
 
 type Docker struct {
-	Image       string                 `json:"image" db:"docker_image"`
-	Command     string                 `json:"command" db:"docker_command"`
+	Image string `json:"image" db:"docker_image"`
+	// Command are the arguments of the container, they replace the CMD of the image and are given
+	// to its entrypoint. In json it is "command" as a string, and Args when it is an array.
+	Command string   `json:"-" db:"docker_command"`
+	Args    []string `json:"-" db:"docker_args"`
+	// Shell runs Command with /bin/sh -c instead of splitting it in words
+	Shell       bool                   `json:"shell,omitempty" db:"docker_shell"`
 	Environment map[string]interface{} `json:"environment" db:"docker_environment"`
+	// Entrypoint replaces the ENTRYPOINT of the image if it is set
+	Entrypoint []string `json:"entrypoint,omitempty" db:"docker_entrypoint"`
+	// Workdir and User replace the working directory and user of the image if they are set
+	Workdir   string    `json:"workdir,omitempty" db:"docker_workdir"`
+	User      string    `json:"user,omitempty" db:"docker_user"`
+	Resources Resources `json:"resources" db:"docker_resources"`
+	Mounts    []Mount   `json:"mounts,omitempty" db:"docker_mounts"`
+	// Outputs are the paths in the container copied to the artifacts of the job when it exits
+	Outputs []string `json:"outputs,omitempty" db:"docker_outputs"`
+	// PullPolicy is when the image is pulled, see Pull for the default
+	PullPolicy PullPolicy `json:"pull_policy,omitempty" db:"docker_pull_policy"`
 }
 
 const MagicEnd = "_#$#$#$<END>#$#$#$_"
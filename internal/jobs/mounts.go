@@ -0,0 +1,95 @@
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// MountType is the kind of storage mounted in the container of a job
+type MountType string
+
+const (
+	// MountBind mounts a path of the host
+	MountBind MountType = "bind"
+	// MountVolume mounts an existing named volume
+	MountVolume MountType = "volume"
+	// MountScratch mounts an empty volume created for the job and deleted after it runs
+	MountScratch MountType = "scratch"
+)
+
+// Mount is a host path or volume mounted in the container of a job
+type Mount struct {
+	// Type is guessed from Source if empty: an absolute path is a bind mount, a name a volume
+	Type MountType `json:"type,omitempty"`
+	// Source is the host path or the volume name, empty for scratch volumes
+	Source   string `json:"source,omitempty"`
+	Target   string `json:"target"`
+	ReadOnly bool   `json:"read_only,omitempty"`
+}
+
+// Kind returns the type of the mount, guessing it from the source if it is not set
+func (m Mount) Kind() MountType {
+	if m.Type != "" {
+		return m.Type
+	}
+	if strings.HasPrefix(m.Source, "/") {
+		return MountBind
+	}
+	return MountVolume
+}
+
+// ValidateMounts checks that the mounts are well formed. Whether the sources can be used is
+// checked by the worker, which has the allowlist.
+func ValidateMounts(mounts []Mount) error {
+	targets := make(map[string]bool)
+	for _, m := range mounts {
+		if !path.IsAbs(m.Target) {
+			return fmt.Errorf("mount target %q is not an absolute path", m.Target)
+		}
+		target := path.Clean(m.Target)
+		if target == "/" {
+			return fmt.Errorf("mount target can not be /")
+		}
+		if targets[target] {
+			return fmt.Errorf("mount target %q is repeated", target)
+		}
+		targets[target] = true
+
+		switch m.Kind() {
+		case MountBind:
+			if !path.IsAbs(m.Source) {
+				return fmt.Errorf("bind mount source %q is not an absolute path", m.Source)
+			}
+		case MountVolume:
+			if m.Source == "" || strings.ContainsAny(m.Source, "/\\") {
+				return fmt.Errorf("invalid volume name %q", m.Source)
+			}
+		case MountScratch:
+			if m.Source != "" {
+				return fmt.Errorf("scratch mount %q can not have a source", target)
+			}
+			if m.ReadOnly {
+				return fmt.Errorf("scratch mount %q can not be read only", target)
+			}
+		default:
+			return fmt.Errorf("unknown mount type %q", m.Type)
+		}
+	}
+	return nil
+}
+
+// ValidateOutputs checks that the outputs are paths of the container other than the root. A
+// relative path is inside the working directory of the job.
+func ValidateOutputs(outputs []string) error {
+	for _, o := range outputs {
+		if strings.TrimSpace(o) == "" {
+			return errors.New("empty output path")
+		}
+		if path.Clean(o) == "/" {
+			return errors.New("output can not be /")
+		}
+	}
+	return nil
+}
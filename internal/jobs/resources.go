@@ -0,0 +1,212 @@
+package jobs
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Resources are the limits and runtime options of the container of a job. Zero values keep the
+// defaults of the runtime.
+type Resources struct {
+	// CPUs is the number of cores the container can use, 1.5 is one and a half cores
+	CPUs   float64 `json:"cpus,omitempty" yaml:"cpus"`
+	Memory Size    `json:"memory,omitempty" yaml:"memory"`
+	// MemorySwap is the memory plus swap the container can use, -1 for unlimited swap
+	MemorySwap Size     `json:"memory_swap,omitempty" yaml:"memory_swap"`
+	ShmSize    Size     `json:"shm_size,omitempty" yaml:"shm_size"`
+	PidsLimit  int64    `json:"pids_limit,omitempty" yaml:"pids_limit"`
+	Ulimits    []Ulimit `json:"ulimits,omitempty" yaml:"ulimits"`
+}
+
+// Ulimit is a resource limit of the processes of the container, like "nofile"
+type Ulimit struct {
+	Name string `json:"name" yaml:"name"`
+	Soft int64  `json:"soft" yaml:"soft"`
+	Hard int64  `json:"hard" yaml:"hard"`
+}
+
+// ApplyMax sets the fields that were not given to max, the maximums of the queue, so that a job
+// cannot go over them by omitting a field and keeping the default of the runtime. The zero fields
+// of max have no maximum and are left as they are.
+func (r *Resources) ApplyMax(max Resources) {
+	if r.CPUs == 0 {
+		r.CPUs = max.CPUs
+	}
+	if r.Memory == 0 {
+		r.Memory = max.Memory
+	}
+	// memory_swap requires memory, and without memory the container has no swap limit to keep
+	if r.MemorySwap == 0 && r.Memory != 0 {
+		r.MemorySwap = max.MemorySwap
+	}
+	if r.ShmSize == 0 {
+		r.ShmSize = max.ShmSize
+	}
+	if r.PidsLimit == 0 {
+		r.PidsLimit = max.PidsLimit
+	}
+
+	for _, m := range max.Ulimits {
+		found := false
+		for _, u := range r.Ulimits {
+			if u.Name == m.Name {
+				found = true
+				break
+			}
+		}
+		if found {
+			continue
+		}
+		soft := m.Soft
+		if soft == 0 || soft > m.Hard {
+			soft = m.Hard
+		}
+		r.Ulimits = append(r.Ulimits, Ulimit{Name: m.Name, Soft: soft, Hard: m.Hard})
+	}
+}
+
+// Validate checks that the resources are valid and within max, the maximums of the queue. The zero
+// fields of max have no maximum. ApplyMax has to be called first, a job without a value gets none
+// checked.
+func (r Resources) Validate(max Resources) error {
+	if r.CPUs < 0 || r.Memory < 0 || r.ShmSize < 0 || r.PidsLimit < 0 || r.MemorySwap < -1 {
+		return fmt.Errorf("resources can not be negative")
+	}
+	if r.MemorySwap > 0 && r.MemorySwap < r.Memory {
+		return fmt.Errorf("memory_swap %s is lower than memory %s", r.MemorySwap, r.Memory)
+	}
+	if r.MemorySwap != 0 && r.Memory == 0 {
+		return fmt.Errorf("memory_swap requires memory")
+	}
+
+	if max.CPUs > 0 && r.CPUs > max.CPUs {
+		return fmt.Errorf("cpus %g is over the maximum of %g", r.CPUs, max.CPUs)
+	}
+	if max.Memory > 0 && r.Memory > max.Memory {
+		return fmt.Errorf("memory %s is over the maximum of %s", r.Memory, max.Memory)
+	}
+	if max.MemorySwap > 0 && (r.MemorySwap == -1 || r.MemorySwap > max.MemorySwap) {
+		return fmt.Errorf("memory_swap %s is over the maximum of %s", r.MemorySwap, max.MemorySwap)
+	}
+	if max.ShmSize > 0 && r.ShmSize > max.ShmSize {
+		return fmt.Errorf("shm_size %s is over the maximum of %s", r.ShmSize, max.ShmSize)
+	}
+	if max.PidsLimit > 0 && r.PidsLimit > max.PidsLimit {
+		return fmt.Errorf("pids_limit %d is over the maximum of %d", r.PidsLimit, max.PidsLimit)
+	}
+
+	seen := make(map[string]bool)
+	for _, u := range r.Ulimits {
+		if u.Name == "" {
+			return fmt.Errorf("ulimit without name")
+		}
+		if seen[u.Name] {
+			return fmt.Errorf("ulimit %q is repeated", u.Name)
+		}
+		seen[u.Name] = true
+		if u.Soft > u.Hard {
+			return fmt.Errorf("ulimit %q soft limit %d is over its hard limit %d", u.Name, u.Soft, u.Hard)
+		}
+		for _, m := range max.Ulimits {
+			if m.Name == u.Name && u.Hard > m.Hard {
+				return fmt.Errorf("ulimit %q hard limit %d is over the maximum of %d", u.Name, u.Hard, m.Hard)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Size is an amount of bytes, encoded as a number in json and accepted as a number or a string
+// with a unit ("512m", "8GiB"). The units are powers of 1024.
+type Size int64
+
+var sizeUnits = map[string]int64{
+	"":  1,
+	"b": 1,
+	"k": 1 << 10,
+	"m": 1 << 20,
+	"g": 1 << 30,
+	"t": 1 << 40,
+}
+
+// ParseSize parses a size with an optional unit: b, k, m, g or t, followed by an optional "b" or
+// "ib" ("512m", "512mb" and "512MiB" are the same). "-1" is the only negative size, used by
+// memory_swap for unlimited swap.
+func ParseSize(s string) (Size, error) {
+	value := strings.ToLower(strings.TrimSpace(s))
+	if value == "-1" {
+		return -1, nil
+	}
+	unit := strings.TrimLeft(value, "0123456789.")
+	number := strings.TrimSpace(value[:len(value)-len(unit)])
+	unit = strings.TrimSpace(unit)
+	if len(unit) > 1 {
+		unit = strings.TrimSuffix(strings.TrimSuffix(unit, "b"), "i")
+	}
+
+	mult, ok := sizeUnits[unit]
+	if !ok || number == "" {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q: %w", s, err)
+	}
+	return Size(n * float64(mult)), nil
+}
+
+func (s Size) String() string {
+	if s == -1 {
+		return "unlimited"
+	}
+	for _, unit := range []string{"t", "g", "m", "k"} {
+		if mult := sizeUnits[unit]; s >= Size(mult) && int64(s)%mult == 0 {
+			return fmt.Sprintf("%d%s", int64(s)/mult, unit)
+		}
+	}
+	return strconv.FormatInt(int64(s), 10)
+}
+
+func (s *Size) UnmarshalJSON(b []byte) error {
+	var v interface{}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch value := v.(type) {
+	case nil:
+		*s = 0
+	case float64:
+		*s = Size(value)
+	case string:
+		if value == "" {
+			*s = 0
+			return nil
+		}
+		parsed, err := ParseSize(value)
+		if err != nil {
+			return err
+		}
+		*s = parsed
+	default:
+		return fmt.Errorf("invalid size %s", string(b))
+	}
+	return nil
+}
+
+func (s *Size) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var str string
+	if err := unmarshal(&str); err != nil {
+		return err
+	}
+
+	parsed, err := ParseSize(str)
+	if err != nil {
+		return err
+	}
+	*s = parsed
+	return nil
+}
@@ -0,0 +1,105 @@
+package jobs
+
+import (
+	"time"
+)
+
+// StatsSample is the resource usage of a running job at a point in time
+type StatsSample struct {
+	Time time.Time `json:"time" db:"time"`
+	// CPU is the usage in percent of one core, 200 means two full cores
+	CPU float64 `json:"cpu" db:"cpu"`
+	// Memory and MemoryLimit are in bytes, the limit is zero if there is none
+	Memory      int64 `json:"memory" db:"memory"`
+	MemoryLimit int64 `json:"memory_limit" db:"memory_limit"`
+	// the network and block IO counters are in bytes since the container started
+	NetRx      int64 `json:"net_rx" db:"net_rx"`
+	NetTx      int64 `json:"net_tx" db:"net_tx"`
+	BlockRead  int64 `json:"block_read" db:"block_read"`
+	BlockWrite int64 `json:"block_write" db:"block_write"`
+}
+
+// Usage summarizes the resource usage samples of a job
+type Usage struct {
+	Samples    int     `json:"samples"`
+	AvgCPU     float64 `json:"avg_cpu"`
+	PeakCPU    float64 `json:"peak_cpu"`
+	AvgMemory  int64   `json:"avg_memory"`
+	PeakMemory int64   `json:"peak_memory"`
+	// the IO values are the highest counters reported
+	NetRx      int64 `json:"net_rx"`
+	NetTx      int64 `json:"net_tx"`
+	BlockRead  int64 `json:"block_read"`
+	BlockWrite int64 `json:"block_write"`
+}
+
+// Add returns the usage including the given samples
+func (u Usage) Add(samples ...StatsSample) Usage {
+	if len(samples) == 0 {
+		return u
+	}
+
+	cpu := u.AvgCPU * float64(u.Samples)
+	mem := float64(u.AvgMemory) * float64(u.Samples)
+	for _, s := range samples {
+		cpu += s.CPU
+		mem += float64(s.Memory)
+		u.PeakCPU = maxFloat(u.PeakCPU, s.CPU)
+		u.PeakMemory = maxInt(u.PeakMemory, s.Memory)
+		u.NetRx = maxInt(u.NetRx, s.NetRx)
+		u.NetTx = maxInt(u.NetTx, s.NetTx)
+		u.BlockRead = maxInt(u.BlockRead, s.BlockRead)
+		u.BlockWrite = maxInt(u.BlockWrite, s.BlockWrite)
+	}
+
+	u.Samples += len(samples)
+	u.AvgCPU = cpu / float64(u.Samples)
+	u.AvgMemory = int64(mem / float64(u.Samples))
+	return u
+}
+
+// Downsample groups the samples, sorted by time, in intervals of step. Each interval has the
+// average CPU and memory and the highest limit and IO counters of its samples.
+func Downsample(samples []StatsSample, step time.Duration) []StatsSample {
+	if step <= 0 || len(samples) == 0 {
+		return samples
+	}
+
+	var (
+		res   []StatsSample
+		count int
+	)
+	for _, s := range samples {
+		bucket := s.Time.Truncate(step)
+		if len(res) == 0 || !res[len(res)-1].Time.Equal(bucket) {
+			res = append(res, StatsSample{Time: bucket})
+			count = 0
+		}
+
+		b := &res[len(res)-1]
+		count++
+		// running averages
+		b.CPU += (s.CPU - b.CPU) / float64(count)
+		b.Memory += (s.Memory - b.Memory) / int64(count)
+		b.MemoryLimit = maxInt(b.MemoryLimit, s.MemoryLimit)
+		b.NetRx = maxInt(b.NetRx, s.NetRx)
+		b.NetTx = maxInt(b.NetTx, s.NetTx)
+		b.BlockRead = maxInt(b.BlockRead, s.BlockRead)
+		b.BlockWrite = maxInt(b.BlockWrite, s.BlockWrite)
+	}
+	return res
+}
+
+func maxInt(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func maxFloat(a, b float64) float64 {
+	if a > b {
+		return a
+	}
+	return b
+}
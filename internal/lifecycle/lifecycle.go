@@ -0,0 +1,145 @@
+// Package lifecycle runs the long-lived parts of a binary, like the http server or the slots of a
+// worker, and shuts them down when the process receives SIGINT or SIGTERM, waiting for them up to
+// a deadline.
+package lifecycle
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Manager starts the components and shuts them down
+type Manager struct {
+	// timeout is the longest the shutdown waits for the components, zero waits forever
+	timeout time.Duration
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	// ctx is cancelled once the deadline passes
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	wg sync.WaitGroup
+	mu sync.Mutex
+	// running are the components that have not returned, by name
+	running  map[string]int
+	deadline time.Time
+}
+
+// New returns a manager whose shutdown waits up to timeout for the components, or forever if it is
+// zero
+func New(timeout time.Duration) *Manager {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Manager{
+		timeout: timeout,
+		closing: make(chan struct{}),
+		ctx:     ctx,
+		cancel:  cancel,
+		running: make(map[string]int),
+	}
+}
+
+// Go runs a component in a new goroutine, the shutdown waits for it to return. If it fails before
+// the shutdown, the error is logged and the whole binary is shut down.
+func (m *Manager) Go(name string, fn func() error) {
+	m.mu.Lock()
+	m.running[name]++
+	m.mu.Unlock()
+
+	m.wg.Add(1)
+	go func() {
+		defer m.wg.Done()
+
+		err := fn()
+
+		m.mu.Lock()
+		if m.running[name]--; m.running[name] == 0 {
+			delete(m.running, name)
+		}
+		m.mu.Unlock()
+
+		if err != nil {
+			log.Printf("%s stopped: %v\n", name, err)
+			m.Shutdown()
+		}
+	}()
+}
+
+// Closing is closed when the shutdown starts, the components must stop taking new work
+func (m *Manager) Closing() <-chan struct{} {
+	return m.closing
+}
+
+// Context is cancelled when the shutdown deadline passes, the work still running is abandoned
+func (m *Manager) Context() context.Context {
+	return m.ctx
+}
+
+// Deadline returns when the shutdown stops waiting for the components. It is false before the
+// shutdown starts and if there is no timeout.
+func (m *Manager) Deadline() (time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.deadline, !m.deadline.IsZero()
+}
+
+// Shutdown starts the shutdown, it can be called more than once
+func (m *Manager) Shutdown() {
+	m.closeOnce.Do(func() {
+		if m.timeout > 0 {
+			m.mu.Lock()
+			m.deadline = time.Now().Add(m.timeout)
+			m.mu.Unlock()
+			time.AfterFunc(m.timeout, m.cancel)
+		}
+		close(m.closing)
+	})
+}
+
+// Wait blocks until SIGINT or SIGTERM is received, or Shutdown is called, and then waits for the
+// components to return. A second signal or the deadline end the wait earlier, returning the
+// names of the components that are still running.
+func (m *Manager) Wait() []string {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(c)
+
+	select {
+	case s := <-c:
+		log.Printf("received %s, shutting down\n", s)
+	case <-m.closing:
+	}
+	m.Shutdown()
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		m.cancel()
+		return nil
+	case <-m.ctx.Done():
+	case s := <-c:
+		log.Printf("received %s again, not waiting anymore\n", s)
+		m.cancel()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	pending := make([]string, 0, len(m.running))
+	for name := range m.running {
+		pending = append(pending, name)
+	}
+	sort.Strings(pending)
+	return pending
+}
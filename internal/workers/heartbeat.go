@@ -0,0 +1,53 @@
+package workers
+
+import (
+	"github.com/gofrs/uuid"
+	"gitlab-bcds.udg.edu/sergivb01/skeduler/internal/jobs"
+)
+
+// Heartbeat is sent periodically by a worker to tell the server which jobs it is running
+type Heartbeat struct {
+	// WorkerID is the ID given to the worker when it registered
+	WorkerID uuid.UUID   `json:"worker_id"`
+	Running  []uuid.UUID `json:"running"`
+	// Load is the load average of the last minute
+	Load float64 `json:"load"`
+	// FreeSlots is the number of slots that are idle, waiting for a job
+	FreeSlots int `json:"free_slots"`
+}
+
+// HeartbeatResponse contains the actions the server wants the worker to take
+type HeartbeatResponse struct {
+	Stop []jobs.StopSignal `json:"stop"`
+	// Register is true when the server does not know the worker, which has to register again
+	Register bool `json:"register,omitempty"`
+	// Cordoned tells the worker to stop fetching new jobs
+	Cordoned bool `json:"cordoned,omitempty"`
+	// Drain tells the worker what to do with its running jobs when it is being drained
+	Drain DrainMode `json:"drain,omitempty"`
+}
+
+// ReturnReason is why a worker hands jobs back to the server
+type ReturnReason string
+
+const (
+	// ReturnNotStarted are jobs claimed but not started, for example because the worker is
+	// shutting down
+	ReturnNotStarted ReturnReason = ""
+	// ReturnCheckpoint are running jobs stopped with SIGTERM by a worker that is shutting down, so
+	// that they could save a checkpoint
+	ReturnCheckpoint ReturnReason = "CHECKPOINT"
+	// ReturnKill are running jobs killed by a worker that is shutting down
+	ReturnKill ReturnReason = "KILL"
+	// ReturnPreempted are running jobs stopped to make room for a job with more priority
+	ReturnPreempted ReturnReason = "PREEMPTED"
+	// ReturnDrained are running jobs stopped because their worker is being drained
+	ReturnDrained ReturnReason = "DRAINED"
+)
+
+// ReturnedJobs is sent by a worker to hand back jobs, which are enqueued again
+type ReturnedJobs struct {
+	WorkerID uuid.UUID    `json:"worker_id"`
+	Jobs     []uuid.UUID  `json:"jobs"`
+	Reason   ReturnReason `json:"reason,omitempty"`
+}
@@ -0,0 +1,50 @@
+package workers
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+)
+
+// dockerHub is the name of the registry of the images without a registry host
+const dockerHub = "docker.io"
+
+// RegistryAuth are the credentials of a container registry
+type RegistryAuth struct {
+	Username string `json:"username,omitempty" yaml:"username"`
+	Password string `json:"password,omitempty" yaml:"password"`
+	// IdentityToken is an OAuth refresh token, used instead of the username and password
+	IdentityToken string `json:"identity_token,omitempty" yaml:"identity_token"`
+}
+
+// String hides the secrets, so that the credentials can be logged with the configuration
+func (a RegistryAuth) String() string {
+	return fmt.Sprintf("{Username:%s Password:<hidden>}", a.Username)
+}
+
+// RegistryHost returns the host of the registry of an image reference, docker.io for the Docker
+// Hub images
+func RegistryHost(image string) (string, error) {
+	named, err := reference.ParseNormalizedNamed(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference %q: %w", image, err)
+	}
+	return reference.Domain(named), nil
+}
+
+// NormalizeRegistry returns the host of a registry given as a host or an URL, so that it can be
+// compared with RegistryHost. The aliases of the Docker Hub are docker.io.
+func NormalizeRegistry(registry string) string {
+	registry = strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")
+	if i := strings.Index(registry, "/"); i >= 0 {
+		registry = registry[:i]
+	}
+	registry = strings.ToLower(registry)
+
+	switch registry {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return dockerHub
+	}
+	return registry
+}
@@ -0,0 +1,64 @@
+package workers
+
+import (
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+type Status string
+
+const (
+	Online  Status = "ONLINE"
+	Offline Status = "OFFLINE"
+)
+
+// DrainMode is what a draining worker does with its running jobs
+type DrainMode string
+
+const (
+	// DrainWait lets the running jobs finish
+	DrainWait DrainMode = "WAIT"
+	// DrainRequeue stops the running jobs and enqueues them again
+	DrainRequeue DrainMode = "REQUEUE"
+)
+
+// Registration is sent by a worker when it starts, describing the machine it runs on
+type Registration struct {
+	// Name identifies the worker, registering again with the same name replaces the old entry
+	Name     string            `json:"name"`
+	Hostname string            `json:"hostname"`
+	Version  string            `json:"version"`
+	Labels   map[string]string `json:"labels"`
+	GPUs     []string          `json:"gpus"`
+	CPUs     int               `json:"cpus"`
+	// Memory is the total memory of the machine in bytes
+	Memory int64 `json:"memory"`
+	// Slots is the number of jobs the worker can run at the same time
+	Slots int `json:"slots"`
+}
+
+// Worker is a registered worker and its last reported state
+type Worker struct {
+	ID       uuid.UUID         `json:"id" db:"id"`
+	Name     string            `json:"name" db:"name"`
+	Hostname string            `json:"hostname" db:"hostname"`
+	Version  string            `json:"version" db:"version"`
+	Labels   map[string]string `json:"labels" db:"labels"`
+	GPUs     []string          `json:"gpus" db:"gpus"`
+	CPUs     int               `json:"cpus" db:"cpus"`
+	Memory   int64             `json:"memory" db:"memory"`
+	Slots    int               `json:"slots" db:"slots"`
+	Status   Status            `json:"status" db:"status"`
+	// Cordoned workers are not given new jobs
+	Cordoned bool `json:"cordoned" db:"cordoned"`
+	// Drain is set when the worker is being drained, it is always cordoned too
+	Drain DrainMode `json:"drain,omitempty" db:"drain"`
+	// Load is the load average of the last minute reported in the last heartbeat
+	Load    float64     `json:"load" db:"load"`
+	Running []uuid.UUID `json:"running" db:"running"`
+	// FreeSlots is the number of idle slots reported in the last heartbeat
+	FreeSlots    int       `json:"free_slots" db:"free_slots"`
+	RegisteredAt time.Time `json:"registered_at" db:"registered_at"`
+	LastSeenAt   time.Time `json:"last_seen_at" db:"last_seen_at"`
+}
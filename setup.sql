@@ -1,4 +1,4 @@
-CREATE TYPE job_status AS ENUM ('ENQUEUED', 'RUNNING', 'FINISHED', 'CANCELLED');
+CREATE TYPE job_status AS ENUM ('ENQUEUED', 'RUNNING', 'FINISHED', 'CANCELLED', 'TIMED_OUT', 'HELD', 'FAILED', 'EXPIRED');
 
 CREATE TABLE jobs
 (
@@ -8,16 +8,103 @@ CREATE TABLE jobs
     description        text                                                    not null,
     docker_image       text                                                    not null,
     docker_command     text                                                    not null,
+    docker_args        text[]                   default '{}'                   not null,
+    docker_shell       boolean                  default false                  not null,
     docker_environment jsonb                                                   not null,
+    docker_entrypoint  text[]                   default '{}'                   not null,
+    docker_workdir     text                     default ''                     not null,
+    docker_user        text                     default ''                     not null,
+    docker_resources   jsonb                    default '{}'                   not null,
+    docker_mounts      jsonb                    default '[]'                   not null,
+    docker_outputs     text[]                   default '{}'                   not null,
+    docker_pull_policy text                     default ''                     not null,
     created_at         timestamp with time zone default CURRENT_TIMESTAMP      not null,
     updated_at         timestamp with time zone default CURRENT_TIMESTAMP      not null,
     status             job_status               default 'ENQUEUED'::job_status not null,
-    metadata           json
+    metadata           json,
+    queue              text                     default 'default'              not null,
+    timeout            integer                  default 0                      not null,
+    started_at         timestamp with time zone,
+    stop_request       text                     default ''                     not null,
+    cancelled_by       text                     default ''                     not null,
+    priority           integer                  default 0                      not null,
+    preemptible        boolean                  default false                  not null,
+    attempts           integer                  default 0                      not null,
+    username           text                     default ''                     not null,
+    tags               text[]                   default '{}'                   not null,
+    gpus               integer                  default 0                      not null,
+    blocked_reason     text                     default ''                     not null,
+    expires_at         timestamp with time zone,
+    max_queue_time     integer                  default 0                      not null,
+    max_retries        integer                  default 0                      not null,
+    dead_lettered_at   timestamp with time zone,
+    usage              jsonb,
+    pull               jsonb,
+    worker_id          uuid
 );
 
 CREATE INDEX jobs_status_index ON jobs (status);
 CREATE INDEX jobs_createdat_index ON jobs (created_at);
+CREATE INDEX jobs_priority_index ON jobs (priority DESC, created_at);
+CREATE INDEX jobs_deadletteredat_index ON jobs (dead_lettered_at) WHERE dead_lettered_at IS NOT NULL;
+
+CREATE TABLE idempotency_keys
+(
+    key          text                                               not null
+        primary key,
+    request_hash text                                               not null,
+    job_id       uuid
+        references jobs (id) on delete cascade,
+    created_at   timestamp with time zone default CURRENT_TIMESTAMP not null
+);
+
+CREATE INDEX idempotency_keys_createdat_index ON idempotency_keys (created_at);
+
+CREATE TABLE workers
+(
+    id            uuid                     default gen_random_uuid() not null
+        primary key,
+    name          text                                               not null
+        unique,
+    hostname      text                                               not null,
+    version       text                                               not null,
+    labels        jsonb                    default '{}'              not null,
+    gpus          text[]                   default '{}'              not null,
+    cpus          integer                  default 0                 not null,
+    memory        bigint                   default 0                 not null,
+    slots         integer                  default 0                 not null,
+    status        text                     default 'ONLINE'          not null,
+    cordoned      boolean                  default false             not null,
+    drain         text                     default ''                not null,
+    load          double precision         default 0                 not null,
+    running       uuid[]                   default '{}'              not null,
+    free_slots    integer                  default 0                 not null,
+    registered_at timestamp with time zone default CURRENT_TIMESTAMP not null,
+    last_seen_at  timestamp with time zone default CURRENT_TIMESTAMP not null
+);
+
+CREATE TABLE job_stats
+(
+    job_id       uuid                     not null
+        references jobs (id) on delete cascade,
+    time         timestamp with time zone not null,
+    cpu          double precision         default 0 not null,
+    memory       bigint                   default 0 not null,
+    memory_limit bigint                   default 0 not null,
+    net_rx       bigint                   default 0 not null,
+    net_tx       bigint                   default 0 not null,
+    block_read   bigint                   default 0 not null,
+    block_write  bigint                   default 0 not null
+);
+
+CREATE INDEX job_stats_job_index ON job_stats (job_id, time);
 
 ALTER TABLE jobs
     OWNER TO skeduler;
+ALTER TABLE idempotency_keys
+    OWNER TO skeduler;
+ALTER TABLE workers
+    OWNER TO skeduler;
+ALTER TABLE job_stats
+    OWNER TO skeduler;
 ALTER TYPE job_status OWNER TO skeduler;
\ No newline at end of file
@@ -0,0 +1,85 @@
+-- Esquema de la base de dades sqlite del servidor. Es crea amb:
+--   sqlite3 database.db < setup_sqlite.sql
+
+CREATE TABLE IF NOT EXISTS "jobs" (
+	"id" TEXT NOT NULL UNIQUE,
+	"name" TEXT NOT NULL,
+	"description" NUMERIC NOT NULL,
+	"docker_image" TEXT NOT NULL,
+	"docker_cmd" TEXT NOT NULL,
+	"docker_env" TEXT,
+	"created_at" INT NOT NULL DEFAULT (strftime('%s', 'now')),
+	"updated_at" INT NOT NULL DEFAULT (strftime('%s', 'now')),
+	"status" TEXT NOT NULL DEFAULT 'ENQUEUED',
+	"metadata" TEXT,
+	queue TEXT NOT NULL DEFAULT 'default',
+	timeout INT NOT NULL DEFAULT 0,
+	started_at INT,
+	stop_request TEXT NOT NULL DEFAULT '',
+	cancelled_by TEXT NOT NULL DEFAULT '',
+	priority INT NOT NULL DEFAULT 0,
+	preemptible INT NOT NULL DEFAULT 0,
+	attempts INT NOT NULL DEFAULT 0,
+	username TEXT NOT NULL DEFAULT '',
+	tags TEXT NOT NULL DEFAULT '[]',
+	gpus INT NOT NULL DEFAULT 0,
+	blocked_reason TEXT NOT NULL DEFAULT '',
+	expires_at INT,
+	max_queue_time INT NOT NULL DEFAULT 0,
+	max_retries INT NOT NULL DEFAULT 0,
+	dead_lettered_at INT,
+	usage TEXT,
+	docker_entrypoint TEXT NOT NULL DEFAULT '[]',
+	docker_workdir TEXT NOT NULL DEFAULT '',
+	docker_user TEXT NOT NULL DEFAULT '',
+	docker_resources TEXT NOT NULL DEFAULT '{}',
+	docker_args TEXT NOT NULL DEFAULT '[]',
+	docker_shell INT NOT NULL DEFAULT 0,
+	docker_mounts TEXT NOT NULL DEFAULT '[]',
+	docker_outputs TEXT NOT NULL DEFAULT '[]',
+	docker_pull_policy TEXT NOT NULL DEFAULT '',
+	pull TEXT,
+	worker_id TEXT,
+	PRIMARY KEY("id")
+);
+
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+	key TEXT NOT NULL PRIMARY KEY,
+	request_hash TEXT NOT NULL,
+	job_id TEXT REFERENCES jobs(id) ON DELETE CASCADE,
+	created_at INT NOT NULL DEFAULT (strftime('%s', 'now'))
+);
+
+CREATE TABLE IF NOT EXISTS workers (
+	id TEXT NOT NULL PRIMARY KEY,
+	name TEXT NOT NULL UNIQUE,
+	hostname TEXT NOT NULL,
+	version TEXT NOT NULL,
+	labels TEXT NOT NULL DEFAULT '{}',
+	gpus TEXT NOT NULL DEFAULT '[]',
+	cpus INT NOT NULL DEFAULT 0,
+	memory INT NOT NULL DEFAULT 0,
+	slots INT NOT NULL DEFAULT 0,
+	status TEXT NOT NULL DEFAULT 'ONLINE',
+	load REAL NOT NULL DEFAULT 0,
+	running TEXT NOT NULL DEFAULT '[]',
+	registered_at INT NOT NULL DEFAULT (strftime('%s', 'now')),
+	last_seen_at INT NOT NULL DEFAULT (strftime('%s', 'now')),
+	cordoned INT NOT NULL DEFAULT 0,
+	drain TEXT NOT NULL DEFAULT '',
+	free_slots INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS job_stats (
+	job_id TEXT NOT NULL,
+	time INT NOT NULL,
+	cpu REAL NOT NULL DEFAULT 0,
+	memory INT NOT NULL DEFAULT 0,
+	memory_limit INT NOT NULL DEFAULT 0,
+	net_rx INT NOT NULL DEFAULT 0,
+	net_tx INT NOT NULL DEFAULT 0,
+	block_read INT NOT NULL DEFAULT 0,
+	block_write INT NOT NULL DEFAULT 0
+);
+
+CREATE INDEX IF NOT EXISTS job_stats_job_index ON job_stats (job_id, time);
@@ -0,0 +1,105 @@
+-- Porta una base de dades creada amb una versió anterior de setup.sql a l'esquema actual. Es pot executar més
+-- d'una vegada: només afegeix el que falta.
+--   psql -U skeduler -d skeduler -f upgrade.sql
+-- Els valors nous de job_status s'afegeixen fora de cap transacció, per això no s'ha d'executar amb --single-transaction.
+
+ALTER TYPE job_status ADD VALUE IF NOT EXISTS 'TIMED_OUT';
+ALTER TYPE job_status ADD VALUE IF NOT EXISTS 'HELD';
+ALTER TYPE job_status ADD VALUE IF NOT EXISTS 'FAILED';
+ALTER TYPE job_status ADD VALUE IF NOT EXISTS 'EXPIRED';
+
+ALTER TABLE jobs
+    ADD COLUMN IF NOT EXISTS docker_args        text[]                   default '{}'      not null,
+    ADD COLUMN IF NOT EXISTS docker_shell       boolean                  default false     not null,
+    ADD COLUMN IF NOT EXISTS docker_entrypoint  text[]                   default '{}'      not null,
+    ADD COLUMN IF NOT EXISTS docker_workdir     text                     default ''        not null,
+    ADD COLUMN IF NOT EXISTS docker_user        text                     default ''        not null,
+    ADD COLUMN IF NOT EXISTS docker_resources   jsonb                    default '{}'      not null,
+    ADD COLUMN IF NOT EXISTS docker_mounts      jsonb                    default '[]'      not null,
+    ADD COLUMN IF NOT EXISTS docker_outputs     text[]                   default '{}'      not null,
+    ADD COLUMN IF NOT EXISTS docker_pull_policy text                     default ''        not null,
+    ADD COLUMN IF NOT EXISTS queue              text                     default 'default' not null,
+    ADD COLUMN IF NOT EXISTS timeout            integer                  default 0         not null,
+    ADD COLUMN IF NOT EXISTS started_at         timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS stop_request       text                     default ''        not null,
+    ADD COLUMN IF NOT EXISTS cancelled_by       text                     default ''        not null,
+    ADD COLUMN IF NOT EXISTS priority           integer                  default 0         not null,
+    ADD COLUMN IF NOT EXISTS preemptible        boolean                  default false     not null,
+    ADD COLUMN IF NOT EXISTS attempts           integer                  default 0         not null,
+    ADD COLUMN IF NOT EXISTS username           text                     default ''        not null,
+    ADD COLUMN IF NOT EXISTS tags               text[]                   default '{}'      not null,
+    ADD COLUMN IF NOT EXISTS gpus               integer                  default 0         not null,
+    ADD COLUMN IF NOT EXISTS blocked_reason     text                     default ''        not null,
+    ADD COLUMN IF NOT EXISTS expires_at         timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS max_queue_time     integer                  default 0         not null,
+    ADD COLUMN IF NOT EXISTS max_retries        integer                  default 0         not null,
+    ADD COLUMN IF NOT EXISTS dead_lettered_at   timestamp with time zone,
+    ADD COLUMN IF NOT EXISTS usage              jsonb,
+    ADD COLUMN IF NOT EXISTS pull               jsonb,
+    ADD COLUMN IF NOT EXISTS worker_id          uuid;
+
+CREATE INDEX IF NOT EXISTS jobs_priority_index ON jobs (priority DESC, created_at);
+CREATE INDEX IF NOT EXISTS jobs_deadletteredat_index ON jobs (dead_lettered_at) WHERE dead_lettered_at IS NOT NULL;
+
+CREATE TABLE IF NOT EXISTS idempotency_keys
+(
+    key          text                                               not null
+        primary key,
+    request_hash text                                               not null,
+    job_id       uuid
+        references jobs (id) on delete cascade,
+    created_at   timestamp with time zone default CURRENT_TIMESTAMP not null
+);
+
+CREATE INDEX IF NOT EXISTS idempotency_keys_createdat_index ON idempotency_keys (created_at);
+
+CREATE TABLE IF NOT EXISTS workers
+(
+    id            uuid                     default gen_random_uuid() not null
+        primary key,
+    name          text                                               not null
+        unique,
+    hostname      text                                               not null,
+    version       text                                               not null,
+    labels        jsonb                    default '{}'              not null,
+    gpus          text[]                   default '{}'              not null,
+    cpus          integer                  default 0                 not null,
+    memory        bigint                   default 0                 not null,
+    slots         integer                  default 0                 not null,
+    status        text                     default 'ONLINE'          not null,
+    cordoned      boolean                  default false             not null,
+    drain         text                     default ''                not null,
+    load          double precision         default 0                 not null,
+    running       uuid[]                   default '{}'              not null,
+    free_slots    integer                  default 0                 not null,
+    registered_at timestamp with time zone default CURRENT_TIMESTAMP not null,
+    last_seen_at  timestamp with time zone default CURRENT_TIMESTAMP not null
+);
+
+ALTER TABLE workers
+    ADD COLUMN IF NOT EXISTS cordoned   boolean default false not null,
+    ADD COLUMN IF NOT EXISTS drain      text    default ''    not null,
+    ADD COLUMN IF NOT EXISTS free_slots integer default 0     not null;
+
+CREATE TABLE IF NOT EXISTS job_stats
+(
+    job_id       uuid                     not null
+        references jobs (id) on delete cascade,
+    time         timestamp with time zone not null,
+    cpu          double precision         default 0 not null,
+    memory       bigint                   default 0 not null,
+    memory_limit bigint                   default 0 not null,
+    net_rx       bigint                   default 0 not null,
+    net_tx       bigint                   default 0 not null,
+    block_read   bigint                   default 0 not null,
+    block_write  bigint                   default 0 not null
+);
+
+CREATE INDEX IF NOT EXISTS job_stats_job_index ON job_stats (job_id, time);
+
+ALTER TABLE idempotency_keys
+    OWNER TO skeduler;
+ALTER TABLE workers
+    OWNER TO skeduler;
+ALTER TABLE job_stats
+    OWNER TO skeduler;